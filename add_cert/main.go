@@ -37,6 +37,7 @@ import (
 	"flag"
 	"io/ioutil"
 	"log"
+	"time"
 
 	"github.com/caoimhechaos/x509keyserver/keydb"
 )
@@ -48,10 +49,18 @@ func main() {
 	var kdb *keydb.X509KeyDB
 	var dbserver, keyspace string
 	var certpath string
+	var revoke, reindex bool
+	var count int
 	var err error
 
 	flag.StringVar(&certpath, "certificate-path", "cert.crt",
 		"Name of the certificate file to read")
+	flag.BoolVar(&revoke, "revoke", false,
+		"Mark the certificate as revoked instead of adding it")
+	flag.BoolVar(&reindex, "reindex", false,
+		"Rebuild the indices used for sorting and paginating certificates "+
+			"instead of adding a certificate; needed once for certificates "+
+			"which were added by older versions")
 
 	flag.StringVar(&dbserver, "cassandra-server", "localhost:9160",
 		"host:port pair of the Cassandra database server")
@@ -65,6 +74,15 @@ func main() {
 		log.Fatal("Error connecting to key database: ", err)
 	}
 
+	if reindex {
+		count, err = kdb.ReindexCertificates()
+		if err != nil {
+			log.Fatal("Error reindexing certificates after ", count, ": ", err)
+		}
+		log.Print("Reindexed ", count, " certificates")
+		return
+	}
+
 	pemdata, err = ioutil.ReadFile(certpath)
 	if err != nil {
 		log.Fatal("Unable to open ", certpath, ": ", err)
@@ -80,6 +98,14 @@ func main() {
 		log.Fatal("Error parsing certificate: ", err)
 	}
 
+	if revoke {
+		err = kdb.RevokeX509Certificate(cert.SerialNumber.Uint64(), time.Now())
+		if err != nil {
+			log.Fatal("Error revoking certificate: ", err)
+		}
+		return
+	}
+
 	err = kdb.AddX509Certificate(cert)
 	if err != nil {
 		log.Fatal("Error storing decoded certificate in database: ", err)
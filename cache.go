@@ -0,0 +1,245 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver
+
+import (
+	"container/list"
+	"crypto/x509"
+	"sync"
+	"time"
+)
+
+// Cache stores the certificates retrieved by X509KeyClient. Implementations
+// must be safe for concurrent use. The client takes care of ignoring and
+// deleting expired entries, so caches don't have to look at the expiry
+// time; caches which have a Prune(now time.Time) method get it called
+// regularly to remove expired entries in the background, though.
+type Cache interface {
+	// Get returns the entry for the certificate with the given index.
+	Get(index uint64) (*CacheEntry, bool)
+
+	// Set stores the entry for the certificate with the given index,
+	// replacing any previous entry.
+	Set(index uint64, entry *CacheEntry)
+
+	// Delete removes the entry for the certificate with the given index,
+	// if there is one.
+	Delete(index uint64)
+
+	// Len returns the number of entries in the cache.
+	Len() int
+}
+
+// CacheEntry is the information cached about an individual certificate.
+type CacheEntry struct {
+	// The certificate, or nil if the server doesn't know it.
+	Cert *x509.Certificate
+
+	// Time after which the entry must no longer be used. The zero time
+	// means the entry doesn't expire.
+	Expires time.Time
+
+	// Time after which the certificate should be fetched from the server
+	// again. Until it expires, the entry may still be used if the server
+	// can't be reached. The zero time means the entry is never refreshed.
+	Refresh time.Time
+}
+
+// Expired determines whether the entry should no longer be used at "now".
+func (e *CacheEntry) Expired(now time.Time) bool {
+	return !e.Expires.IsZero() && now.After(e.Expires)
+}
+
+// NeedsRefresh determines whether the certificate should be fetched from
+// the server again at "now".
+func (e *CacheEntry) NeedsRefresh(now time.Time) bool {
+	return e.Expired(now) || (!e.Refresh.IsZero() && now.After(e.Refresh))
+}
+
+// Implemented by caches which can remove expired entries themselves.
+type cachePruner interface {
+	Prune(now time.Time)
+}
+
+// LRUCache keeps up to a fixed number of certificates in memory, evicting
+// the least recently used one when a new certificate would exceed the
+// limit. It is the cache used by X509KeyClient unless configured otherwise.
+type LRUCache struct {
+	max_size int
+	lock     sync.Mutex
+	entries  map[uint64]*list.Element
+	order    *list.List
+}
+
+type cacheRecord struct {
+	Index uint64
+	Entry *CacheEntry
+}
+
+// NewLRUCache creates a new cache holding up to "max_size" certificates.
+// A negative size means the cache is unbounded, a size of 0 that nothing
+// is cached.
+func NewLRUCache(max_size int) *LRUCache {
+	return &LRUCache{
+		max_size: max_size,
+		entries:  make(map[uint64]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// Get looks up the certificate with the given index and marks it as
+// recently used.
+func (c *LRUCache) Get(index uint64) (*CacheEntry, bool) {
+	var elem *list.Element
+	var ok bool
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok = c.entries[index]; !ok {
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheRecord).Entry, true
+}
+
+// Set adds the certificate with the given index to the cache, evicting the
+// least recently used entries if necessary.
+func (c *LRUCache) Set(index uint64, entry *CacheEntry) {
+	var elem *list.Element
+	var ok bool
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok = c.entries[index]; ok {
+		elem.Value.(*cacheRecord).Entry = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	if c.max_size == 0 {
+		return
+	}
+
+	c.entries[index] = c.order.PushFront(&cacheRecord{
+		Index: index,
+		Entry: entry,
+	})
+	c.trim()
+}
+
+// Delete removes the entry for the certificate with the given index.
+func (c *LRUCache) Delete(index uint64) {
+	var elem *list.Element
+	var ok bool
+
+	c.lock.Lock()
+	if elem, ok = c.entries[index]; ok {
+		c.remove(elem)
+	}
+	c.lock.Unlock()
+}
+
+// Len returns the number of certificates currently in the cache.
+func (c *LRUCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
+
+// Prune removes all entries which expired before "now", and trims the
+// cache to its maximum size.
+func (c *LRUCache) Prune(now time.Time) {
+	var elem, next *list.Element
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for elem = c.order.Front(); elem != nil; elem = next {
+		next = elem.Next()
+		if elem.Value.(*cacheRecord).Entry.Expired(now) {
+			c.remove(elem)
+		}
+	}
+	c.trim()
+}
+
+// Remove the given entry from the cache. Must be called with the lock held.
+func (c *LRUCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheRecord).Index)
+}
+
+// Evict the least recently used entries until the cache is within its
+// size limit again. Must be called with the lock held.
+func (c *LRUCache) trim() {
+	if c.max_size < 0 {
+		return
+	}
+
+	for c.order.Len() > c.max_size {
+		c.remove(c.order.Back())
+	}
+}
+
+// NoCache is a Cache which doesn't store anything, so that every request
+// is sent to the server.
+type NoCache struct{}
+
+// Get never finds anything.
+func (NoCache) Get(index uint64) (*CacheEntry, bool) {
+	return nil, false
+}
+
+// Set discards the entry.
+func (NoCache) Set(index uint64, entry *CacheEntry) {
+}
+
+// Delete does nothing.
+func (NoCache) Delete(index uint64) {
+}
+
+// Len is always 0.
+func (NoCache) Len() int {
+	return 0
+}
+
+// A request to the server for a certificate which isn't cached yet. Other
+// callers asking for the same certificate wait for "done" to be closed and
+// share the result.
+type pendingFetch struct {
+	done chan struct{}
+	cert *x509.Certificate
+	err  error
+}
@@ -0,0 +1,123 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver_test
+
+import (
+	"testing"
+
+	"github.com/caoimhechaos/x509keyserver"
+)
+
+// Number of entries in the caches used for benchmarks.
+const benchmarkCacheSize = 100000
+
+// Create an LRU cache holding "size" entries.
+func filledLRUCache(size int) *x509keyserver.LRUCache {
+	var cache = x509keyserver.NewLRUCache(size)
+	var i int
+
+	for i = 0; i < size; i++ {
+		cache.Set(uint64(i), &x509keyserver.CacheEntry{})
+	}
+	return cache
+}
+
+func TestLRUCacheSetKeepsSize(t *testing.T) {
+	var cache = x509keyserver.NewLRUCache(10)
+	var ok bool
+	var i int
+
+	for i = 0; i < 100; i++ {
+		cache.Set(uint64(i), &x509keyserver.CacheEntry{})
+		if cache.Len() > 10 {
+			t.Fatalf("Cache holds %d entries after %d insertions, "+
+				"expected at most 10", cache.Len(), i+1)
+		}
+	}
+
+	// The most recently added entries must have been kept.
+	for i = 90; i < 100; i++ {
+		if _, ok = cache.Get(uint64(i)); !ok {
+			t.Errorf("Entry %d was evicted", i)
+		}
+	}
+	if _, ok = cache.Get(0); ok {
+		t.Error("Least recently used entry 0 was not evicted")
+	}
+}
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	var cache = filledLRUCache(3)
+	var ok bool
+
+	// Using entry 0 makes entry 1 the least recently used one.
+	cache.Get(0)
+	cache.Set(3, &x509keyserver.CacheEntry{})
+
+	if _, ok = cache.Get(1); ok {
+		t.Error("Entry 1 should have been evicted")
+	}
+	if _, ok = cache.Get(0); !ok {
+		t.Error("Recently used entry 0 was evicted")
+	}
+}
+
+func TestLRUCacheZeroSize(t *testing.T) {
+	var cache = x509keyserver.NewLRUCache(0)
+
+	cache.Set(1, &x509keyserver.CacheEntry{})
+	if cache.Len() != 0 {
+		t.Errorf("Cache of size 0 holds %d entries", cache.Len())
+	}
+}
+
+func BenchmarkLRUCacheGet(b *testing.B) {
+	var cache = filledLRUCache(benchmarkCacheSize)
+	var i int
+
+	b.ResetTimer()
+	for i = 0; i < b.N; i++ {
+		cache.Get(uint64(i % benchmarkCacheSize))
+	}
+}
+
+func BenchmarkLRUCacheSet(b *testing.B) {
+	var cache = filledLRUCache(benchmarkCacheSize)
+	var entry = &x509keyserver.CacheEntry{}
+	var i int
+
+	// Every insertion evicts the least recently used entry.
+	b.ResetTimer()
+	for i = 0; i < b.N; i++ {
+		cache.Set(uint64(benchmarkCacheSize+i), entry)
+	}
+}
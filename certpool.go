@@ -0,0 +1,188 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver
+
+import (
+	"context"
+	"crypto/x509"
+	"sync"
+	"time"
+)
+
+// CertPool creates a certificate pool from all certificates on the server
+// which match "filter". Revoked certificates are never added.
+func (cl *X509KeyClient) CertPool(ctx context.Context,
+	filter CertificateFilter) (*x509.CertPool, error) {
+	var pool = x509.NewCertPool()
+	var iter *CertificateIterator
+
+	if cl.closed() {
+		return nil, ErrClientClosed
+	}
+
+	filter.IncludeRevoked = false
+	iter = cl.Certificates(ctx, filter)
+	for iter.Next() {
+		pool.AddCert(iter.Certificate())
+	}
+	if iter.Err() != nil {
+		return nil, iter.Err()
+	}
+
+	return pool, nil
+}
+
+// RefreshingCertPool is a certificate pool created by CertPool which is
+// rebuilt regularly in the background, so that it follows the changes on
+// the server.
+type RefreshingCertPool struct {
+	client *X509KeyClient
+	filter CertificateFilter
+
+	lock    sync.RWMutex
+	pool    *x509.CertPool
+	updated time.Time
+	err     error
+
+	stop      chan struct{}
+	done      chan struct{}
+	stop_once sync.Once
+}
+
+// RefreshingCertPool creates a certificate pool from all certificates on
+// the server which match "filter", and rebuilds it every "interval" until
+// Close is called on the pool or the client. An interval of 0 means the
+// pool is only rebuilt by calling Refresh. Creating the pool fails if it
+// can't be built initially.
+func (cl *X509KeyClient) RefreshingCertPool(ctx context.Context,
+	filter CertificateFilter, interval time.Duration) (
+	*RefreshingCertPool, error) {
+	var ret = &RefreshingCertPool{
+		client: cl,
+		filter: filter,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	var err error
+
+	err = ret.Refresh(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if interval <= 0 {
+		close(ret.done)
+		return ret, nil
+	}
+
+	if !cl.addBackground() {
+		close(ret.done)
+		return nil, ErrClientClosed
+	}
+	go ret.refreshRegularly(interval)
+	return ret, nil
+}
+
+// Pool returns the most recently built certificate pool. The pool must not
+// be modified, since it may be in use elsewhere.
+func (p *RefreshingCertPool) Pool() *x509.CertPool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.pool
+}
+
+// LastUpdate returns the time the pool was last rebuilt successfully, and
+// the error encountered by the latest attempt, if it failed. The previous
+// pool remains in use if rebuilding it fails.
+func (p *RefreshingCertPool) LastUpdate() (time.Time, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.updated, p.err
+}
+
+// Refresh rebuilds the pool right away.
+func (p *RefreshingCertPool) Refresh(ctx context.Context) error {
+	var pool *x509.CertPool
+	var err error
+
+	pool, err = p.client.CertPool(ctx, p.filter)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.err = err
+	if err == nil {
+		p.pool = pool
+		p.updated = time.Now()
+	}
+	return err
+}
+
+// Close stops refreshing the pool. The last pool remains available.
+func (p *RefreshingCertPool) Close() {
+	p.stop_once.Do(func() {
+		close(p.stop)
+	})
+	<-p.done
+}
+
+// Rebuild the pool every "interval" until either the pool or the client is
+// closed.
+func (p *RefreshingCertPool) refreshRegularly(interval time.Duration) {
+	var ticker = time.NewTicker(interval)
+	var ctx, cancel = p.client.stopContext()
+
+	defer p.client.background.Done()
+	defer close(p.done)
+	defer cancel()
+	defer ticker.Stop()
+
+	// Don't keep Close waiting for a refresh in progress.
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.client.stop:
+			return
+		case <-ticker.C:
+			p.Refresh(ctx)
+		}
+	}
+}
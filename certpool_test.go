@@ -0,0 +1,234 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver_test
+
+import (
+	"context"
+	"crypto/x509"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caoimhechaos/x509keyserver"
+	"github.com/caoimhechaos/x509keyserver/x509keyservertest"
+)
+
+// Determine whether "cert" is trusted by "pool".
+func trustedBy(cert *x509.Certificate, pool *x509.CertPool) bool {
+	var err error
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     pool,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err == nil
+}
+
+func TestCertPool(t *testing.T) {
+	var server, ca = newTestServer(t)
+	var revoked, leaf *x509keyservertest.Certificate
+	var client *x509keyserver.X509KeyClient
+	var pool *x509.CertPool
+	var err error
+
+	defer server.Close()
+
+	revoked, err = x509keyservertest.NewCA("Revoked CA")
+	if err == nil {
+		leaf, err = ca.Issue("leaf.example.com")
+	}
+	if err == nil {
+		err = server.AddCertificates(revoked.Cert, leaf.Cert)
+	}
+	if err == nil {
+		err = server.Revoke(revoked.Cert.SerialNumber.Uint64())
+	}
+	if err != nil {
+		t.Fatal("Error adding certificates: ", err)
+	}
+
+	client, err = server.NewClient()
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	pool, err = client.CertPool(context.Background(),
+		x509keyserver.CertificateFilter{OnlyCA: true})
+	if err != nil {
+		t.Fatal("Error building certificate pool: ", err)
+	}
+	if !trustedBy(leaf.Cert, pool) {
+		t.Error("Certificate issued by a CA in the pool isn't trusted")
+	}
+	if trustedBy(revoked.Cert, pool) {
+		t.Error("Revoked CA was added to the pool")
+	}
+
+	// The leaf itself is not a CA, so it isn't in the pool.
+	if len(pool.Subjects()) != 1 {
+		t.Errorf("Pool holds %d certificates, expected 1",
+			len(pool.Subjects()))
+	}
+}
+
+func TestRefreshingCertPool(t *testing.T) {
+	var server, _ = newTestServer(t)
+	var added *x509keyservertest.Certificate
+	var client *x509keyserver.X509KeyClient
+	var pool *x509keyserver.RefreshingCertPool
+	var updated, last time.Time
+	var deadline time.Time = time.Now().Add(5 * time.Second)
+	var err error
+
+	defer server.Close()
+
+	client, err = server.NewClient()
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	pool, err = client.RefreshingCertPool(context.Background(),
+		x509keyserver.CertificateFilter{}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal("Error building certificate pool: ", err)
+	}
+	updated, err = pool.LastUpdate()
+	if err != nil || updated.IsZero() {
+		t.Fatalf("Initial pool not built: %v, %v", updated, err)
+	}
+
+	added, err = x509keyservertest.NewCA("Added CA")
+	if err == nil {
+		err = server.AddCertificates(added.Cert)
+	}
+	if err != nil {
+		t.Fatal("Error adding certificate: ", err)
+	}
+
+	for !trustedBy(added.Cert, pool.Pool()) {
+		if time.Now().After(deadline) {
+			t.Fatal("Certificate added to the server never made it " +
+				"into the pool")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pool.Close()
+	last, _ = pool.LastUpdate()
+	if !last.After(updated) {
+		t.Error("Last update time not advanced by the refresh")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	updated, _ = pool.LastUpdate()
+	if !updated.Equal(last) {
+		t.Error("Pool was rebuilt after being closed")
+	}
+	if !trustedBy(added.Cert, pool.Pool()) {
+		t.Error("Last pool not available after closing")
+	}
+}
+
+func TestRefreshingCertPoolStopsWithClient(t *testing.T) {
+	var server, _ = newTestServer(t)
+	var client *x509keyserver.X509KeyClient
+	var pool *x509keyserver.RefreshingCertPool
+	var requests int
+	var err error
+
+	defer server.Close()
+
+	client, err = server.NewClient()
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	pool, err = client.RefreshingCertPool(context.Background(),
+		x509keyserver.CertificateFilter{}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal("Error building certificate pool: ", err)
+	}
+
+	client.Close()
+	requests = server.Requests("ListCertificates")
+	time.Sleep(50 * time.Millisecond)
+	if server.Requests("ListCertificates") != requests {
+		t.Error("Pool was rebuilt after the client was closed")
+	}
+
+	// Closing the pool as well must not block.
+	pool.Close()
+
+	_, err = client.RefreshingCertPool(context.Background(),
+		x509keyserver.CertificateFilter{}, 10*time.Millisecond)
+	if err != x509keyserver.ErrClientClosed {
+		t.Errorf("Expected ErrClientClosed from a closed client, got %v",
+			err)
+	}
+}
+
+func TestRefreshingCertPoolRacesWithClose(t *testing.T) {
+	var server, _ = newTestServer(t)
+	var client *x509keyserver.X509KeyClient
+	var wg sync.WaitGroup
+	var i int
+	var err error
+
+	defer server.Close()
+
+	client, err = server.NewClient()
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+
+	for i = 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			var pool *x509keyserver.RefreshingCertPool
+			var err error
+
+			defer wg.Done()
+			pool, err = client.RefreshingCertPool(context.Background(),
+				x509keyserver.CertificateFilter{}, time.Millisecond)
+			if err == nil {
+				pool.Close()
+			} else if err != x509keyserver.ErrClientClosed {
+				t.Error("Error building certificate pool: ", err)
+			}
+		}()
+	}
+
+	client.Close()
+	wg.Wait()
+}
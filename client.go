@@ -31,150 +31,634 @@
 
 package x509keyserver
 
+// The protocol buffer messages and the gRPC service in keydata.pb.go are
+// generated from keydata.proto, and must be regenerated whenever it
+// changes.
+//go:generate protoc --go_out=plugins=grpc:. keydata.proto
+
 import (
 	"context"
 	"crypto/x509"
-	"expvar"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/caoimhechaos/go-urlconnection"
 	"github.com/golang/protobuf/proto"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
 )
 
+// ErrClientClosed is returned by all requests made after the client has been
+// closed.
+var ErrClientClosed = errors.New("Client has been closed")
+
+// ErrNoServers is returned when creating a client without any servers.
+var ErrNoServers = errors.New("No servers specified")
+
+// Used for generating unique resolver schemes for multi server clients.
+var resolverSequence uint64
+
+// ErrCertificateRevoked is returned when the server reports that the
+// requested certificate has been revoked. Earlier versions of the client
+// returned revoked certificates like any other.
+var ErrCertificateRevoked = errors.New("Certificate has been revoked")
+
+// Returned for certificates which are cached as not existing.
+var errNotFoundCached = status.Error(codes.NotFound,
+	"Certificate not found (cached)")
+
 // Implementation of the X.509 key server RPC interface from the client side.
-// Essentially implements a caching client which will keep up to
-// "max_cache_size" records in its cache. They never expire since certificate
-// index numbers shouldn't be reused and should therefor be unique.
+// Essentially implements a caching client which by default will keep a
+// fixed number of records in its cache, evicting the least recently used
+// ones. Since certificate index numbers shouldn't be reused, records are
+// kept until the certificate expires, and refreshed after the TTL if one is
+// configured. Expired records are removed every "cache_prune_interval".
 type X509KeyClient struct {
 	client               X509KeyServerClient
-	key_cache            map[uint64]*cacheRecord
-	cache_lock           sync.RWMutex
-	max_cache_size       int
+	key_cache            Cache
+	disk_cache           *diskCache
+	pending_lock         sync.Mutex
+	pending              map[uint64]*pendingFetch
+	cache_ttl            time.Duration
+	negative_ttl         time.Duration
 	timeout              time.Duration
+	retry_policy         *RetryPolicy
+	stale_on_error       bool
 	cache_prune_interval time.Duration
-}
+	metrics              *clientMetrics
 
-type cacheRecord struct {
-	Cert     *x509.Certificate
-	LastUsed time.Time
-}
+	// Interval of the background refresh, and the certificates found in
+	// the cache since it last ran.
+	refresh_interval time.Duration
+	hot_lock         sync.Mutex
+	hot              map[uint64]struct{}
+
+	// Closed once the certificates requested with WithPreload and
+	// WithPreloadRecent have been retrieved, if any were; "preload_err"
+	// is only set before that.
+	preload_done chan struct{}
+	preload_err  error
 
-var key_cache_size = expvar.NewInt("x509-key-cache-size")
-var key_cache_requests = expvar.NewInt("x509-key-cache-requests")
-var key_cache_hits = expvar.NewInt("x509-key-cache-hits")
-var key_cache_misses = expvar.NewInt("x509-key-cache-misses")
-var key_cache_errors = expvar.NewMap("x509-key-cache-errors")
+	// Connection to close along with the client, if we created it.
+	conn *grpc.ClientConn
+
+	// Closed to tell background work to stop; "background" keeps track
+	// of the goroutines which need to finish before Close returns. Once
+	// the client has been created, goroutines are only added to it while
+	// holding "background_lock", which Close holds while closing "stop".
+	stop            chan struct{}
+	background      sync.WaitGroup
+	background_lock sync.Mutex
+	close_once      sync.Once
+}
 
 // Create a new caching X509 key client. "server" will be the server to
 // connect to for retrieving certificates, "max_size" is the maximum size
-// we'll want the cache to have, and "cache_prune_interval" is the
-// maximum amount of time we'll allow the cache to go over quota.
+// we'll want the cache to have, and "cache_prune_interval" is the interval
+// at which expired certificates are removed from the cache.
+//
+// This is equivalent to calling NewClient with WithCacheSize(max_size),
+// WithRequestTimeout(timeout), WithDialTimeout(timeout) and
+// WithCachePruneInterval(cache_prune_interval).
 func NewX509KeyClient(
 	server string,
 	max_size int,
 	timeout time.Duration,
 	cache_prune_interval time.Duration) (*X509KeyClient, error) {
+	return NewClient(server,
+		WithCacheSize(max_size),
+		WithRequestTimeout(timeout),
+		WithDialTimeout(timeout),
+		WithCachePruneInterval(cache_prune_interval))
+}
+
+// Create a new caching X509 key client connected to "server", configured
+// by "opts". Unless specified otherwise, the client caches up to
+// DefaultCacheSize certificates, uses an unencrypted connection and
+// resolves the server address using go-urlconnection.
+//
+// If "server" is a gRPC target such as "dns:///keys.example.com:1234"
+// which resolves to several addresses, requests are balanced across all
+// of them which are reachable.
+//
+// Certificates which have been revoked are never returned, and cached
+// copies are dropped once the server reports the revocation; requests
+// for them fail with ErrCertificateRevoked. Use WithCacheTTL to notice
+// revocations of cached certificates before they expire.
+func NewClient(server string, opts ...ClientOption) (*X509KeyClient, error) {
+	var o = &clientOptions{
+		cache_size:     DefaultCacheSize,
+		timeout:        DefaultTimeout,
+		dial_timeout:   DefaultDialTimeout,
+		prune_interval: DefaultCachePruneInterval,
+		creds:          insecure.NewCredentials(),
+	}
+	var dial_opts []grpc.DialOption
 	var conn *grpc.ClientConn
 	var ret *X509KeyClient
+	var disk *diskCache
+	var opt ClientOption
 	var err error
 
-	conn, err = grpc.Dial(server,
-		grpc.WithDialer(urlconnection.ConnectTimeout),
-		grpc.WithTimeout(timeout))
+	for _, opt = range opts {
+		opt(o)
+	}
+
+	if o.disk_dir != "" {
+		disk, err = newDiskCache(o.disk_dir, o.cache_size, o.cache_ttl)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if o.dialer == nil {
+		o.dialer = urlconnectionDialer(o.dial_timeout)
+	}
+
+	dial_opts = []grpc.DialOption{
+		grpc.WithTransportCredentials(o.creds),
+		grpc.WithContextDialer(o.dialer),
+		grpc.WithChainUnaryInterceptor(o.interceptors...),
+		grpc.WithDefaultServiceConfig(serviceConfig),
+	}
+
+	conn, err = grpc.Dial(server, append(dial_opts, o.dial_options...)...)
 	if err != nil {
 		return nil, err
 	}
 
-	ret = &X509KeyClient{
-		client:               NewX509KeyServerClient(conn),
-		key_cache:            make(map[uint64]*cacheRecord),
-		max_cache_size:       max_size,
-		timeout:              timeout,
-		cache_prune_interval: cache_prune_interval,
+	ret = newX509KeyClient(NewX509KeyServerClient(conn), o.cache_size,
+		o.timeout)
+	ret.disk_cache = disk
+	if o.cache != nil {
+		ret.key_cache = o.cache
 	}
+	ret.retry_policy = o.retry_policy
+	ret.stale_on_error = o.stale_on_error
+	ret.cache_ttl = o.cache_ttl
+	ret.negative_ttl = o.negative_ttl
+	ret.cache_prune_interval = o.prune_interval
+	ret.conn = conn
+	if o.metrics_sink != nil {
+		ret.SetMetricsSink(o.metrics_sink)
+	}
+	ret.refresh_interval = o.refresh_interval
+	ret.startSweeper()
 
-	// Spawn a thread to regularly trim the cache back to its maximum size.
-	go ret.TrimCache()
+	if o.refresh_interval > 0 {
+		ret.background.Add(1)
+		go ret.refreshHotEntries()
+	}
+	if len(o.preload) > 0 || o.preload_recent > 0 {
+		ret.preload_done = make(chan struct{})
+		ret.background.Add(1)
+		go ret.preloadInBackground(o.preload, o.preload_recent)
+	}
 	return ret, nil
 }
 
-// Clean up old certificate entries.
-func (cl *X509KeyClient) TrimCache() {
-	c := time.Tick(cl.cache_prune_interval)
+// Create a new caching X509 key client which balances its requests across
+// all reachable servers in "servers", so that requests keep working as
+// long as any of them is up. See NewClient for the available options.
+func NewMultiServerClient(servers []string, opts ...ClientOption) (
+	*X509KeyClient, error) {
+	var addrs []resolver.Address
+	var r *manual.Resolver
+	var server string
+
+	if len(servers) == 0 {
+		return nil, ErrNoServers
+	}
+
+	for _, server = range servers {
+		addrs = append(addrs, resolver.Address{Addr: server})
+	}
+
+	// Every client needs its own resolver scheme.
+	r = manual.NewBuilderWithScheme(fmt.Sprintf("x509keyserver-%d",
+		atomic.AddUint64(&resolverSequence, 1)))
+	r.InitialState(resolver.State{Addresses: addrs})
+
+	return NewClient(r.Scheme()+":///",
+		append(opts, WithDialOptions(grpc.WithResolvers(r)))...)
+}
+
+// Create a new caching X509 key client which sends its requests over the
+// existing connection "conn". The connection remains owned by the caller
+// and is not closed by Close.
+func NewX509KeyClientFromConn(
+	conn *grpc.ClientConn,
+	max_size int,
+	timeout time.Duration) *X509KeyClient {
+	var ret = newX509KeyClient(NewX509KeyServerClient(conn), max_size,
+		timeout)
+
+	ret.startSweeper()
+	return ret
+}
 
-	// Negative cache sizes don't make any sense.
-	if cl.max_cache_size < 0 {
+func newX509KeyClient(
+	client X509KeyServerClient,
+	max_size int,
+	timeout time.Duration) *X509KeyClient {
+	return &X509KeyClient{
+		client:               client,
+		key_cache:            NewLRUCache(max_size),
+		pending:              make(map[uint64]*pendingFetch),
+		timeout:              timeout,
+		cache_prune_interval: DefaultCachePruneInterval,
+		metrics:              newClientMetrics(),
+		hot:                  make(map[uint64]struct{}),
+		stop:                 make(chan struct{}),
+	}
+}
+
+// Start removing expired entries from the cache in the background, unless
+// pruning has been disabled.
+func (cl *X509KeyClient) startSweeper() {
+	if cl.cache_prune_interval <= 0 {
 		return
 	}
 
-	for _ = range c {
-		cl.cache_lock.Lock()
-		for len(cl.key_cache) > cl.max_cache_size {
-			var cur, min *cacheRecord
-			var key, min_key uint64
-			for key, cur = range cl.key_cache {
-				if min == nil || cur.LastUsed.Before(min.LastUsed) {
-					min_key = key
-					min = cur
-				}
-			}
+	cl.background.Add(1)
+	go cl.sweepCache()
+}
 
-			// We found a minimal key, delete it.
-			if min != nil {
-				delete(cl.key_cache, min_key)
-				key_cache_size.Set(int64(len(cl.key_cache)))
-			}
+// Regularly remove expired entries from the cache until the client is
+// closed.
+func (cl *X509KeyClient) sweepCache() {
+	var ticker = time.NewTicker(cl.cache_prune_interval)
+
+	defer cl.background.Done()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cl.stop:
+			return
+		case <-ticker.C:
+			cl.TrimCache()
+		}
+	}
+}
+
+// Close stops all background work of the client and closes the connection
+// to the server if it was opened by the client. Requests made after Close
+// fail with ErrClientClosed. Closing a client more than once has no effect.
+func (cl *X509KeyClient) Close() error {
+	var err error
+
+	cl.close_once.Do(func() {
+		cl.background_lock.Lock()
+		close(cl.stop)
+		cl.background_lock.Unlock()
+
+		cl.background.Wait()
+		if cl.conn != nil {
+			err = cl.conn.Close()
+		}
+	})
+
+	return err
+}
+
+// Register a goroutine which Close has to wait for. Returns false if the
+// client has been closed already, in which case it must not be started.
+func (cl *X509KeyClient) addBackground() bool {
+	cl.background_lock.Lock()
+	defer cl.background_lock.Unlock()
+
+	if cl.closed() {
+		return false
+	}
+	cl.background.Add(1)
+	return true
+}
+
+// Determine whether Close has been called on the client.
+func (cl *X509KeyClient) closed() bool {
+	select {
+	case <-cl.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetMetricsSink makes the client report all changes to its metrics to
+// "sink" in addition to keeping track of them for Stats(). Passing nil
+// disables reporting.
+func (cl *X509KeyClient) SetMetricsSink(sink MetricsSink) {
+	cl.metrics.setSink(sink)
+}
+
+// Stats returns a snapshot of the metrics of this client.
+func (cl *X509KeyClient) Stats() *ClientStats {
+	return cl.metrics.snapshot()
+}
+
+// Clean up old certificate entries. Expired entries are removed, and the
+// cache is trimmed to its maximum size. This happens automatically every
+// "cache_prune_interval", but can be triggered manually as well.
+func (cl *X509KeyClient) TrimCache() {
+	var pruner cachePruner
+	var ok bool
+
+	if pruner, ok = cl.key_cache.(cachePruner); ok {
+		pruner.Prune(time.Now())
+	}
+	cl.metrics.setCacheSize(cl.key_cache.Len())
+}
+
+// Look up the certificate with the given index in the cache, removing the
+// entry if it has expired. If the certificate is cached as not existing,
+// the certificate returned is nil.
+func (cl *X509KeyClient) cacheGet(index uint64) (*x509.Certificate, bool) {
+	var entry *CacheEntry
+	var ok bool
+
+	if entry, ok = cl.key_cache.Get(index); !ok {
+		return nil, false
+	}
+
+	if entry.Expired(time.Now()) {
+		cl.key_cache.Delete(index)
+		cl.metrics.setCacheSize(cl.key_cache.Len())
+		return nil, false
+	}
+
+	// Entries due for a refresh are kept in case the server is down.
+	if entry.NeedsRefresh(time.Now()) {
+		return nil, false
+	}
+
+	return entry.Cert, true
+}
+
+// Find a cached copy of the certificate with the given index which is due
+// to be refreshed, but may still be used if the server can't be reached.
+func (cl *X509KeyClient) staleCertificate(index uint64) *x509.Certificate {
+	var entry *CacheEntry
+	var cert *x509.Certificate
+	var ok bool
+
+	entry, ok = cl.key_cache.Get(index)
+	if ok && entry.Cert != nil && !entry.Expired(time.Now()) {
+		return entry.Cert
+	}
+
+	if cl.disk_cache != nil {
+		if cert, _, ok = cl.disk_cache.load(index); ok {
+			return cert
 		}
-		cl.cache_lock.Unlock()
 	}
+
+	return nil
+}
+
+// Convert a certificate found in the cache into the result of a request.
+func cachedResult(cert *x509.Certificate) (*x509.Certificate, error) {
+	if cert == nil {
+		return nil, errNotFoundCached
+	}
+	return cert, nil
 }
 
-// Retrieve the certificate associated with the given key ID.
+// Update the cache with the result of asking the server for the certificate
+// with the given index.
+func (cl *X509KeyClient) storeResult(index uint64, cert *x509.Certificate,
+	err error) {
+	var now time.Time = time.Now()
+	var entry *CacheEntry
+
+	switch {
+	case err == nil:
+		entry = &CacheEntry{
+			Cert:    cert,
+			Expires: cert.NotAfter,
+		}
+		if cl.cache_ttl > 0 {
+			entry.Refresh = now.Add(cl.cache_ttl)
+		}
+		if !entry.Expired(now) {
+			cl.key_cache.Set(index, entry)
+		} else {
+			cl.key_cache.Delete(index)
+		}
+	case status.Code(err) == codes.NotFound:
+		if cl.negative_ttl > 0 {
+			cl.key_cache.Set(index, &CacheEntry{
+				Expires: now.Add(cl.negative_ttl),
+			})
+		} else {
+			cl.key_cache.Delete(index)
+		}
+	case err == ErrCertificateRevoked:
+		cl.key_cache.Delete(index)
+	}
+
+	cl.metrics.setCacheSize(cl.key_cache.Len())
+}
+
+// Retrieve the certificate associated with the given key ID. Concurrent
+// requests for a certificate which isn't cached yet are answered by a
+// single RPC to the server. Returns ErrCertificateRevoked if the
+// certificate has been revoked.
 func (cl *X509KeyClient) RetrieveCertificateByIndex(index uint64) (*x509.Certificate, error) {
-	var res *X509KeyData
-	var c context.Context
+	return cl.RetrieveCertificateByIndexContext(context.Background(), index)
+}
+
+// Retrieve the certificate associated with the given key ID. The RPC to the
+// server, if any, is subject to the deadline, cancellation and metadata of
+// "ctx" as well as the client timeout, unless overridden in "opts".
+//
+// If the client was created with WithStaleOnError and the server can't be
+// reached, a cached certificate which is due to be refreshed is returned
+// instead of the error. Use WithResultInfo to find out whether this
+// happened.
+//
+// Returns ErrCertificateRevoked if the certificate has been revoked, and
+// a NotFound status if the server doesn't know it.
+func (cl *X509KeyClient) RetrieveCertificateByIndexContext(
+	ctx context.Context, index uint64, opts ...CallOption) (
+	*x509.Certificate, error) {
+	var o = cl.callOptions(opts)
+	var cancel context.CancelFunc
+	var cert, stale *x509.Certificate
+	var err error
+
+	if cl.closed() {
+		return nil, ErrClientClosed
+	}
+
+	if o.info != nil {
+		*o.info = ResultInfo{}
+	}
+
+	if o.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+
+	cert, err = cl.retrieve(ctx, index, o)
+	if err == nil || !cl.stale_on_error || !isUnavailableError(err) {
+		return cert, err
+	}
+
+	if stale = cl.staleCertificate(index); stale == nil {
+		return nil, err
+	}
+
+	cl.metrics.incr(&cl.metrics.staleResults, MetricStaleResults)
+	if o.info != nil {
+		o.info.Cached = true
+		o.info.Stale = true
+		o.info.Err = err
+	}
+	return stale, nil
+}
+
+// Retrieve the certificate associated with the given key ID from the cache
+// or the server.
+func (cl *X509KeyClient) retrieve(ctx context.Context, index uint64,
+	o *callOptions) (*x509.Certificate, error) {
+	var fetch *pendingFetch
+	var cert *x509.Certificate
+	var ok bool
+
+	cl.metrics.incr(&cl.metrics.cacheRequests, MetricCacheRequests)
+
+	if o.bypass_cache {
+		cl.metrics.incr(&cl.metrics.cacheMisses, MetricCacheMisses)
+		return cl.fetchAndStore(ctx, index)
+	}
+
+	if cert, ok = cl.cacheGet(index); ok {
+		cl.metrics.incr(&cl.metrics.cacheHits, MetricCacheHits)
+		cl.markHot(index)
+		o.setCached()
+		return cachedResult(cert)
+	}
+	cl.metrics.incr(&cl.metrics.cacheMisses, MetricCacheMisses)
+
+	for {
+		// Wait for the result if someone is already asking the server.
+		cl.pending_lock.Lock()
+		if fetch, ok = cl.pending[index]; !ok {
+			fetch = &pendingFetch{done: make(chan struct{})}
+			cl.pending[index] = fetch
+			cl.pending_lock.Unlock()
+			break
+		}
+		cl.pending_lock.Unlock()
+
+		select {
+		case <-fetch.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		// If the other caller gave up before the server answered, ask
+		// again ourselves rather than failing as well.
+		if isContextError(fetch.err) && ctx.Err() == nil {
+			if cert, ok = cl.cacheGet(index); ok {
+				o.setCached()
+				return cachedResult(cert)
+			}
+			continue
+		}
+		return fetch.cert, fetch.err
+	}
+
+	// Requests which finished since we looked at the cache have stored
+	// their result there.
+	if cert, ok = cl.cacheGet(index); ok {
+		o.setCached()
+		fetch.cert, fetch.err = cachedResult(cert)
+	} else {
+		fetch.cert, fetch.err = cl.loadCertificate(ctx, index, o)
+		cl.storeResult(index, fetch.cert, fetch.err)
+	}
+
+	cl.pending_lock.Lock()
+	delete(cl.pending, index)
+	cl.pending_lock.Unlock()
+	close(fetch.done)
+
+	return fetch.cert, fetch.err
+}
+
+// Retrieve the certificate associated with the given key ID from the disk
+// cache if there is one, or from the server otherwise.
+func (cl *X509KeyClient) loadCertificate(ctx context.Context, index uint64,
+	o *callOptions) (*x509.Certificate, error) {
 	var cert *x509.Certificate
-	var cr *cacheRecord
 	var err error
 	var ok bool
 
-	c, _ = context.WithTimeout(context.Background(), cl.timeout)
+	if cl.disk_cache != nil {
+		if cert, ok = cl.disk_cache.get(index); ok {
+			o.setCached()
+			return cert, nil
+		}
+	}
+
+	cert, err = cl.fetchCertificate(ctx, index)
+	cl.persistResult(index, cert, err)
+	return cert, err
+}
 
-	key_cache_requests.Add(1)
+// Update the disk cache, if any, with the result of asking the server for
+// the certificate with the given index.
+func (cl *X509KeyClient) persistResult(index uint64, cert *x509.Certificate,
+	err error) {
+	if cl.disk_cache == nil {
+		return
+	}
 
-	cl.cache_lock.RLock()
-	if cr, ok = cl.key_cache[index]; ok {
-		key_cache_hits.Add(1)
-		cr.LastUsed = time.Now()
-		defer cl.cache_lock.RUnlock()
-		return cr.Cert, nil
+	if err == nil {
+		if cl.disk_cache.add(index, cert) != nil {
+			cl.metrics.recordError(ErrorClassDiskCache)
+		}
+	} else if status.Code(err) == codes.NotFound || err == ErrCertificateRevoked {
+		cl.disk_cache.delete(index)
 	}
-	cl.cache_lock.RUnlock()
+}
+
+// Retrieve the certificate associated with the given key ID from the
+// server, bypassing the cache.
+func (cl *X509KeyClient) fetchCertificate(ctx context.Context, index uint64) (
+	*x509.Certificate, error) {
+	var res *X509KeyData
+	var cert *x509.Certificate
+	var err error
 
-	key_cache_misses.Add(1)
-	res, err = cl.client.RetrieveCertificateByIndex(
-		c, &X509KeyDataRequest{Index: proto.Uint64(index)})
+	err = cl.withRetries(ctx, func(ctx context.Context) error {
+		res, err = cl.client.RetrieveCertificateByIndex(
+			ctx, &X509KeyDataRequest{Index: proto.Uint64(index)})
+		return err
+	})
 	if err != nil {
-		key_cache_errors.Add(err.Error(), 1)
+		cl.metrics.recordError(errorClass(err))
 		return nil, err
 	}
 
+	if res.GetRevoked() != 0 {
+		cl.metrics.recordError(ErrorClassRevokedCertificate)
+		return nil, ErrCertificateRevoked
+	}
+
 	cert, err = x509.ParseCertificate(res.GetDerCertificate())
 	if err != nil {
-		key_cache_errors.Add(err.Error(), 1)
+		cl.metrics.recordError(ErrorClassInvalidCertificate)
 		return nil, err
 	}
 
-	cr = new(cacheRecord)
-	cr.Cert = cert
-	cr.LastUsed = time.Now()
-
-	cl.cache_lock.Lock()
-	cl.key_cache[index] = cr
-	key_cache_size.Set(int64(len(cl.key_cache)))
-	cl.cache_lock.Unlock()
-
 	return cert, nil
 }
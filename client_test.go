@@ -0,0 +1,636 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caoimhechaos/x509keyserver"
+	"github.com/caoimhechaos/x509keyserver/x509keyservertest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Start a test server holding a freshly generated CA certificate.
+func newTestServer(t *testing.T) (*x509keyservertest.Server,
+	*x509keyservertest.Certificate) {
+	var server *x509keyservertest.Server
+	var ca *x509keyservertest.Certificate
+	var err error
+
+	server, ca, err = x509keyservertest.NewServerWithCA("Test CA")
+	if err != nil {
+		t.Fatal("Error setting up server: ", err)
+	}
+	return server, ca
+}
+
+func TestConcurrentMissesAreCoalesced(t *testing.T) {
+	var server, ca = newTestServer(t)
+	var client *x509keyserver.X509KeyClient
+	var wg sync.WaitGroup
+	var errs = make(chan error, 20)
+	var err error
+	var i int
+
+	defer server.Close()
+
+	client, err = server.NewClient()
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	// Keep the first request busy until all others have been made.
+	server.SetLatency(200 * time.Millisecond)
+
+	for i = 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			var err error
+
+			defer wg.Done()
+
+			_, err = client.RetrieveCertificateByIndexContext(
+				context.Background(), ca.Cert.SerialNumber.Uint64())
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err = range errs {
+		if err != nil {
+			t.Error("Error retrieving certificate: ", err)
+		}
+	}
+
+	if server.Requests("RetrieveCertificateByIndex") != 1 {
+		t.Errorf("Server received %d requests, expected 1",
+			server.Requests("RetrieveCertificateByIndex"))
+	}
+}
+
+func TestMultiServerClientFailover(t *testing.T) {
+	var ca *x509keyservertest.Certificate
+	var servers = map[string]*x509keyservertest.Server{
+		"server-a": x509keyservertest.NewServer(),
+		"server-b": x509keyservertest.NewServer(),
+	}
+	var server *x509keyservertest.Server
+	var client *x509keyserver.X509KeyClient
+	var before int
+	var err error
+	var i int
+
+	for _, server = range servers {
+		defer server.Close()
+	}
+
+	ca, err = x509keyservertest.NewCA("Test CA")
+	if err != nil {
+		t.Fatal("Error generating certificate: ", err)
+	}
+	for _, server = range servers {
+		err = server.AddCertificates(ca.Cert)
+		if err != nil {
+			t.Fatal("Error adding certificate: ", err)
+		}
+	}
+
+	client, err = x509keyserver.NewMultiServerClient(
+		[]string{"server-a", "server-b"},
+		x509keyserver.WithCache(x509keyserver.NoCache{}),
+		x509keyserver.WithRetryPolicy(x509keyserver.RetryPolicy{
+			MaxAttempts:    5,
+			InitialBackoff: 10 * time.Millisecond,
+		}),
+		x509keyserver.WithContextDialer(
+			func(ctx context.Context, addr string) (net.Conn, error) {
+				return servers[addr].Dial(ctx, addr)
+			}))
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	for i = 0; i < 10; i++ {
+		_, err = client.RetrieveCertificateByIndex(
+			ca.Cert.SerialNumber.Uint64())
+		if err != nil {
+			t.Fatal("Error retrieving certificate: ", err)
+		}
+	}
+
+	servers["server-a"].Close()
+	before = servers["server-b"].Requests("RetrieveCertificateByIndex")
+
+	for i = 0; i < 10; i++ {
+		_, err = client.RetrieveCertificateByIndex(
+			ca.Cert.SerialNumber.Uint64())
+		if err != nil {
+			t.Fatal("Error retrieving certificate after failover: ", err)
+		}
+	}
+
+	if servers["server-b"].Requests("RetrieveCertificateByIndex")-before < 10 {
+		t.Errorf("Remaining server only received %d of 10 requests",
+			servers["server-b"].Requests("RetrieveCertificateByIndex")-
+				before)
+	}
+}
+
+func TestBackgroundRefreshRestoresEvictedEntries(t *testing.T) {
+	var server, ca = newTestServer(t)
+	var leaf *x509keyservertest.Certificate
+	var client *x509keyserver.X509KeyClient
+	var info x509keyserver.ResultInfo
+	var err error
+
+	defer server.Close()
+
+	leaf, err = ca.Issue("Test leaf")
+	if err != nil {
+		t.Fatal("Error generating certificate: ", err)
+	}
+	err = server.AddCertificates(leaf.Cert)
+	if err != nil {
+		t.Fatal("Error adding certificate: ", err)
+	}
+
+	client, err = server.NewClient(
+		x509keyserver.WithCacheSize(1),
+		x509keyserver.WithBackgroundRefresh(50*time.Millisecond))
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	// Fetch the CA certificate and use it again from the cache, which makes
+	// it hot, then push it out of the cache.
+	_, err = client.RetrieveCertificateByIndex(ca.Cert.SerialNumber.Uint64())
+	if err == nil {
+		_, err = client.RetrieveCertificateByIndex(
+			ca.Cert.SerialNumber.Uint64())
+	}
+	if err == nil {
+		_, err = client.RetrieveCertificateByIndex(
+			leaf.Cert.SerialNumber.Uint64())
+	}
+	if err != nil {
+		t.Fatal("Error retrieving certificate: ", err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	_, err = client.RetrieveCertificateByIndexContext(context.Background(),
+		ca.Cert.SerialNumber.Uint64(), x509keyserver.WithResultInfo(&info))
+	if err != nil {
+		t.Fatal("Error retrieving certificate: ", err)
+	}
+	if !info.Cached {
+		t.Error("Evicted hot certificate was not fetched again in the " +
+			"background")
+	}
+}
+
+// Retrieve the certificate with the given index and report whether it was
+// taken from the cache.
+func retrieveCached(t *testing.T, client *x509keyserver.X509KeyClient,
+	index uint64, opts ...x509keyserver.CallOption) bool {
+	var info x509keyserver.ResultInfo
+	var err error
+
+	_, err = client.RetrieveCertificateByIndexContext(context.Background(),
+		index, append(opts, x509keyserver.WithResultInfo(&info))...)
+	if err != nil {
+		t.Fatal("Error retrieving certificate: ", err)
+	}
+	return info.Cached
+}
+
+func TestClientCachesCertificates(t *testing.T) {
+	var server, ca = newTestServer(t)
+	var client *x509keyserver.X509KeyClient
+	var index uint64 = ca.Cert.SerialNumber.Uint64()
+	var err error
+
+	defer server.Close()
+
+	client, err = server.NewClient()
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	if retrieveCached(t, client, index) {
+		t.Error("First request was answered from the cache")
+	}
+	if !retrieveCached(t, client, index) {
+		t.Error("Second request was not answered from the cache")
+	}
+	if retrieveCached(t, client, index, x509keyserver.BypassCache()) {
+		t.Error("Request bypassing the cache was answered from it")
+	}
+
+	if server.Requests("RetrieveCertificateByIndex") != 2 {
+		t.Errorf("Server received %d requests, expected 2",
+			server.Requests("RetrieveCertificateByIndex"))
+	}
+
+	_, err = client.RetrieveCertificateByIndex(index + 1000)
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for an unknown certificate, got %v", err)
+	}
+}
+
+func TestClientEvictsLeastRecentlyUsed(t *testing.T) {
+	var server, ca = newTestServer(t)
+	var leaves [2]*x509keyservertest.Certificate
+	var client *x509keyserver.X509KeyClient
+	var ca_index, first, second uint64
+	var err error
+	var i int
+
+	defer server.Close()
+
+	for i = range leaves {
+		leaves[i], err = ca.Issue("Test leaf")
+		if err == nil {
+			err = server.AddCertificates(leaves[i].Cert)
+		}
+		if err != nil {
+			t.Fatal("Error adding certificate: ", err)
+		}
+	}
+	ca_index = ca.Cert.SerialNumber.Uint64()
+	first = leaves[0].Cert.SerialNumber.Uint64()
+	second = leaves[1].Cert.SerialNumber.Uint64()
+
+	client, err = server.NewClient(x509keyserver.WithCacheSize(2))
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	retrieveCached(t, client, ca_index)
+	retrieveCached(t, client, first)
+	// Use the CA certificate again so the first leaf is evicted next.
+	retrieveCached(t, client, ca_index)
+	retrieveCached(t, client, second)
+
+	if client.Stats().CacheSize != 2 {
+		t.Errorf("Cache holds %d certificates, expected 2",
+			client.Stats().CacheSize)
+	}
+	if !retrieveCached(t, client, ca_index) {
+		t.Error("Recently used certificate was evicted")
+	}
+	if retrieveCached(t, client, first) {
+		t.Error("Least recently used certificate was not evicted")
+	}
+	if server.Requests("RetrieveCertificateByIndex") != 4 {
+		t.Errorf("Server received %d requests, expected 4",
+			server.Requests("RetrieveCertificateByIndex"))
+	}
+}
+
+// A MetricsSink which remembers all values it was sent.
+type recordingSink struct {
+	lock     sync.Mutex
+	counters map[string]int64
+	gauges   map[string]int64
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{
+		counters: make(map[string]int64),
+		gauges:   make(map[string]int64),
+	}
+}
+
+func (s *recordingSink) IncrCounter(name, label string, delta int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if label != "" {
+		name += "/" + label
+	}
+	s.counters[name] += delta
+}
+
+func (s *recordingSink) SetGauge(name string, value int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.gauges[name] = value
+}
+
+func TestClientStats(t *testing.T) {
+	var server, ca = newTestServer(t)
+	var sink = newRecordingSink()
+	var client *x509keyserver.X509KeyClient
+	var index uint64 = ca.Cert.SerialNumber.Uint64()
+	var stats *x509keyserver.ClientStats
+	var err error
+
+	defer server.Close()
+
+	client, err = server.NewClient(x509keyserver.WithMetricsSink(sink))
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	retrieveCached(t, client, index)
+	retrieveCached(t, client, index)
+	_, err = client.RetrieveCertificateByIndex(index + 1000)
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound for an unknown certificate, got %v", err)
+	}
+
+	stats = client.Stats()
+	if stats.CacheRequests != 3 || stats.CacheHits != 1 ||
+		stats.CacheMisses != 2 {
+		t.Errorf("Expected 3 requests, 1 hit and 2 misses, got %d, %d "+
+			"and %d", stats.CacheRequests, stats.CacheHits,
+			stats.CacheMisses)
+	}
+	if stats.CacheSize != 1 {
+		t.Errorf("Expected 1 cached certificate, got %d", stats.CacheSize)
+	}
+	if stats.Errors[codes.NotFound.String()] != 1 || len(stats.Errors) != 1 {
+		t.Errorf("Expected a single NotFound error, got %v", stats.Errors)
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if sink.counters[x509keyserver.MetricCacheRequests] != 3 ||
+		sink.counters[x509keyserver.MetricCacheHits] != 1 ||
+		sink.counters[x509keyserver.MetricCacheMisses] != 2 {
+		t.Errorf("Sink received unexpected cache counters: %v",
+			sink.counters)
+	}
+	if sink.counters[x509keyserver.MetricErrors+"/NotFound"] != 1 {
+		t.Errorf("Sink received unexpected error counters: %v",
+			sink.counters)
+	}
+	if sink.gauges[x509keyserver.MetricCacheSize] != 1 {
+		t.Errorf("Sink received cache size %d, expected 1",
+			sink.gauges[x509keyserver.MetricCacheSize])
+	}
+}
+
+func TestClientNegativeCacheTTL(t *testing.T) {
+	var server, ca = newTestServer(t)
+	var client *x509keyserver.X509KeyClient
+	var unknown uint64 = ca.Cert.SerialNumber.Uint64() + 1000
+	var i int
+	var err error
+
+	defer server.Close()
+
+	client, err = server.NewClient(
+		x509keyserver.WithNegativeCacheTTL(200 * time.Millisecond))
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	for i = 0; i < 3; i++ {
+		_, err = client.RetrieveCertificateByIndex(unknown)
+		if status.Code(err) != codes.NotFound {
+			t.Fatalf("Expected NotFound for an unknown certificate, got %v",
+				err)
+		}
+	}
+	if server.Requests("RetrieveCertificateByIndex") != 1 {
+		t.Errorf("Server received %d requests, expected 1",
+			server.Requests("RetrieveCertificateByIndex"))
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	_, err = client.RetrieveCertificateByIndex(unknown)
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("Expected NotFound for an unknown certificate, got %v", err)
+	}
+	if server.Requests("RetrieveCertificateByIndex") != 2 {
+		t.Errorf("Server received %d requests after the negative result "+
+			"expired, expected 2",
+			server.Requests("RetrieveCertificateByIndex"))
+	}
+}
+
+func TestClientRefreshesAfterCacheTTL(t *testing.T) {
+	var server, ca = newTestServer(t)
+	var client *x509keyserver.X509KeyClient
+	var index uint64 = ca.Cert.SerialNumber.Uint64()
+	var err error
+
+	defer server.Close()
+
+	client, err = server.NewClient(
+		x509keyserver.WithCacheTTL(100 * time.Millisecond))
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	retrieveCached(t, client, index)
+	if !retrieveCached(t, client, index) {
+		t.Error("Second request was not answered from the cache")
+	}
+
+	// The certificate is valid for much longer, but is due for a refresh.
+	time.Sleep(150 * time.Millisecond)
+	if retrieveCached(t, client, index) {
+		t.Error("Certificate due for a refresh was answered from the cache")
+	}
+	if server.Requests("RetrieveCertificateByIndex") != 2 {
+		t.Errorf("Server received %d requests, expected 2",
+			server.Requests("RetrieveCertificateByIndex"))
+	}
+}
+
+func TestClientEvictsExpiredCertificates(t *testing.T) {
+	var server, ca = newTestServer(t)
+	var leaf *x509keyservertest.Certificate
+	var client *x509keyserver.X509KeyClient
+	var err error
+
+	defer server.Close()
+
+	leaf, err = ca.Issue("short.example.com",
+		x509keyservertest.WithValidity(time.Now().Add(-time.Hour),
+			time.Now().Add(1500*time.Millisecond)))
+	if err == nil {
+		err = server.AddCertificates(leaf.Cert)
+	}
+	if err != nil {
+		t.Fatal("Error adding certificate: ", err)
+	}
+
+	client, err = server.NewClient()
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	retrieveCached(t, client, leaf.Cert.SerialNumber.Uint64())
+	if !retrieveCached(t, client, leaf.Cert.SerialNumber.Uint64()) {
+		t.Error("Second request was not answered from the cache")
+	}
+
+	// Certificate times only have a resolution of a second.
+	time.Sleep(time.Until(leaf.Cert.NotAfter) + 100*time.Millisecond)
+	if retrieveCached(t, client, leaf.Cert.SerialNumber.Uint64()) {
+		t.Error("Expired certificate was answered from the cache")
+	}
+	if client.Stats().CacheSize != 0 {
+		t.Errorf("Expired certificate was cached again, cache size %d",
+			client.Stats().CacheSize)
+	}
+}
+
+func TestClientDropsRevokedCertificates(t *testing.T) {
+	var server, ca = newTestServer(t)
+	var client *x509keyserver.X509KeyClient
+	var index uint64 = ca.Cert.SerialNumber.Uint64()
+	var err error
+
+	defer server.Close()
+
+	client, err = server.NewClient(
+		x509keyserver.WithCacheTTL(100 * time.Millisecond))
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	retrieveCached(t, client, index)
+
+	err = server.Revoke(index)
+	if err != nil {
+		t.Fatal("Error revoking certificate: ", err)
+	}
+	if !retrieveCached(t, client, index) {
+		t.Error("Cached certificate not used before the refresh")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	_, err = client.RetrieveCertificateByIndex(index)
+	if err != x509keyserver.ErrCertificateRevoked {
+		t.Errorf("Expected ErrCertificateRevoked, got %v", err)
+	}
+	if client.Stats().CacheSize != 0 {
+		t.Errorf("Revoked certificate still cached, cache size %d",
+			client.Stats().CacheSize)
+	}
+	if client.Stats().Errors[x509keyserver.ErrorClassRevokedCertificate] != 1 {
+		t.Errorf("Revocation not counted: %v", client.Stats().Errors)
+	}
+
+	_, err = client.RetrieveCertificateByIndex(index)
+	if err != x509keyserver.ErrCertificateRevoked {
+		t.Errorf("Expected ErrCertificateRevoked again, got %v", err)
+	}
+}
+
+func TestPreloadReportsAllErrors(t *testing.T) {
+	var server, ca = newTestServer(t)
+	var client *x509keyserver.X509KeyClient
+	var perr *x509keyserver.PreloadError
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var ok bool
+	var err error
+
+	defer server.Close()
+
+	server.SetError("RetrieveCertificateByIndex",
+		status.Error(codes.Internal, "broken"))
+
+	client, err = server.NewClient(
+		x509keyserver.WithPreload(ca.Cert.SerialNumber.Uint64()),
+		x509keyserver.WithPreloadRecent(10))
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = client.WaitForPreload(ctx)
+	if perr, ok = err.(*x509keyserver.PreloadError); !ok {
+		t.Fatalf("Expected a PreloadError, got %v", err)
+	}
+	if status.Code(perr.Indices) != codes.Internal ||
+		status.Code(perr.Recent) != codes.Internal {
+		t.Errorf("Expected both kinds of preloading to fail, got %v", perr)
+	}
+
+	// The recent certificates are listed even though preloading the
+	// given ones failed.
+	if server.Requests("ListCertificates") != 1 {
+		t.Errorf("Recent certificates were listed %d times, expected 1",
+			server.Requests("ListCertificates"))
+	}
+}
+
+func TestPreloadRecentAfterPreloadSucceeds(t *testing.T) {
+	var server, ca = newTestServer(t)
+	var client *x509keyserver.X509KeyClient
+	var index uint64 = ca.Cert.SerialNumber.Uint64()
+	var err error
+
+	defer server.Close()
+
+	client, err = server.NewClient(x509keyserver.WithPreload(index),
+		x509keyserver.WithPreloadRecent(10))
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	err = client.WaitForPreload(context.Background())
+	if err != nil {
+		t.Fatal("Error preloading certificates: ", err)
+	}
+	if !retrieveCached(t, client, index) {
+		t.Error("Preloaded certificate was not cached")
+	}
+}
@@ -0,0 +1,338 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Magic number at the start of all certificate files in the disk cache.
+var diskCacheMagic = []byte("X5KC")
+
+// Suffix of certificate files in the disk cache.
+const diskCacheSuffix = ".crt"
+
+// Length of the header of a certificate file: the magic number, the time
+// the certificate was stored and the SHA-256 sum of the time and the DER
+// encoded certificate which follows.
+const diskCacheHeaderLen = 4 + 8 + sha256.Size
+
+// Prefix of the temporary files certificates are written to before they
+// are renamed into place.
+const diskCacheTempPrefix = ".tmp-"
+
+// Age after which temporary files are assumed to be left over from a
+// client which crashed while storing a certificate. Younger ones may still
+// be written by another client using the same directory.
+const diskCacheTempMaxAge = time.Minute
+
+var errDiskCacheCorrupt = errors.New("Corrupt certificate file in disk cache")
+
+// diskCache keeps DER encoded certificates in a directory so they survive
+// restarts of the client. Each certificate is stored in its own file named
+// after its index, and verified against a checksum when it is loaded. Up to
+// "max_size" files are kept; the least recently used ones are removed when
+// that limit is exceeded.
+type diskCache struct {
+	dir      string
+	max_size int
+	ttl      time.Duration
+
+	// Indices of the certificate files in the directory, most recently
+	// used first. The directory is only read once when the cache is
+	// opened; afterwards files are removed based on this list alone.
+	lock  sync.Mutex
+	order *list.List
+	files map[uint64]*list.Element
+}
+
+// Open the disk cache in "dir", creating the directory if necessary. A
+// negative "max_size" means the number of files is unlimited; a positive
+// "ttl" limits how long a stored certificate is used.
+func newDiskCache(dir string, max_size int, ttl time.Duration) (
+	*diskCache, error) {
+	var ret = &diskCache{
+		dir:      dir,
+		max_size: max_size,
+		ttl:      ttl,
+		order:    list.New(),
+		files:    make(map[uint64]*list.Element),
+	}
+	var infos []os.FileInfo
+	var files []os.FileInfo
+	var info os.FileInfo
+	var err error
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	infos, err = ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, info = range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(info.Name(), diskCacheTempPrefix) {
+			if time.Since(info.ModTime()) > diskCacheTempMaxAge {
+				os.Remove(filepath.Join(dir, info.Name()))
+			}
+		} else if strings.HasSuffix(info.Name(), diskCacheSuffix) {
+			files = append(files, info)
+		}
+	}
+
+	// Load the files oldest first, so the most recently used one ends up
+	// at the front of the list.
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	for _, info = range files {
+		var index uint64
+
+		index, err = strconv.ParseUint(
+			strings.TrimSuffix(info.Name(), diskCacheSuffix), 16, 64)
+		if err != nil {
+			// Not one of ours.
+			continue
+		}
+		ret.files[index] = ret.order.PushFront(index)
+	}
+
+	ret.lock.Lock()
+	ret.trim()
+	ret.lock.Unlock()
+
+	return ret, nil
+}
+
+// Determine the name of the file holding the certificate with the given
+// index.
+func (d *diskCache) path(index uint64) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%016x%s", index, diskCacheSuffix))
+}
+
+// Compute the checksum over the storage time and the certificate.
+func diskCacheChecksum(stored, der []byte) []byte {
+	var h = sha256.New()
+
+	h.Write(stored)
+	h.Write(der)
+	return h.Sum(nil)
+}
+
+// Load the certificate with the given index from disk, unless it was
+// stored longer than the TTL ago.
+func (d *diskCache) get(index uint64) (*x509.Certificate, bool) {
+	var cert *x509.Certificate
+	var stored time.Time
+	var ok bool
+
+	cert, stored, ok = d.load(index)
+	if !ok || (d.ttl > 0 && time.Now().After(stored.Add(d.ttl))) {
+		return nil, false
+	}
+	return cert, true
+}
+
+// Load the certificate with the given index from disk along with the time
+// it was stored. Files which are corrupt or contain expired certificates
+// are removed.
+func (d *diskCache) load(index uint64) (*x509.Certificate, time.Time, bool) {
+	var name string = d.path(index)
+	var cert *x509.Certificate
+	var stored time.Time
+	var now time.Time = time.Now()
+	var data []byte
+	var err error
+
+	data, err = ioutil.ReadFile(name)
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+
+	cert, stored, err = decodeDiskCacheFile(data)
+	if err != nil || now.After(cert.NotAfter) {
+		d.delete(index)
+		return nil, time.Time{}, false
+	}
+
+	// Keep track of when the certificate was last used for trimming. The
+	// modification time preserves the order across restarts.
+	d.lock.Lock()
+	d.touch(index)
+	d.lock.Unlock()
+	os.Chtimes(name, now, now)
+	return cert, stored, true
+}
+
+// Mark the file for "index" as the most recently used one. Must be called
+// with the lock held.
+func (d *diskCache) touch(index uint64) {
+	var elem *list.Element
+	var ok bool
+
+	elem, ok = d.files[index]
+	if ok {
+		d.order.MoveToFront(elem)
+	} else {
+		d.files[index] = d.order.PushFront(index)
+	}
+}
+
+// Decode the contents of a certificate file, verifying its integrity.
+func decodeDiskCacheFile(data []byte) (*x509.Certificate, time.Time, error) {
+	var stored, sum, der []byte
+	var cert *x509.Certificate
+	var err error
+
+	if len(data) < diskCacheHeaderLen ||
+		!bytes.Equal(data[:len(diskCacheMagic)], diskCacheMagic) {
+		return nil, time.Time{}, errDiskCacheCorrupt
+	}
+
+	stored = data[len(diskCacheMagic) : len(diskCacheMagic)+8]
+	sum = data[len(diskCacheMagic)+8 : diskCacheHeaderLen]
+	der = data[diskCacheHeaderLen:]
+
+	if !bytes.Equal(sum, diskCacheChecksum(stored, der)) {
+		return nil, time.Time{}, errDiskCacheCorrupt
+	}
+
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return cert, time.Unix(int64(binary.BigEndian.Uint64(stored)), 0), nil
+}
+
+// Store the certificate with the given index on disk, removing the least
+// recently used files if the size limit is exceeded.
+func (d *diskCache) add(index uint64, cert *x509.Certificate) error {
+	var name string = d.path(index)
+	var stored = make([]byte, 8)
+	var buf bytes.Buffer
+	var tmp *os.File
+	var err error
+
+	if d.max_size == 0 {
+		return nil
+	}
+
+	binary.BigEndian.PutUint64(stored, uint64(time.Now().Unix()))
+	buf.Write(diskCacheMagic)
+	buf.Write(stored)
+	buf.Write(diskCacheChecksum(stored, cert.Raw))
+	buf.Write(cert.Raw)
+
+	// Write to a temporary file first so readers never see partial data.
+	tmp, err = ioutil.TempFile(d.dir, diskCacheTempPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	err = os.Rename(tmp.Name(), name)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	d.touch(index)
+	d.trim()
+	return nil
+}
+
+// Remove the certificate with the given index from disk, if present.
+func (d *diskCache) delete(index uint64) {
+	d.lock.Lock()
+	d.remove(index)
+	d.lock.Unlock()
+}
+
+// Remove the file for "index" and forget about it. Must be called with the
+// lock held.
+func (d *diskCache) remove(index uint64) {
+	var elem *list.Element
+	var ok bool
+
+	os.Remove(d.path(index))
+	elem, ok = d.files[index]
+	if ok {
+		d.order.Remove(elem)
+		delete(d.files, index)
+	}
+}
+
+// Remove the least recently used files until the size limit is met. Must
+// be called with the lock held.
+func (d *diskCache) trim() {
+	if d.max_size < 0 {
+		return
+	}
+
+	for d.order.Len() > d.max_size {
+		d.remove(d.order.Back().Value.(uint64))
+	}
+}
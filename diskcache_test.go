@@ -0,0 +1,195 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Create a self signed certificate with the given serial number.
+func newDiskCacheTestCert(t *testing.T, serial int64) *x509.Certificate {
+	var tmpl = &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "Disk cache test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	var key *ecdsa.PrivateKey
+	var cert *x509.Certificate
+	var der []byte
+	var err error
+
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("Error generating key: ", err)
+	}
+	der, err = x509.CreateCertificate(rand.Reader, tmpl, tmpl,
+		key.Public(), key)
+	if err != nil {
+		t.Fatal("Error creating certificate: ", err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal("Error parsing certificate: ", err)
+	}
+	return cert
+}
+
+func TestDiskCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	var dir string
+	var cache *diskCache
+	var ok bool
+	var err error
+
+	dir, err = ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err = newDiskCache(dir, 2, 0)
+	if err != nil {
+		t.Fatal("Error opening disk cache: ", err)
+	}
+
+	cache.add(1, newDiskCacheTestCert(t, 1))
+	cache.add(2, newDiskCacheTestCert(t, 2))
+	if _, ok = cache.get(1); !ok {
+		t.Fatal("Certificate 1 not found in disk cache")
+	}
+	cache.add(3, newDiskCacheTestCert(t, 3))
+
+	if _, ok = cache.get(2); ok {
+		t.Error("Certificate 2 should have been evicted")
+	}
+	if _, err = os.Stat(cache.path(2)); !os.IsNotExist(err) {
+		t.Error("File for certificate 2 still exists: ", err)
+	}
+	if _, ok = cache.get(1); !ok {
+		t.Error("Certificate 1 should have been kept")
+	}
+	if _, ok = cache.get(3); !ok {
+		t.Error("Certificate 3 should have been kept")
+	}
+}
+
+func TestDiskCacheTrimsOnOpen(t *testing.T) {
+	var dir string
+	var cache *diskCache
+	var stamp time.Time = time.Now().Add(-time.Hour)
+	var i uint64
+	var err error
+
+	dir, err = ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err = newDiskCache(dir, -1, 0)
+	if err != nil {
+		t.Fatal("Error opening disk cache: ", err)
+	}
+	for i = 1; i <= 4; i++ {
+		cache.add(i, newDiskCacheTestCert(t, int64(i)))
+		// Make the order of use visible through the modification time.
+		os.Chtimes(cache.path(i), stamp,
+			stamp.Add(time.Duration(i)*time.Minute))
+	}
+
+	cache, err = newDiskCache(dir, 2, 0)
+	if err != nil {
+		t.Fatal("Error reopening disk cache: ", err)
+	}
+	if cache.order.Len() != 2 {
+		t.Errorf("Expected 2 files in the index, got %d", cache.order.Len())
+	}
+	for i = 1; i <= 4; i++ {
+		_, err = os.Stat(cache.path(i))
+		if (i > 2) != (err == nil) {
+			t.Errorf("Unexpected state of file %d after reopening: %v",
+				i, err)
+		}
+	}
+}
+
+func TestDiskCacheRemovesStaleTempFiles(t *testing.T) {
+	var dir string
+	var stale, recent string
+	var cache *diskCache
+	var stamp time.Time = time.Now().Add(-time.Hour)
+	var err error
+
+	dir, err = ioutil.TempDir("", "diskcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stale = filepath.Join(dir, diskCacheTempPrefix+"stale")
+	recent = filepath.Join(dir, diskCacheTempPrefix+"recent")
+	err = ioutil.WriteFile(stale, []byte("partial"), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(recent, []byte("partial"), 0600)
+	}
+	if err == nil {
+		err = os.Chtimes(stale, stamp, stamp)
+	}
+	if err != nil {
+		t.Fatal("Error creating temporary files: ", err)
+	}
+
+	cache, err = newDiskCache(dir, -1, 0)
+	if err != nil {
+		t.Fatal("Error opening disk cache: ", err)
+	}
+	if cache.order.Len() != 0 {
+		t.Errorf("Temporary files were indexed: %d entries",
+			cache.order.Len())
+	}
+	if _, err = os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("Stale temporary file was not removed: ", err)
+	}
+	if _, err = os.Stat(recent); err != nil {
+		t.Error("Temporary file still being written was removed: ", err)
+	}
+}
@@ -0,0 +1,264 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Number of certificates requested from the server at a time when
+// enumerating them.
+const listPageSize = 100
+
+// ErrListIndexZero is returned by CertificateIterator.Err if the server
+// listed the certificate with the index 0 at the end of a page other than
+// the first. The next page can't be requested then, since a start index
+// of 0 means the beginning of the list.
+var ErrListIndexZero = errors.New(
+	"Cannot continue listing after the certificate with index 0")
+
+// CertificateFilter selects the certificates returned by Certificates and
+// added to pools by CertPool. The zero value selects all certificates
+// which haven't been revoked.
+type CertificateFilter struct {
+	// If set, only certificates issued by this subject are returned. It
+	// must be formatted the way the server displays it.
+	Issuer string
+
+	// Only return certificates of certificate authorities.
+	OnlyCA bool
+
+	// Skip certificates which have already expired.
+	SkipExpired bool
+
+	// Also return revoked certificates. Since the server doesn't hand
+	// them out, only their metadata is available.
+	IncludeRevoked bool
+}
+
+// Determine whether the certificate described by "rec" may match the
+// filter. The CA flag can only be checked on the certificate itself.
+func (f *CertificateFilter) matchRecord(rec *X509KeyData, now time.Time) bool {
+	if rec.GetRevoked() != 0 && !f.IncludeRevoked {
+		return false
+	}
+	if f.Issuer != "" && rec.GetIssuer() != f.Issuer {
+		return false
+	}
+	if f.SkipExpired && now.After(time.Unix(int64(rec.GetExpires()), 0)) {
+		return false
+	}
+	return true
+}
+
+// CertificateIterator walks through the certificates known to the server
+// in the order the server lists them, requesting them page by page as
+// needed. That is only the order of their index if the database uses an
+// order preserving partitioner.
+//
+// Example:
+//
+//	iter := client.Certificates(ctx, filter)
+//	for iter.Next() {
+//		fmt.Println(iter.Record().GetIndex(), iter.Certificate().Subject)
+//	}
+//	if err := iter.Err(); err != nil {
+//		...
+//	}
+//
+// Certificates are retrieved from the server without going through the
+// cache of the client, so that walking through all of them doesn't evict
+// the ones in use.
+type CertificateIterator struct {
+	client *X509KeyClient
+	ctx    context.Context
+	filter CertificateFilter
+	now    time.Time
+
+	// The current page, and the index to request the next one from. Since
+	// the start index is included, every page after the first one repeats
+	// the last certificate of the previous page.
+	records []*X509KeyData
+	start   uint64
+	paged   bool
+	last    bool
+	endErr  error
+
+	rec  *X509KeyData
+	cert *x509.Certificate
+	err  error
+}
+
+// Certificates returns an iterator over all certificates on the server
+// which match "filter". The RPCs made by the iterator are subject to
+// "ctx".
+func (cl *X509KeyClient) Certificates(ctx context.Context,
+	filter CertificateFilter) *CertificateIterator {
+	return &CertificateIterator{
+		client: cl,
+		ctx:    ctx,
+		filter: filter,
+		now:    time.Now(),
+	}
+}
+
+// Next advances to the next matching certificate. It returns false once
+// all certificates have been seen or an error occurred.
+func (it *CertificateIterator) Next() bool {
+	var rec *X509KeyData
+	var cert *x509.Certificate
+	var err error
+
+	it.rec, it.cert = nil, nil
+	for it.err == nil {
+		if len(it.records) == 0 && !it.nextPage() {
+			return false
+		}
+
+		rec, it.records = it.records[0], it.records[1:]
+		if !it.filter.matchRecord(rec, it.now) {
+			continue
+		}
+
+		if rec.GetRevoked() != 0 {
+			it.rec = rec
+			return true
+		}
+
+		cert, err = it.client.fetchUncached(it.ctx, rec.GetIndex())
+		if status.Code(err) == codes.NotFound || err == ErrCertificateRevoked {
+			// Removed or revoked since it was listed.
+			continue
+		} else if err != nil {
+			it.err = err
+			return false
+		}
+
+		if it.filter.OnlyCA && !cert.IsCA {
+			continue
+		}
+
+		it.rec, it.cert = rec, cert
+		return true
+	}
+
+	return false
+}
+
+// Retrieve the certificate with the given index from the server, subject to
+// the client timeout and retry policy, without looking at or updating the
+// cache.
+func (cl *X509KeyClient) fetchUncached(ctx context.Context, index uint64) (
+	*x509.Certificate, error) {
+	var cancel context.CancelFunc
+
+	if cl.closed() {
+		return nil, ErrClientClosed
+	}
+
+	if cl.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cl.timeout)
+		defer cancel()
+	}
+
+	return cl.fetchCertificate(ctx, index)
+}
+
+// Request the next page of certificates from the server. Returns false if
+// there are no more certificates or the request failed.
+func (it *CertificateIterator) nextPage() bool {
+	var list *X509KeyDataList
+	var last *X509KeyData
+
+	if it.last {
+		it.err = it.endErr
+		return false
+	}
+	if it.client.closed() {
+		it.err = ErrClientClosed
+		return false
+	}
+
+	list, it.err = it.client.listCertificates(it.ctx, &X509KeyDataListRequest{
+		StartIndex: proto.Uint64(it.start),
+		Count:      proto.Int32(listPageSize),
+	})
+	if it.err != nil {
+		return false
+	}
+
+	it.records = list.GetRecords()
+	if len(it.records) < listPageSize {
+		it.last = true
+	}
+	if it.paged && len(it.records) > 0 &&
+		it.records[0].GetIndex() == it.start {
+		it.records = it.records[1:]
+	}
+	it.paged = true
+	if len(it.records) == 0 {
+		it.last = true
+		return false
+	}
+
+	last = it.records[len(it.records)-1]
+	it.start = last.GetIndex()
+	if it.start == 0 && !it.last {
+		// Report the error once the current page has been consumed.
+		it.endErr = ErrListIndexZero
+		it.last = true
+	}
+	return true
+}
+
+// Record returns the metadata of the current certificate.
+func (it *CertificateIterator) Record() *X509KeyData {
+	return it.rec
+}
+
+// Certificate returns the current certificate, or nil if it has been
+// revoked.
+func (it *CertificateIterator) Certificate() *x509.Certificate {
+	return it.cert
+}
+
+// Err returns the error which ended the iteration, if any.
+func (it *CertificateIterator) Err() error {
+	return it.err
+}
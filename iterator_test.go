@@ -0,0 +1,219 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caoimhechaos/x509keyserver"
+	"github.com/caoimhechaos/x509keyserver/keydb"
+	"github.com/caoimhechaos/x509keyserver/x509keyservertest"
+)
+
+// Start a test server holding a CA hierarchy with the given number of
+// leaves, an expired leaf and a revoked leaf.
+func newIteratorTestServer(t *testing.T, leaves int) (
+	*x509keyservertest.Server, *x509keyservertest.Hierarchy,
+	*x509keyservertest.Certificate, *x509keyservertest.Certificate) {
+	var server = x509keyservertest.NewServer()
+	var h *x509keyservertest.Hierarchy
+	var expired, revoked *x509keyservertest.Certificate
+	var err error
+
+	h, err = x509keyservertest.NewHierarchy(leaves)
+	if err == nil {
+		expired, err = h.Intermediate.Issue("expired.example.com",
+			x509keyservertest.Expired())
+	}
+	if err == nil {
+		revoked, err = h.Intermediate.Issue("revoked.example.com")
+	}
+	if err == nil {
+		err = server.AddCertificates(h.Certificates()...)
+	}
+	if err == nil {
+		err = server.AddCertificates(expired.Cert, revoked.Cert)
+	}
+	if err == nil {
+		err = server.Revoke(revoked.Cert.SerialNumber.Uint64())
+	}
+	if err != nil {
+		server.Close()
+		t.Fatal("Error setting up server: ", err)
+	}
+
+	return server, h, expired, revoked
+}
+
+// Collect the indices of all certificates returned by the iterator.
+func iterate(t *testing.T, client *x509keyserver.X509KeyClient,
+	filter x509keyserver.CertificateFilter) map[uint64]bool {
+	var iter = client.Certificates(context.Background(), filter)
+	var ret = make(map[uint64]bool)
+
+	for iter.Next() {
+		if ret[iter.Record().GetIndex()] {
+			t.Errorf("Certificate %d returned twice",
+				iter.Record().GetIndex())
+		}
+		ret[iter.Record().GetIndex()] = true
+
+		if iter.Record().GetRevoked() == 0 && iter.Certificate() == nil {
+			t.Errorf("No certificate for %d", iter.Record().GetIndex())
+		}
+	}
+	if iter.Err() != nil {
+		t.Fatal("Error iterating over certificates: ", iter.Err())
+	}
+
+	// The end of the iteration is final.
+	if iter.Next() || iter.Record() != nil || iter.Certificate() != nil {
+		t.Error("Iterator continued after the end")
+	}
+	return ret
+}
+
+func TestCertificateIteratorPages(t *testing.T) {
+	var server, h, _, _ = newIteratorTestServer(t, 250)
+	var client *x509keyserver.X509KeyClient
+	var seen map[uint64]bool
+	var err error
+
+	defer server.Close()
+
+	client, err = server.NewClient()
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	// All but the revoked certificate, over several pages.
+	seen = iterate(t, client, x509keyserver.CertificateFilter{})
+	if len(seen) != len(h.Certificates())+1 {
+		t.Errorf("Iterated over %d certificates, expected %d", len(seen),
+			len(h.Certificates())+1)
+	}
+	if server.Requests("ListCertificates") < 3 {
+		t.Errorf("Only %d pages were requested",
+			server.Requests("ListCertificates"))
+	}
+}
+
+func TestCertificateIteratorFilters(t *testing.T) {
+	var server, h, expired, revoked = newIteratorTestServer(t, 3)
+	var client *x509keyserver.X509KeyClient
+	var seen map[uint64]bool
+	var err error
+
+	defer server.Close()
+
+	client, err = server.NewClient()
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	seen = iterate(t, client, x509keyserver.CertificateFilter{})
+	if len(seen) != 6 || seen[revoked.Cert.SerialNumber.Uint64()] {
+		t.Errorf("Unexpected certificates without a filter: %v", seen)
+	}
+
+	seen = iterate(t, client, x509keyserver.CertificateFilter{
+		IncludeRevoked: true,
+	})
+	if len(seen) != 7 || !seen[revoked.Cert.SerialNumber.Uint64()] {
+		t.Errorf("Unexpected certificates including revoked ones: %v", seen)
+	}
+
+	seen = iterate(t, client, x509keyserver.CertificateFilter{
+		SkipExpired: true,
+	})
+	if len(seen) != 5 || seen[expired.Cert.SerialNumber.Uint64()] {
+		t.Errorf("Unexpected certificates skipping expired ones: %v", seen)
+	}
+
+	seen = iterate(t, client, x509keyserver.CertificateFilter{
+		OnlyCA: true,
+	})
+	if len(seen) != 2 || !seen[h.Root.Cert.SerialNumber.Uint64()] ||
+		!seen[h.Intermediate.Cert.SerialNumber.Uint64()] {
+		t.Errorf("Unexpected CA certificates: %v", seen)
+	}
+
+	seen = iterate(t, client, x509keyserver.CertificateFilter{
+		Issuer: string(keydb.FormatCertSubject(
+			h.Intermediate.Cert.Subject)),
+	})
+	if len(seen) != 4 || seen[h.Intermediate.Cert.SerialNumber.Uint64()] {
+		t.Errorf("Unexpected certificates issued by the intermediate "+
+			"CA: %v", seen)
+	}
+}
+
+func TestCertificateIteratorBypassesCache(t *testing.T) {
+	var server, ca = newTestServer(t)
+	var leaves [5]*x509keyservertest.Certificate
+	var client *x509keyserver.X509KeyClient
+	var index uint64 = ca.Cert.SerialNumber.Uint64()
+	var i int
+	var err error
+
+	defer server.Close()
+
+	for i = range leaves {
+		leaves[i], err = ca.Issue("leaf.example.com")
+		if err == nil {
+			err = server.AddCertificates(leaves[i].Cert)
+		}
+		if err != nil {
+			t.Fatal("Error adding certificate: ", err)
+		}
+	}
+
+	client, err = server.NewClient(x509keyserver.WithCacheSize(2))
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	retrieveCached(t, client, index)
+	iterate(t, client, x509keyserver.CertificateFilter{})
+
+	if client.Stats().CacheSize != 1 {
+		t.Errorf("Iterating changed the cache size to %d",
+			client.Stats().CacheSize)
+	}
+	if !retrieveCached(t, client, index) {
+		t.Error("Cached certificate was evicted by iterating")
+	}
+}
@@ -0,0 +1,523 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package fakecassandra provides a local Cassandra server which keeps its
+// data in memory and implements the parts of the Thrift API used by keydb,
+// so that the Cassandra backend can be exercised without a cluster.
+package fakecassandra
+
+import (
+	"bytes"
+	"crypto/md5"
+	"database/cassandra"
+	"errors"
+	"net"
+	"sort"
+	"sync"
+)
+
+// Returned to clients which haven't selected a keyspace yet.
+var errNoKeyspace = errors.New("You have not set a keyspace for this session")
+
+// Returned for requests using features the fake doesn't implement, such as
+// super columns and token ranges.
+var errUnsupported = errors.New("Not supported by the fake Cassandra server")
+
+// Columns of a row by name.
+type row map[string]*cassandra.Column
+
+// Rows of a column family by key.
+type columnFamily map[string]row
+
+// Server is a Cassandra stand-in which keeps all data in memory and speaks
+// the subset of the Thrift API used by keydb.X509KeyDB, so that the real
+// client can connect to it. Rows are ordered by their key, as with the
+// ByteOrderedPartitioner, unless SetRandomPartitioner has been called, and
+// columns by their name. Writes follow the Cassandra rules for time stamps:
+// a column is only overwritten or deleted by mutations with a time stamp at
+// least as recent as its own.
+type Server struct {
+	lock      sync.Mutex
+	keyspaces map[string]map[string]columnFamily
+	hashed    bool
+
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// State of a client connection.
+type session struct {
+	server   *Server
+	keyspace string
+}
+
+// setKeyspace selects the keyspace used by all subsequent operations of
+// the session. The keyspace is created if it doesn't exist yet.
+func (s *session) setKeyspace(keyspace string) error {
+	var ok bool
+
+	s.server.lock.Lock()
+	defer s.server.lock.Unlock()
+
+	if _, ok = s.server.keyspaces[keyspace]; !ok {
+		s.server.keyspaces[keyspace] = make(map[string]columnFamily)
+	}
+	s.keyspace = keyspace
+	return nil
+}
+
+// Find the column family with the given name in "keyspace", creating it if
+// requested. Must be called with the lock held.
+func (srv *Server) columnFamily(keyspace, name string, create bool) (
+	columnFamily, error) {
+	var cfs map[string]columnFamily
+	var cf columnFamily
+	var ok bool
+
+	if cfs, ok = srv.keyspaces[keyspace]; !ok {
+		return nil, errNoKeyspace
+	}
+	if cf, ok = cfs[name]; !ok && create {
+		cf = make(columnFamily)
+		cfs[name] = cf
+	}
+	return cf, nil
+}
+
+// Copy a column, so the caller can't modify the stored data.
+func copyColumn(col *cassandra.Column) *cassandra.Column {
+	var ret = cassandra.NewColumn()
+	var ts int64
+
+	ret.Name = append([]byte(nil), col.Name...)
+	ret.Value = append([]byte(nil), col.Value...)
+	if col.Timestamp != nil {
+		ts = *col.Timestamp
+		ret.Timestamp = &ts
+	}
+	return ret
+}
+
+// Time stamp of a column or deletion, treating missing ones as 0.
+func timestamp(ts *int64) int64 {
+	if ts == nil {
+		return 0
+	}
+	return *ts
+}
+
+// Apply "predicate" to the columns of "r", returning them in the order
+// Cassandra would.
+func (r row) slice(predicate *cassandra.SlicePredicate) (
+	[]*cassandra.ColumnOrSuperColumn, error) {
+	var ret []*cassandra.ColumnOrSuperColumn
+	var names []string
+	var name []byte
+	var sr *cassandra.SliceRange
+	var col *cassandra.Column
+	var key string
+	var ok bool
+
+	if predicate == nil {
+		return nil, errUnsupported
+	}
+
+	for key = range r {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	if predicate.ColumnNames != nil {
+		for _, key = range names {
+			for _, name = range predicate.ColumnNames {
+				if key == string(name) {
+					ret = append(ret, &cassandra.ColumnOrSuperColumn{
+						Column: copyColumn(r[key]),
+					})
+					break
+				}
+			}
+		}
+		return ret, nil
+	}
+
+	if sr = predicate.SliceRange; sr == nil {
+		return nil, errUnsupported
+	}
+	if sr.Reversed {
+		sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	}
+
+	for _, key = range names {
+		if int32(len(ret)) >= sr.Count {
+			break
+		}
+		if !inRange([]byte(key), sr.Start, sr.Finish, sr.Reversed) {
+			continue
+		}
+		if col, ok = r[key]; ok {
+			ret = append(ret, &cassandra.ColumnOrSuperColumn{
+				Column: copyColumn(col),
+			})
+		}
+	}
+
+	return ret, nil
+}
+
+// Determine whether "name" lies between "start" and "finish" in scan
+// direction. Empty bounds are unlimited.
+func inRange(name, start, finish []byte, reversed bool) bool {
+	if reversed {
+		start, finish = finish, start
+	}
+	if len(start) > 0 && bytes.Compare(name, start) < 0 {
+		return false
+	}
+	if len(finish) > 0 && bytes.Compare(name, finish) > 0 {
+		return false
+	}
+	return true
+}
+
+// SetRandomPartitioner makes range scans order rows by the MD5 hash of
+// their key, as with the RandomPartitioner, rather than by the key itself.
+func (srv *Server) SetRandomPartitioner(enabled bool) {
+	srv.lock.Lock()
+	srv.hashed = enabled
+	srv.lock.Unlock()
+}
+
+// Determine the position of the row "key" in the order of the partitioner.
+func (srv *Server) token(key []byte) []byte {
+	var sum [md5.Size]byte
+
+	if !srv.hashed {
+		return key
+	}
+	sum = md5.Sum(key)
+	return append(sum[:], key...)
+}
+
+// Retrieve a single column. Returns a cassandra.NotFoundException if
+// the row or column doesn't exist.
+func (s *session) get(key []byte, column_path *cassandra.ColumnPath,
+	level cassandra.ConsistencyLevel) (*cassandra.ColumnOrSuperColumn, error) {
+	var cf columnFamily
+	var col *cassandra.Column
+	var ok bool
+	var err error
+
+	if column_path.SuperColumn != nil || column_path.Column == nil {
+		return nil, errUnsupported
+	}
+
+	s.server.lock.Lock()
+	defer s.server.lock.Unlock()
+
+	cf, err = s.server.columnFamily(s.keyspace, column_path.ColumnFamily, false)
+	if err != nil {
+		return nil, err
+	}
+	if col, ok = cf[string(key)][string(column_path.Column)]; !ok {
+		return nil, &cassandra.NotFoundException{}
+	}
+
+	return &cassandra.ColumnOrSuperColumn{Column: copyColumn(col)}, nil
+}
+
+// Retrieve the columns of a row selected by "predicate".
+func (s *session) getSlice(key []byte, column_parent *cassandra.ColumnParent,
+	predicate *cassandra.SlicePredicate,
+	level cassandra.ConsistencyLevel) ([]*cassandra.ColumnOrSuperColumn, error) {
+	var cf columnFamily
+	var err error
+
+	if column_parent.SuperColumn != nil {
+		return nil, errUnsupported
+	}
+
+	s.server.lock.Lock()
+	defer s.server.lock.Unlock()
+
+	cf, err = s.server.columnFamily(s.keyspace, column_parent.ColumnFamily, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return cf[string(key)].slice(predicate)
+}
+
+// Retrieve the columns selected by "predicate" from several
+// rows. Every requested key is present in the result, even if the row
+// doesn't exist.
+func (s *session) multigetSlice(keys [][]byte,
+	column_parent *cassandra.ColumnParent, predicate *cassandra.SlicePredicate,
+	level cassandra.ConsistencyLevel) (
+	map[string][]*cassandra.ColumnOrSuperColumn, error) {
+	var ret = make(map[string][]*cassandra.ColumnOrSuperColumn)
+	var cf columnFamily
+	var key []byte
+	var err error
+
+	if column_parent.SuperColumn != nil {
+		return nil, errUnsupported
+	}
+
+	s.server.lock.Lock()
+	defer s.server.lock.Unlock()
+
+	cf, err = s.server.columnFamily(s.keyspace, column_parent.ColumnFamily, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key = range keys {
+		ret[string(key)], err = cf[string(key)].slice(predicate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ret, nil
+}
+
+// Retrieve the columns selected by "predicate" from up to
+// key_range.Count rows, with keys between key_range.StartKey and
+// key_range.EndKey inclusive. Token ranges are not supported.
+func (s *session) getRangeSlices(column_parent *cassandra.ColumnParent,
+	predicate *cassandra.SlicePredicate, key_range *cassandra.KeyRange,
+	level cassandra.ConsistencyLevel) ([]*cassandra.KeySlice, error) {
+	var ret []*cassandra.KeySlice
+	var cf columnFamily
+	var keys []string
+	var key string
+	var err error
+
+	if column_parent.SuperColumn != nil || key_range.StartToken != nil ||
+		key_range.EndToken != nil {
+		return nil, errUnsupported
+	}
+
+	s.server.lock.Lock()
+	defer s.server.lock.Unlock()
+
+	cf, err = s.server.columnFamily(s.keyspace, column_parent.ColumnFamily, false)
+	if err != nil {
+		return nil, err
+	}
+
+	for key = range cf {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(s.server.token([]byte(keys[i])),
+			s.server.token([]byte(keys[j]))) < 0
+	})
+
+	for _, key = range keys {
+		var ks *cassandra.KeySlice
+		var start, end []byte
+
+		if int32(len(ret)) >= key_range.Count {
+			break
+		}
+		if len(key_range.StartKey) > 0 {
+			start = s.server.token(key_range.StartKey)
+		}
+		if len(key_range.EndKey) > 0 {
+			end = s.server.token(key_range.EndKey)
+		}
+		if !inRange(s.server.token([]byte(key)), start, end, false) {
+			continue
+		}
+
+		ks = &cassandra.KeySlice{Key: []byte(key)}
+		ks.Columns, err = cf[key].slice(predicate)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, ks)
+	}
+
+	return ret, nil
+}
+
+// Apply all mutations in "mutation_map", which maps row keys
+// to column family names to mutations.
+func (s *session) batchMutate(
+	mutation_map map[string]map[string][]*cassandra.Mutation,
+	level cassandra.ConsistencyLevel) error {
+	var mutations map[string][]*cassandra.Mutation
+	var mutation *cassandra.Mutation
+	var cf columnFamily
+	var key, name string
+	var err error
+
+	s.server.lock.Lock()
+	defer s.server.lock.Unlock()
+
+	// Don't apply anything if part of the batch is invalid.
+	for _, mutations = range mutation_map {
+		for _, mutation = range flatten(mutations) {
+			err = validate(mutation)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for key, mutations = range mutation_map {
+		for name = range mutations {
+			cf, err = s.server.columnFamily(s.keyspace, name, true)
+			if err != nil {
+				return err
+			}
+			if cf[key] == nil {
+				cf[key] = make(row)
+			}
+
+			for _, mutation = range mutations[name] {
+				if mutation.ColumnOrSupercolumn != nil {
+					cf[key].insert(mutation.ColumnOrSupercolumn.Column)
+				} else {
+					cf[key].delete(mutation.Deletion)
+				}
+			}
+
+			if len(cf[key]) == 0 {
+				delete(cf, key)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Collect the mutations for all column families of a row.
+func flatten(mutations map[string][]*cassandra.Mutation) []*cassandra.Mutation {
+	var ret []*cassandra.Mutation
+	var list []*cassandra.Mutation
+
+	for _, list = range mutations {
+		ret = append(ret, list...)
+	}
+	return ret
+}
+
+// Determine whether the fake can apply "mutation".
+func validate(mutation *cassandra.Mutation) error {
+	if mutation.ColumnOrSupercolumn != nil {
+		if mutation.ColumnOrSupercolumn.Column == nil {
+			return errUnsupported
+		}
+		return nil
+	}
+	if mutation.Deletion == nil || mutation.Deletion.SuperColumn != nil {
+		return errUnsupported
+	}
+	if mutation.Deletion.Predicate != nil &&
+		mutation.Deletion.Predicate.ColumnNames == nil {
+		return errUnsupported
+	}
+	return nil
+}
+
+// Store "col" unless the row already has a more recent version of it.
+func (r row) insert(col *cassandra.Column) {
+	var old *cassandra.Column
+	var ok bool
+
+	old, ok = r[string(col.Name)]
+	if ok && timestamp(old.Timestamp) > timestamp(col.Timestamp) {
+		return
+	}
+	r[string(col.Name)] = copyColumn(col)
+}
+
+// Remove the columns selected by "deletion" which aren't more recent than
+// it. A deletion without predicate removes the entire row.
+func (r row) delete(deletion *cassandra.Deletion) {
+	var name []byte
+	var key string
+	var col *cassandra.Column
+
+	if deletion.Predicate == nil {
+		for key, col = range r {
+			if timestamp(col.Timestamp) <= timestamp(deletion.Timestamp) {
+				delete(r, key)
+			}
+		}
+		return
+	}
+
+	for _, name = range deletion.Predicate.ColumnNames {
+		col = r[string(name)]
+		if col != nil &&
+			timestamp(col.Timestamp) <= timestamp(deletion.Timestamp) {
+			delete(r, string(name))
+		}
+	}
+}
+
+// Columns returns copies of all columns stored in the row "key" of the
+// column family "column_family" in "keyspace", ordered by name. This allows
+// tests to check how data is encoded.
+func (srv *Server) Columns(keyspace, column_family string,
+	key []byte) []*cassandra.Column {
+	var ret []*cassandra.Column
+	var names []string
+	var cf columnFamily
+	var r row
+	var name string
+	var err error
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	cf, err = srv.columnFamily(keyspace, column_family, false)
+	if err != nil {
+		return nil
+	}
+	r = cf[string(key)]
+
+	for name = range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name = range names {
+		ret = append(ret, copyColumn(r[name]))
+	}
+	return ret
+}
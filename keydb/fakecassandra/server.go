@@ -0,0 +1,535 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package fakecassandra
+
+import (
+	"bufio"
+	"bytes"
+	"database/cassandra"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// Exception type sent for calls to methods the server doesn't implement.
+const applicationUnknownMethod int32 = 1
+
+var errBadMessageType = errors.New("Expected a Thrift method call")
+var errServerClosed = errors.New("The fake Cassandra server has been closed")
+
+// NewServer starts a fake Cassandra server with no data on a random port
+// of the loopback interface. Clients can connect to the address returned
+// by Addr using either the framed or the unframed transport with the
+// binary protocol.
+func NewServer() (*Server, error) {
+	var srv = &Server{
+		keyspaces: make(map[string]map[string]columnFamily),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	var err error
+
+	srv.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	srv.wg.Add(1)
+	go srv.accept()
+
+	return srv, nil
+}
+
+// Addr returns the "host:port" address the server is listening on.
+func (srv *Server) Addr() string {
+	return srv.listener.Addr().String()
+}
+
+// Close stops the server and disconnects all clients. The data is kept,
+// so tests can still inspect it using Columns.
+func (srv *Server) Close() error {
+	var conn net.Conn
+	var err error
+
+	srv.lock.Lock()
+	if srv.closed {
+		srv.lock.Unlock()
+		return errServerClosed
+	}
+	srv.closed = true
+	err = srv.listener.Close()
+	for conn = range srv.conns {
+		conn.Close()
+	}
+	srv.lock.Unlock()
+
+	srv.wg.Wait()
+	return err
+}
+
+// Accept connections until the listener is closed.
+func (srv *Server) accept() {
+	var conn net.Conn
+	var err error
+
+	defer srv.wg.Done()
+
+	for {
+		conn, err = srv.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		srv.lock.Lock()
+		if srv.closed {
+			srv.lock.Unlock()
+			conn.Close()
+			return
+		}
+		srv.conns[conn] = struct{}{}
+		srv.wg.Add(1)
+		srv.lock.Unlock()
+
+		go srv.serve(conn)
+	}
+}
+
+// Answer the requests sent over "conn" until it is closed or the client
+// sends something which can't be decoded. Strict binary protocol messages
+// start with the version marker, so anything else is taken to be the
+// length prefix of a frame.
+func (srv *Server) serve(conn net.Conn) {
+	var in = bufio.NewReader(conn)
+	var sess = &session{server: srv}
+	var first []byte
+	var err error
+
+	defer srv.wg.Done()
+	defer func() {
+		srv.lock.Lock()
+		delete(srv.conns, conn)
+		srv.lock.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		var proto = &protocolReader{r: in}
+		var reply []byte
+		var framed bool
+
+		first, err = in.Peek(1)
+		if err != nil {
+			return
+		}
+		if framed = first[0] != 0x80; framed {
+			var frame []byte
+			var size int
+
+			size, err = proto.readSize()
+			if err != nil {
+				return
+			}
+			frame = make([]byte, size)
+			_, err = io.ReadFull(in, frame)
+			if err != nil {
+				return
+			}
+			proto = &protocolReader{r: bytes.NewReader(frame)}
+		}
+
+		reply, err = sess.handle(proto)
+		if err != nil {
+			return
+		}
+		if reply == nil {
+			continue
+		}
+
+		if framed {
+			var size [4]byte
+
+			binary.BigEndian.PutUint32(size[:], uint32(len(reply)))
+			reply = append(size[:], reply...)
+		}
+		_, err = conn.Write(reply)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Handler for a Thrift method. It decodes the arguments from "args", calls
+// the corresponding operation and encodes its result, or the exception it
+// raised, as the fields of the result struct.
+type handler func(s *session, args thriftStruct, out *protocolWriter)
+
+var handlers = map[string]handler{
+	"set_keyspace":     (*session).handleSetKeyspace,
+	"get":              (*session).handleGet,
+	"get_slice":        (*session).handleGetSlice,
+	"multiget_slice":   (*session).handleMultigetSlice,
+	"get_range_slices": (*session).handleGetRangeSlices,
+	"batch_mutate":     (*session).handleBatchMutate,
+}
+
+// Read a call from "in" and return the encoded reply, or nil for one way
+// calls. Returns an error if the connection should be dropped.
+func (s *session) handle(in *protocolReader) ([]byte, error) {
+	var out = new(protocolWriter)
+	var args thriftStruct
+	var h handler
+	var name string
+	var mtype byte
+	var seqid int32
+	var ok bool
+	var err error
+
+	name, mtype, seqid, err = in.readMessageBegin()
+	if err == nil && mtype != messageCall && mtype != messageOneway {
+		err = errBadMessageType
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	args, err = in.readStruct(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if h, ok = handlers[name]; !ok {
+		out.writeMessageBegin(name, messageException, seqid)
+		writeApplicationException(out, applicationUnknownMethod,
+			"Invalid method name: '"+name+"'")
+	} else {
+		out.writeMessageBegin(name, messageReply, seqid)
+		h(s, args, out)
+		out.writeFieldStop()
+	}
+
+	if mtype == messageOneway {
+		return nil, nil
+	}
+	return out.Bytes(), nil
+}
+
+// Encode a TApplicationException.
+func writeApplicationException(out *protocolWriter, code int32,
+	message string) {
+	out.writeFieldBegin(typeString, 1)
+	out.writeBinary([]byte(message))
+	out.writeFieldBegin(typeI32, 2)
+	out.writeI32(code)
+	out.writeFieldStop()
+}
+
+// Encode "err" as the exception field of a result struct. Not found errors
+// go into "nfe_id" if the method declares them, everything else is
+// reported as an InvalidRequestException.
+func writeError(out *protocolWriter, err error, nfe_id int16) {
+	var nfe *cassandra.NotFoundException
+
+	if errors.As(err, &nfe) && nfe_id > 0 {
+		out.writeFieldBegin(typeStruct, nfe_id)
+		out.writeFieldStop()
+		return
+	}
+
+	out.writeFieldBegin(typeStruct, 1)
+	out.writeFieldBegin(typeString, 1)
+	out.writeBinary([]byte(err.Error()))
+	out.writeFieldStop()
+}
+
+func (s *session) handleSetKeyspace(args thriftStruct, out *protocolWriter) {
+	var err error
+
+	err = s.setKeyspace(args.str(1))
+	if err != nil {
+		writeError(out, err, 0)
+	}
+}
+
+func (s *session) handleGet(args thriftStruct, out *protocolWriter) {
+	var path = args.child(2)
+	var cosc *cassandra.ColumnOrSuperColumn
+	var err error
+
+	cosc, err = s.get(args.binary(1), &cassandra.ColumnPath{
+		ColumnFamily: path.str(3),
+		SuperColumn:  path.binary(4),
+		Column:       path.binary(5),
+	}, cassandra.ConsistencyLevel(args.i32(3, 1)))
+	if err != nil {
+		writeError(out, err, 2)
+		return
+	}
+
+	out.writeFieldBegin(typeStruct, 0)
+	writeColumnOrSuperColumn(out, cosc)
+}
+
+func (s *session) handleGetSlice(args thriftStruct, out *protocolWriter) {
+	var cols []*cassandra.ColumnOrSuperColumn
+	var err error
+
+	cols, err = s.getSlice(args.binary(1), readColumnParent(args.child(2)),
+		readSlicePredicate(args.child(3)),
+		cassandra.ConsistencyLevel(args.i32(4, 1)))
+	if err != nil {
+		writeError(out, err, 0)
+		return
+	}
+
+	out.writeFieldBegin(typeList, 0)
+	writeColumnList(out, cols)
+}
+
+func (s *session) handleMultigetSlice(args thriftStruct, out *protocolWriter) {
+	var rows map[string][]*cassandra.ColumnOrSuperColumn
+	var keys [][]byte
+	var key string
+	var err error
+
+	keys, err = readBinaryList(args.list(1))
+	if err == nil {
+		rows, err = s.multigetSlice(keys, readColumnParent(args.child(2)),
+			readSlicePredicate(args.child(3)),
+			cassandra.ConsistencyLevel(args.i32(4, 1)))
+	}
+	if err != nil {
+		writeError(out, err, 0)
+		return
+	}
+
+	out.writeFieldBegin(typeMap, 0)
+	out.writeMapBegin(typeString, typeList, len(rows))
+	for key = range rows {
+		out.writeBinary([]byte(key))
+		writeColumnList(out, rows[key])
+	}
+}
+
+func (s *session) handleGetRangeSlices(args thriftStruct,
+	out *protocolWriter) {
+	var kr = args.child(3)
+	var slices []*cassandra.KeySlice
+	var slice *cassandra.KeySlice
+	var err error
+
+	// Tokens and row filters aren't supported, and the cassandra package
+	// represents the tokens in a way we don't need to know about.
+	if kr.has(3) || kr.has(4) || kr.has(6) {
+		writeError(out, errUnsupported, 0)
+		return
+	}
+
+	slices, err = s.getRangeSlices(readColumnParent(args.child(1)),
+		readSlicePredicate(args.child(2)), &cassandra.KeyRange{
+			StartKey: kr.binary(1),
+			EndKey:   kr.binary(2),
+			Count:    kr.i32(5, 100),
+		}, cassandra.ConsistencyLevel(args.i32(4, 1)))
+	if err != nil {
+		writeError(out, err, 0)
+		return
+	}
+
+	out.writeFieldBegin(typeList, 0)
+	out.writeListBegin(typeStruct, len(slices))
+	for _, slice = range slices {
+		out.writeFieldBegin(typeString, 1)
+		out.writeBinary(slice.Key)
+		out.writeFieldBegin(typeList, 2)
+		writeColumnList(out, slice.Columns)
+		out.writeFieldStop()
+	}
+}
+
+func (s *session) handleBatchMutate(args thriftStruct, out *protocolWriter) {
+	var mmap = make(map[string]map[string][]*cassandra.Mutation)
+	var rows = args.mapping(1)
+	var i int
+	var err error
+
+	for i = range rows.keys {
+		var key, _ = rows.keys[i].([]byte)
+		var cfs, _ = rows.values[i].(*thriftMap)
+		var j int
+
+		if cfs == nil {
+			cfs = new(thriftMap)
+		}
+		mmap[string(key)] = make(map[string][]*cassandra.Mutation)
+
+		for j = range cfs.keys {
+			var cf, _ = cfs.keys[j].([]byte)
+			var mutations, _ = cfs.values[j].([]interface{})
+			var value interface{}
+
+			for _, value = range mutations {
+				var m, _ = value.(thriftStruct)
+
+				mmap[string(key)][string(cf)] = append(
+					mmap[string(key)][string(cf)], readMutation(m))
+			}
+		}
+	}
+
+	err = s.batchMutate(mmap, cassandra.ConsistencyLevel(args.i32(2, 1)))
+	if err != nil {
+		writeError(out, err, 0)
+	}
+}
+
+// Decoding of the Cassandra structs used in requests.
+
+func readColumnParent(st thriftStruct) *cassandra.ColumnParent {
+	return &cassandra.ColumnParent{
+		ColumnFamily: st.str(3),
+		SuperColumn:  st.binary(4),
+	}
+}
+
+func readSlicePredicate(st thriftStruct) *cassandra.SlicePredicate {
+	var ret = cassandra.NewSlicePredicate()
+	var sr thriftStruct
+	var err error
+
+	if st == nil {
+		return nil
+	}
+
+	if st.has(1) {
+		ret.ColumnNames, err = readBinaryList(st.list(1))
+		if err != nil {
+			return nil
+		}
+		if ret.ColumnNames == nil {
+			ret.ColumnNames = [][]byte{}
+		}
+	}
+
+	if sr = st.child(2); sr != nil {
+		ret.SliceRange = &cassandra.SliceRange{
+			Start:    sr.binary(1),
+			Finish:   sr.binary(2),
+			Reversed: sr.boolean(3),
+			Count:    sr.i32(4, 100),
+		}
+	}
+	return ret
+}
+
+func readMutation(st thriftStruct) *cassandra.Mutation {
+	var ret = cassandra.NewMutation()
+	var cosc, col, del thriftStruct
+
+	// Anything but a plain column is left out, so it gets rejected.
+	if cosc = st.child(1); cosc != nil {
+		ret.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
+		if col = cosc.child(1); col != nil {
+			ret.ColumnOrSupercolumn.Column = readColumn(col)
+		}
+	}
+
+	if del = st.child(2); del != nil {
+		ret.Deletion = &cassandra.Deletion{
+			Timestamp:   del.i64(1),
+			SuperColumn: del.binary(2),
+			Predicate:   readSlicePredicate(del.child(3)),
+		}
+	}
+	return ret
+}
+
+func readColumn(st thriftStruct) *cassandra.Column {
+	var ret = cassandra.NewColumn()
+
+	ret.Name = st.binary(1)
+	ret.Value = st.binary(2)
+	ret.Timestamp = st.i64(3)
+	return ret
+}
+
+var errNotBinary = errors.New("Expected a list of binary values")
+
+func readBinaryList(values []interface{}) ([][]byte, error) {
+	var ret [][]byte
+	var value interface{}
+
+	for _, value = range values {
+		var b []byte
+		var ok bool
+
+		if b, ok = value.([]byte); !ok {
+			return nil, errNotBinary
+		}
+		ret = append(ret, b)
+	}
+	return ret, nil
+}
+
+// Encoding of the Cassandra structs used in replies.
+
+func writeColumnOrSuperColumn(out *protocolWriter,
+	cosc *cassandra.ColumnOrSuperColumn) {
+	if cosc.Column != nil {
+		out.writeFieldBegin(typeStruct, 1)
+		writeColumn(out, cosc.Column)
+	}
+	out.writeFieldStop()
+}
+
+func writeColumn(out *protocolWriter, col *cassandra.Column) {
+	out.writeFieldBegin(typeString, 1)
+	out.writeBinary(col.Name)
+	if col.Value != nil {
+		out.writeFieldBegin(typeString, 2)
+		out.writeBinary(col.Value)
+	}
+	if col.Timestamp != nil {
+		out.writeFieldBegin(typeI64, 3)
+		out.writeI64(*col.Timestamp)
+	}
+	out.writeFieldStop()
+}
+
+func writeColumnList(out *protocolWriter,
+	cols []*cassandra.ColumnOrSuperColumn) {
+	var cosc *cassandra.ColumnOrSuperColumn
+
+	out.writeListBegin(typeStruct, len(cols))
+	for _, cosc = range cols {
+		writeColumnOrSuperColumn(out, cosc)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package fakecassandra
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// Send a call with the given arguments to "conn" and decode the reply.
+func call(t *testing.T, conn net.Conn, in *bufio.Reader, framed bool,
+	name string, args func(*protocolWriter)) (byte, thriftStruct) {
+	var out = new(protocolWriter)
+	var proto = &protocolReader{r: in}
+	var body thriftStruct
+	var mtype byte
+	var msg []byte
+	var err error
+
+	out.writeMessageBegin(name, messageCall, 1)
+	args(out)
+	out.writeFieldStop()
+
+	msg = out.Bytes()
+	if framed {
+		var size [4]byte
+
+		binary.BigEndian.PutUint32(size[:], uint32(len(msg)))
+		msg = append(size[:], msg...)
+	}
+	_, err = conn.Write(msg)
+	if err != nil {
+		t.Fatal("Error sending call: ", err)
+	}
+
+	if framed {
+		_, err = proto.readSize()
+		if err != nil {
+			t.Fatal("Error reading frame size: ", err)
+		}
+	}
+	_, mtype, _, err = proto.readMessageBegin()
+	if err == nil {
+		body, err = proto.readStruct(0)
+	}
+	if err != nil {
+		t.Fatal("Error reading reply: ", err)
+	}
+	return mtype, body
+}
+
+func TestServerTransports(t *testing.T) {
+	var server *Server
+	var framed bool
+	var err error
+
+	server, err = NewServer()
+	if err != nil {
+		t.Fatal("Error starting server: ", err)
+	}
+	defer server.Close()
+
+	for _, framed = range []bool{false, true} {
+		var conn net.Conn
+		var in *bufio.Reader
+		var body thriftStruct
+		var mtype byte
+
+		conn, err = net.Dial("tcp", server.Addr())
+		if err != nil {
+			t.Fatal("Error connecting to server: ", err)
+		}
+		in = bufio.NewReader(conn)
+
+		// Reading data requires a keyspace.
+		mtype, body = call(t, conn, in, framed, "get_slice",
+			func(out *protocolWriter) {
+				out.writeFieldBegin(typeString, 1)
+				out.writeBinary([]byte("row"))
+			})
+		if mtype != messageReply || body.child(1) == nil {
+			t.Errorf("Expected an InvalidRequestException (framed: %v), "+
+				"got %v", framed, body)
+		}
+
+		mtype, body = call(t, conn, in, framed, "set_keyspace",
+			func(out *protocolWriter) {
+				out.writeFieldBegin(typeString, 1)
+				out.writeBinary([]byte("test"))
+			})
+		if mtype != messageReply || len(body) != 0 {
+			t.Errorf("Unexpected reply to set_keyspace (framed: %v): %v",
+				framed, body)
+		}
+
+		mtype, body = call(t, conn, in, framed, "get",
+			func(out *protocolWriter) {
+				out.writeFieldBegin(typeString, 1)
+				out.writeBinary([]byte("row"))
+				out.writeFieldBegin(typeStruct, 2)
+				out.writeFieldBegin(typeString, 3)
+				out.writeBinary([]byte("cf"))
+				out.writeFieldBegin(typeString, 5)
+				out.writeBinary([]byte("column"))
+				out.writeFieldStop()
+			})
+		if mtype != messageReply || body.child(2) == nil {
+			t.Errorf("Expected a NotFoundException (framed: %v), got %v",
+				framed, body)
+		}
+
+		mtype, body = call(t, conn, in, framed, "describe_ring",
+			func(out *protocolWriter) {})
+		if mtype != messageException ||
+			body.i32(2, 0) != applicationUnknownMethod {
+			t.Errorf("Expected an unknown method error (framed: %v), got %v",
+				framed, body)
+		}
+
+		conn.Close()
+	}
+}
+
+func TestServerCloseDisconnectsClients(t *testing.T) {
+	var server *Server
+	var conn net.Conn
+	var err error
+
+	server, err = NewServer()
+	if err != nil {
+		t.Fatal("Error starting server: ", err)
+	}
+
+	conn, err = net.Dial("tcp", server.Addr())
+	if err != nil {
+		t.Fatal("Error connecting to server: ", err)
+	}
+	defer conn.Close()
+
+	err = server.Close()
+	if err != nil {
+		t.Error("Error closing server: ", err)
+	}
+
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil {
+		t.Error("Connection still open after closing the server")
+	}
+}
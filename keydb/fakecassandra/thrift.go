@@ -0,0 +1,460 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package fakecassandra
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// Type identifiers of the Thrift binary protocol.
+const (
+	typeStop   byte = 0
+	typeBool   byte = 2
+	typeByte   byte = 3
+	typeDouble byte = 4
+	typeI16    byte = 6
+	typeI32    byte = 8
+	typeI64    byte = 10
+	typeString byte = 11
+	typeStruct byte = 12
+	typeMap    byte = 13
+	typeSet    byte = 14
+	typeList   byte = 15
+)
+
+// Message types of the Thrift binary protocol.
+const (
+	messageCall      byte = 1
+	messageReply     byte = 2
+	messageException byte = 3
+	messageOneway    byte = 4
+)
+
+// Version marker of the strict binary protocol, which is combined with the
+// message type in the first word of each message.
+const (
+	protocolVersionMask uint32 = 0xffff0000
+	protocolVersion1    uint32 = 0x80010000
+)
+
+// Upper limit for the size of frames, strings and containers, so broken
+// requests don't make the server allocate arbitrary amounts of memory.
+const maxMessageSize = 16 << 20
+
+// Nesting limit for structs and containers.
+const maxDepth = 64
+
+var errBadVersion = errors.New("Unsupported Thrift protocol version")
+var errTooLarge = errors.New("Thrift message exceeds the size limit")
+var errTooDeep = errors.New("Thrift message is nested too deeply")
+var errBadType = errors.New("Unknown Thrift type")
+
+// Fields of a decoded struct by their ID. Values are bool, int8, int16,
+// int32, int64, float64, []byte, thriftStruct, []interface{} for lists
+// and sets, or *thriftMap.
+type thriftStruct map[int16]interface{}
+
+// Decoded map, in the order it was sent.
+type thriftMap struct {
+	keys   []interface{}
+	values []interface{}
+}
+
+// protocolReader decodes values encoded with the Thrift binary protocol.
+type protocolReader struct {
+	r   io.Reader
+	buf [8]byte
+}
+
+func (p *protocolReader) readFull(n int) ([]byte, error) {
+	var err error
+
+	_, err = io.ReadFull(p.r, p.buf[:n])
+	return p.buf[:n], err
+}
+
+func (p *protocolReader) readByte() (byte, error) {
+	var b []byte
+	var err error
+
+	b, err = p.readFull(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (p *protocolReader) readI16() (int16, error) {
+	var b []byte
+	var err error
+
+	b, err = p.readFull(2)
+	if err != nil {
+		return 0, err
+	}
+	return int16(binary.BigEndian.Uint16(b)), nil
+}
+
+func (p *protocolReader) readI32() (int32, error) {
+	var b []byte
+	var err error
+
+	b, err = p.readFull(4)
+	if err != nil {
+		return 0, err
+	}
+	return int32(binary.BigEndian.Uint32(b)), nil
+}
+
+func (p *protocolReader) readI64() (int64, error) {
+	var b []byte
+	var err error
+
+	b, err = p.readFull(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(b)), nil
+}
+
+// Read a length prefix and check that it is within the limits.
+func (p *protocolReader) readSize() (int, error) {
+	var size int32
+	var err error
+
+	size, err = p.readI32()
+	if err != nil {
+		return 0, err
+	}
+	if size < 0 || size > maxMessageSize {
+		return 0, errTooLarge
+	}
+	return int(size), nil
+}
+
+func (p *protocolReader) readBinary() ([]byte, error) {
+	var ret []byte
+	var size int
+	var err error
+
+	size, err = p.readSize()
+	if err != nil {
+		return nil, err
+	}
+	ret = make([]byte, size)
+	_, err = io.ReadFull(p.r, ret)
+	return ret, err
+}
+
+// readMessageBegin reads the header of a message in the strict binary
+// protocol.
+func (p *protocolReader) readMessageBegin() (
+	name string, mtype byte, seqid int32, err error) {
+	var version int32
+	var b []byte
+
+	version, err = p.readI32()
+	if err != nil {
+		return
+	}
+	if uint32(version)&protocolVersionMask != protocolVersion1 {
+		err = errBadVersion
+		return
+	}
+	mtype = byte(version)
+
+	b, err = p.readBinary()
+	if err != nil {
+		return
+	}
+	name = string(b)
+
+	seqid, err = p.readI32()
+	return
+}
+
+// readStruct reads all fields of a struct up to its stop marker.
+func (p *protocolReader) readStruct(depth int) (thriftStruct, error) {
+	var ret = make(thriftStruct)
+	var ftype byte
+	var id int16
+	var err error
+
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+
+	for {
+		ftype, err = p.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if ftype == typeStop {
+			return ret, nil
+		}
+
+		id, err = p.readI16()
+		if err != nil {
+			return nil, err
+		}
+		ret[id], err = p.readValue(ftype, depth+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readValue reads a single value of the type "vtype".
+func (p *protocolReader) readValue(vtype byte, depth int) (interface{}, error) {
+	var b byte
+	var u int64
+	var err error
+
+	switch vtype {
+	case typeBool:
+		b, err = p.readByte()
+		return b != 0, err
+	case typeByte:
+		b, err = p.readByte()
+		return int8(b), err
+	case typeI16:
+		return p.readI16()
+	case typeI32:
+		return p.readI32()
+	case typeI64:
+		return p.readI64()
+	case typeDouble:
+		u, err = p.readI64()
+		return math.Float64frombits(uint64(u)), err
+	case typeString:
+		return p.readBinary()
+	case typeStruct:
+		return p.readStruct(depth)
+	case typeList, typeSet:
+		return p.readList(depth)
+	case typeMap:
+		return p.readMap(depth)
+	}
+	return nil, errBadType
+}
+
+func (p *protocolReader) readList(depth int) ([]interface{}, error) {
+	var ret []interface{}
+	var etype byte
+	var size, i int
+	var err error
+
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+
+	etype, err = p.readByte()
+	if err == nil {
+		size, err = p.readSize()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ret = make([]interface{}, 0)
+	for i = 0; i < size; i++ {
+		var value interface{}
+
+		value, err = p.readValue(etype, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, value)
+	}
+	return ret, nil
+}
+
+func (p *protocolReader) readMap(depth int) (*thriftMap, error) {
+	var ret = new(thriftMap)
+	var ktype, vtype byte
+	var size, i int
+	var err error
+
+	if depth > maxDepth {
+		return nil, errTooDeep
+	}
+
+	ktype, err = p.readByte()
+	if err == nil {
+		vtype, err = p.readByte()
+	}
+	if err == nil {
+		size, err = p.readSize()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i = 0; i < size; i++ {
+		var key, value interface{}
+
+		key, err = p.readValue(ktype, depth+1)
+		if err == nil {
+			value, err = p.readValue(vtype, depth+1)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ret.keys = append(ret.keys, key)
+		ret.values = append(ret.values, value)
+	}
+	return ret, nil
+}
+
+// Accessors which return the zero value if a field is missing or has an
+// unexpected type, as Thrift does for optional fields.
+
+func (st thriftStruct) binary(id int16) []byte {
+	var ret, _ = st[id].([]byte)
+	return ret
+}
+
+func (st thriftStruct) str(id int16) string {
+	return string(st.binary(id))
+}
+
+func (st thriftStruct) boolean(id int16) bool {
+	var ret, _ = st[id].(bool)
+	return ret
+}
+
+func (st thriftStruct) i32(id int16, def int32) int32 {
+	var ret int32
+	var ok bool
+
+	if ret, ok = st[id].(int32); !ok {
+		return def
+	}
+	return ret
+}
+
+func (st thriftStruct) i64(id int16) *int64 {
+	var ret int64
+	var ok bool
+
+	if ret, ok = st[id].(int64); !ok {
+		return nil
+	}
+	return &ret
+}
+
+func (st thriftStruct) child(id int16) thriftStruct {
+	var ret, _ = st[id].(thriftStruct)
+	return ret
+}
+
+func (st thriftStruct) list(id int16) []interface{} {
+	var ret, _ = st[id].([]interface{})
+	return ret
+}
+
+func (st thriftStruct) mapping(id int16) *thriftMap {
+	var ret, _ = st[id].(*thriftMap)
+	if ret == nil {
+		return new(thriftMap)
+	}
+	return ret
+}
+
+func (st thriftStruct) has(id int16) bool {
+	var ok bool
+
+	_, ok = st[id]
+	return ok
+}
+
+// protocolWriter encodes values using the Thrift binary protocol.
+type protocolWriter struct {
+	bytes.Buffer
+}
+
+func (p *protocolWriter) writeI16(v int16) {
+	var b [2]byte
+
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	p.Write(b[:])
+}
+
+func (p *protocolWriter) writeI32(v int32) {
+	var b [4]byte
+
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	p.Write(b[:])
+}
+
+func (p *protocolWriter) writeI64(v int64) {
+	var b [8]byte
+
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	p.Write(b[:])
+}
+
+func (p *protocolWriter) writeBinary(v []byte) {
+	p.writeI32(int32(len(v)))
+	p.Write(v)
+}
+
+func (p *protocolWriter) writeMessageBegin(name string, mtype byte,
+	seqid int32) {
+	p.writeI32(int32(protocolVersion1 | uint32(mtype)))
+	p.writeBinary([]byte(name))
+	p.writeI32(seqid)
+}
+
+func (p *protocolWriter) writeFieldBegin(ftype byte, id int16) {
+	p.WriteByte(ftype)
+	p.writeI16(id)
+}
+
+func (p *protocolWriter) writeFieldStop() {
+	p.WriteByte(typeStop)
+}
+
+func (p *protocolWriter) writeListBegin(etype byte, size int) {
+	p.WriteByte(etype)
+	p.writeI32(int32(size))
+}
+
+func (p *protocolWriter) writeMapBegin(ktype, vtype byte, size int) {
+	p.WriteByte(ktype)
+	p.WriteByte(vtype)
+	p.writeI32(int32(size))
+}
@@ -32,6 +32,7 @@
 package keydb
 
 import (
+	"bytes"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"database/cassandra"
@@ -44,17 +45,108 @@ import (
 	"github.com/golang/protobuf/proto"
 )
 
+// KeyDB is implemented by all backends which can store X.509 certificates.
+type KeyDB interface {
+	// ListCertificates lists the next "count" known certificates starting
+	// from "start_index", which is included. The order depends on the
+	// backend, so the next page must be requested starting from the index
+	// of the last certificate listed, rather than the index following it.
+	ListCertificates(start_index uint64, count int32) (
+		[]*x509keyserver.X509KeyData, error)
+
+	// ScanCertificates lists up to "count" certificates from the index for
+	// the given sort order, starting at the position "start".
+	ScanCertificates(order SortOrder, start []byte, reverse bool,
+		count int32) (*CertificatePage, error)
+
+	// RetrieveCertificateByIndex retrieves the certificate with the given
+	// index number.
+	RetrieveCertificateByIndex(index uint64) (*x509.Certificate, error)
+
+	// RetrieveKeyDataByIndex retrieves the certificate with the given
+	// index number along with all its metadata.
+	RetrieveKeyDataByIndex(index uint64) (*x509keyserver.X509KeyData, error)
+
+	// AddX509Certificate adds the given certificate to the database.
+	AddX509Certificate(cert *x509.Certificate) error
+
+	// RevokeX509Certificate marks the certificate with the given index
+	// number as revoked.
+	RevokeX509Certificate(index uint64, when time.Time) error
+}
+
 // X509KeyDB retrieves X.509 certificates from a Cassandra database.
 type X509KeyDB struct {
 	db *cassandra.RetryCassandraClient
 }
 
+// ErrNotFound is returned if the requested certificate is not known.
+var ErrNotFound = errors.New("Certificate not found")
+
+// ErrListIndexZero is returned when listing all certificates can't continue
+// past a certificate with the index 0, which is only possible if it isn't
+// the first row in the order of the partitioner.
+var ErrListIndexZero = errors.New(
+	"Cannot continue listing after the certificate with index 0")
+
 // List of all column names in the certificate column family.
 var certificate_DisplayColumns [][]byte = [][]byte{
-	[]byte("subject"), []byte("issuer"), []byte("expires"),
+	[]byte("subject"), []byte("issuer"), []byte("expires"), []byte("added"),
+	[]byte("revoked"),
 }
 var certificate_AllColumns [][]byte = [][]byte{
-	[]byte("subject"), []byte("issuer"), []byte("expires"), []byte("der_certificate"),
+	[]byte("subject"), []byte("issuer"), []byte("expires"), []byte("added"),
+	[]byte("revoked"), []byte("der_certificate"),
+}
+
+// SortOrder selects the index which is used for enumerating certificates.
+type SortOrder int
+
+const (
+	// SortByIndex enumerates certificates by their index number.
+	SortByIndex SortOrder = iota
+	// SortBySubject enumerates certificates by their formatted subject.
+	SortBySubject
+	// SortByExpiry enumerates certificates by their expiry time stamp.
+	SortByExpiry
+	// SortByAdded enumerates certificates by the time they were added.
+	SortByAdded
+	// SortByRevocation enumerates revoked certificates by the time they
+	// were revoked. Certificates which were not revoked are not included.
+	SortByRevocation
+)
+
+// Row keys of the index rows in the certificate_index column family, by
+// sort order. The column names in each row end in the 8 byte index number
+// of the certificate they refer to, so they sort in the desired order.
+var certificateIndex_Rows = map[SortOrder][]byte{
+	SortByIndex:   []byte("index"),
+	SortBySubject: []byte("subject"),
+	SortByExpiry:  []byte("expires"),
+	SortByAdded:   []byte("added"),
+
+	SortByRevocation: []byte("revoked"),
+}
+
+// CertificatePage is one page of certificates enumerated from one of the
+// certificate indices.
+type CertificatePage struct {
+	// Metadata of the certificates on the page, in scan order.
+	Records []*x509keyserver.X509KeyData
+
+	// Position of each of the records in the index. These can be used
+	// as the start position for subsequent scans.
+	Cursors [][]byte
+
+	// Position of the first record after the page in scan direction,
+	// or nil if the scan reached the end of the index.
+	Next []byte
+}
+
+// More determines whether there are more records after the page in scan
+// direction.
+func (p *CertificatePage) More() bool {
+	return p.Next != nil
 }
 
 // FormatCertSubject converts the specified certificate name field into a string
@@ -105,7 +197,9 @@ func NewX509KeyDB(dbserver, keyspace string) (*X509KeyDB, error) {
 }
 
 // ListCertificates lists the next "count" known certificates starting from
-// "start_index".
+// "start_index". The certificates are returned in the order of the
+// partitioner of the database, which is only the order of their indices
+// with an order preserving partitioner.
 func (db *X509KeyDB) ListCertificates(start_index uint64, count int32) ([]*x509keyserver.X509KeyData, error) {
 	var ret []*x509keyserver.X509KeyData
 	var cp *cassandra.ColumnParent = cassandra.NewColumnParent()
@@ -134,27 +228,11 @@ func (db *X509KeyDB) ListCertificates(start_index uint64, count int32) ([]*x509k
 	}
 
 	for _, ks = range r {
-		var rv *x509keyserver.X509KeyData = new(x509keyserver.X509KeyData)
-		var cos *cassandra.ColumnOrSuperColumn
-		rv.Index = proto.Uint64(binary.BigEndian.Uint64(ks.Key))
-
-		for _, cos = range ks.Columns {
-			var col *cassandra.Column = cos.Column
-			if col == nil {
-				continue
-			}
+		var rv *x509keyserver.X509KeyData
 
-			if string(col.Name) == "subject" {
-				rv.Subject = proto.String(string(col.Value))
-			} else if string(col.Name) == "issuer" {
-				rv.Issuer = proto.String(string(col.Value))
-			} else if string(col.Name) == "issuer" {
-				rv.Issuer = proto.String(string(col.Value))
-			} else if string(col.Name) == "expires" {
-				rv.Expires = proto.Uint64(binary.BigEndian.Uint64(col.Value))
-			} else {
-				return ret, errors.New("Unexpected column: " + string(col.Name))
-			}
+		rv, err = keyDataFromColumns(ks.Key, ks.Columns)
+		if err != nil {
+			return ret, err
 		}
 
 		ret = append(ret, rv)
@@ -163,6 +241,154 @@ func (db *X509KeyDB) ListCertificates(start_index uint64, count int32) ([]*x509k
 	return ret, nil
 }
 
+// keyDataFromColumns converts the columns of the certificate with the given
+// row key into certificate metadata.
+func keyDataFromColumns(key []byte, columns []*cassandra.ColumnOrSuperColumn) (
+	*x509keyserver.X509KeyData, error) {
+	var rv *x509keyserver.X509KeyData = new(x509keyserver.X509KeyData)
+	var cos *cassandra.ColumnOrSuperColumn
+
+	if len(key) != 8 {
+		return nil, fmt.Errorf("Invalid certificate key length %d", len(key))
+	}
+	rv.Index = proto.Uint64(binary.BigEndian.Uint64(key))
+
+	for _, cos = range columns {
+		var col *cassandra.Column = cos.Column
+		if col == nil {
+			continue
+		}
+
+		if string(col.Name) == "subject" {
+			rv.Subject = proto.String(string(col.Value))
+		} else if string(col.Name) == "issuer" {
+			rv.Issuer = proto.String(string(col.Value))
+		} else if string(col.Name) == "expires" {
+			rv.Expires = proto.Uint64(binary.BigEndian.Uint64(col.Value))
+		} else if string(col.Name) == "added" {
+			rv.Added = proto.Uint64(binary.BigEndian.Uint64(col.Value))
+		} else if string(col.Name) == "revoked" {
+			rv.Revoked = proto.Uint64(binary.BigEndian.Uint64(col.Value))
+		} else if string(col.Name) == "der_certificate" {
+			rv.DerCertificate = col.Value
+		} else {
+			return nil, errors.New("Unexpected column: " + string(col.Name))
+		}
+	}
+
+	return rv, nil
+}
+
+// IndexCursor returns the position of the certificate described by "rec"
+// in the index for the specified sort order. Only the fields relevant for
+// the sort order need to be set. This can be used to start a scan at a
+// specific certificate. Leaving the index number at 0 yields the first
+// position for the given subject or time stamp.
+func IndexCursor(order SortOrder, rec *x509keyserver.X509KeyData) []byte {
+	var ret []byte
+	var suffix []byte = make([]byte, 8)
+
+	binary.BigEndian.PutUint64(suffix, rec.GetIndex())
+
+	switch order {
+	case SortBySubject:
+		ret = append([]byte(rec.GetSubject()), 0)
+	case SortByExpiry:
+		ret = make([]byte, 8)
+		binary.BigEndian.PutUint64(ret, rec.GetExpires())
+	case SortByAdded:
+		ret = make([]byte, 8)
+		binary.BigEndian.PutUint64(ret, rec.GetAdded())
+	case SortByRevocation:
+		ret = make([]byte, 8)
+		binary.BigEndian.PutUint64(ret, rec.GetRevoked())
+	}
+
+	return append(ret, suffix...)
+}
+
+// ScanCertificates lists up to "count" certificates from the index for the
+// given sort order, starting at the position "start" (inclusive). If "start"
+// is empty, the scan starts at the beginning of the index, or at its end if
+// "reverse" is set. Reverse scans walk the index backwards.
+func (db *X509KeyDB) ScanCertificates(order SortOrder, start []byte,
+	reverse bool, count int32) (*CertificatePage, error) {
+	var ret *CertificatePage = new(CertificatePage)
+	var cp *cassandra.ColumnParent = cassandra.NewColumnParent()
+	var pred *cassandra.SlicePredicate = cassandra.NewSlicePredicate()
+	var rowKey []byte
+	var keys [][]byte
+	var names []*cassandra.ColumnOrSuperColumn
+	var rows map[string][]*cassandra.ColumnOrSuperColumn
+	var cos *cassandra.ColumnOrSuperColumn
+	var key []byte
+	var ok bool
+	var err error
+
+	if rowKey, ok = certificateIndex_Rows[order]; !ok {
+		return nil, fmt.Errorf("Unknown sort order %d", order)
+	}
+	if count <= 0 {
+		return ret, nil
+	}
+
+	// Fetch one additional entry to find out whether there are more.
+	cp.ColumnFamily = "certificate_index"
+	pred.SliceRange = cassandra.NewSliceRange()
+	pred.SliceRange.Start = start
+	if pred.SliceRange.Start == nil {
+		pred.SliceRange.Start = make([]byte, 0)
+	}
+	pred.SliceRange.Finish = make([]byte, 0)
+	pred.SliceRange.Reversed = reverse
+	pred.SliceRange.Count = count + 1
+
+	names, err = db.db.GetSlice(rowKey, cp, pred,
+		cassandra.ConsistencyLevel_ONE)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cos = range names {
+		if cos.Column == nil || len(cos.Column.Name) < 8 {
+			continue
+		}
+		if int32(len(ret.Cursors)) == count {
+			ret.Next = cos.Column.Name
+			break
+		}
+		ret.Cursors = append(ret.Cursors, cos.Column.Name)
+		keys = append(keys, cos.Column.Name[len(cos.Column.Name)-8:])
+	}
+
+	if len(keys) == 0 {
+		return ret, nil
+	}
+
+	cp = cassandra.NewColumnParent()
+	cp.ColumnFamily = "certificate"
+	pred = cassandra.NewSlicePredicate()
+	pred.ColumnNames = certificate_DisplayColumns
+
+	rows, err = db.db.MultigetSlice(keys, cp, pred,
+		cassandra.ConsistencyLevel_ONE)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key = range keys {
+		var rv *x509keyserver.X509KeyData
+
+		rv, err = keyDataFromColumns(key, rows[string(key)])
+		if err != nil {
+			return nil, err
+		}
+		ret.Records = append(ret.Records, rv)
+	}
+
+	return ret, nil
+}
+
 // RetrieveCertificateByIndex retrieves the certificate with the given index
 // number assigned by the issuer from the database.
 func (db *X509KeyDB) RetrieveCertificateByIndex(index uint64) (*x509.Certificate, error) {
@@ -188,58 +414,256 @@ func (db *X509KeyDB) RetrieveCertificateByIndex(index uint64) (*x509.Certificate
 	return x509.ParseCertificate(r.Column.Value)
 }
 
+// RetrieveKeyDataByIndex retrieves all data stored about the certificate
+// with the given index number, including the certificate itself. Returns
+// ErrNotFound if there is no such certificate.
+func (db *X509KeyDB) RetrieveKeyDataByIndex(index uint64) (
+	*x509keyserver.X509KeyData, error) {
+	var cp *cassandra.ColumnParent = cassandra.NewColumnParent()
+	var pred *cassandra.SlicePredicate = cassandra.NewSlicePredicate()
+	var r []*cassandra.ColumnOrSuperColumn
+	var ret *x509keyserver.X509KeyData
+	var key []byte = make([]byte, 8)
+	var err error
+
+	binary.BigEndian.PutUint64(key, index)
+
+	cp.ColumnFamily = "certificate"
+	pred.ColumnNames = certificate_AllColumns
+
+	r, err = db.db.GetSlice(key, cp, pred, cassandra.ConsistencyLevel_ONE)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err = keyDataFromColumns(key, r)
+	if err != nil {
+		return nil, err
+	}
+	if len(ret.DerCertificate) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return ret, nil
+}
+
+// newColumnMutation creates a mutation for setting the column "name" to
+// "value" with the time stamp "ts".
+func newColumnMutation(name, value []byte, ts *int64) *cassandra.Mutation {
+	var mutation *cassandra.Mutation = cassandra.NewMutation()
+
+	mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
+	mutation.ColumnOrSupercolumn.Column = cassandra.NewColumn()
+	mutation.ColumnOrSupercolumn.Column.Name = name
+	mutation.ColumnOrSupercolumn.Column.Value = value
+	mutation.ColumnOrSupercolumn.Column.Timestamp = ts
+	return mutation
+}
+
+// encodeUint64 encodes "value" as an 8 byte big endian column value.
+func encodeUint64(value uint64) []byte {
+	var ret []byte = make([]byte, 8)
+
+	binary.BigEndian.PutUint64(ret, value)
+	return ret
+}
+
+// addIndexMutation registers the certificate described by "rec" in the
+// index for the given sort order as part of the mutation map "mmap".
+func addIndexMutation(mmap map[string]map[string][]*cassandra.Mutation,
+	order SortOrder, rec *x509keyserver.X509KeyData, ts *int64) {
+	var row []byte = certificateIndex_Rows[order]
+	var ok bool
+
+	if _, ok = mmap[string(row)]; !ok {
+		mmap[string(row)] = make(map[string][]*cassandra.Mutation)
+	}
+
+	mmap[string(row)]["certificate_index"] = append(
+		mmap[string(row)]["certificate_index"],
+		newColumnMutation(IndexCursor(order, rec), make([]byte, 0), ts))
+}
+
+// keyDataFromCertificate creates the metadata stored about "cert" when it
+// is added to the database at the time "now".
+func keyDataFromCertificate(cert *x509.Certificate, now time.Time) *x509keyserver.X509KeyData {
+	return &x509keyserver.X509KeyData{
+		Index:   proto.Uint64(cert.SerialNumber.Uint64()),
+		Subject: proto.String(string(FormatCertSubject(cert.Subject))),
+		Issuer:  proto.String(string(FormatCertSubject(cert.Issuer))),
+		Expires: proto.Uint64(uint64(cert.NotAfter.Unix())),
+		Added:   proto.Uint64(uint64(now.Unix())),
+	}
+}
+
+// removeIndexMutation removes the entry for the certificate described by
+// "rec" from the index for the given sort order as part of the mutation
+// map "mmap".
+func removeIndexMutation(mmap map[string]map[string][]*cassandra.Mutation,
+	order SortOrder, rec *x509keyserver.X509KeyData, ts *int64) {
+	var row []byte = certificateIndex_Rows[order]
+	var mutation *cassandra.Mutation = cassandra.NewMutation()
+	var ok bool
+
+	mutation.Deletion = cassandra.NewDeletion()
+	mutation.Deletion.Timestamp = ts
+	mutation.Deletion.Predicate = cassandra.NewSlicePredicate()
+	mutation.Deletion.Predicate.ColumnNames = [][]byte{IndexCursor(order, rec)}
+
+	if _, ok = mmap[string(row)]; !ok {
+		mmap[string(row)] = make(map[string][]*cassandra.Mutation)
+	}
+
+	mmap[string(row)]["certificate_index"] = append(
+		mmap[string(row)]["certificate_index"], mutation)
+}
+
 // AddX509Certificate adds all relevant data for the given X.509 certificate.
+// If a certificate with the same index is already known, it is replaced,
+// but keeps the time it was first added and its revocation status.
 func (db *X509KeyDB) AddX509Certificate(cert *x509.Certificate) error {
 	var now time.Time = time.Now()
 	var mmap = make(map[string]map[string][]*cassandra.Mutation)
-	var mutation *cassandra.Mutation
-	var expires uint64
+	var rec, old *x509keyserver.X509KeyData
+	var order SortOrder
 	var key []byte = make([]byte, 8)
 	var ts int64 = now.UnixNano() / 1000
+	var err error
+
+	rec = keyDataFromCertificate(cert, now)
 
-	binary.BigEndian.PutUint64(key, cert.SerialNumber.Uint64())
+	old, err = db.RetrieveKeyDataByIndex(rec.GetIndex())
+	if err == nil {
+		if old.Added != nil {
+			rec.Added = old.Added
+		}
+		rec.Revoked = old.Revoked
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	binary.BigEndian.PutUint64(key, rec.GetIndex())
 	mmap[string(key)] = make(map[string][]*cassandra.Mutation)
-	mmap[string(key)]["certificate"] = make([]*cassandra.Mutation, 0)
+	mmap[string(key)]["certificate"] = []*cassandra.Mutation{
+		newColumnMutation([]byte("subject"), []byte(rec.GetSubject()), &ts),
+		newColumnMutation([]byte("issuer"), []byte(rec.GetIssuer()), &ts),
+		newColumnMutation([]byte("expires"),
+			encodeUint64(rec.GetExpires()), &ts),
+		newColumnMutation([]byte("added"), encodeUint64(rec.GetAdded()), &ts),
+		newColumnMutation([]byte("der_certificate"), cert.Raw, &ts),
+	}
 
-	mutation = cassandra.NewMutation()
-	mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	mutation.ColumnOrSupercolumn.Column = cassandra.NewColumn()
-	mutation.ColumnOrSupercolumn.Column.Name = []byte("subject")
-	mutation.ColumnOrSupercolumn.Column.Value = FormatCertSubject(cert.Subject)
-	mutation.ColumnOrSupercolumn.Column.Timestamp = &ts
-	mmap[string(key)]["certificate"] = append(
-		mmap[string(key)]["certificate"], mutation)
+	// Register the certificate in the indices used for enumeration, and
+	// remove index entries of the certificate it replaces which would
+	// point to it again under a different position.
+	for order = range certificateIndex_Rows {
+		if order == SortByRevocation {
+			continue
+		}
+		if old != nil && !bytes.Equal(IndexCursor(order, old),
+			IndexCursor(order, rec)) {
+			removeIndexMutation(mmap, order, old, &ts)
+		}
+		addIndexMutation(mmap, order, rec, &ts)
+	}
 
-	mutation = cassandra.NewMutation()
-	mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	mutation.ColumnOrSupercolumn.Column = cassandra.NewColumn()
-	mutation.ColumnOrSupercolumn.Column.Name = []byte("issuer")
-	mutation.ColumnOrSupercolumn.Column.Value = FormatCertSubject(cert.Issuer)
-	mutation.ColumnOrSupercolumn.Column.Timestamp = &ts
-	mmap[string(key)]["certificate"] = append(
-		mmap[string(key)]["certificate"], mutation)
+	// Commit the data into the database.
+	return db.db.BatchMutate(mmap, cassandra.ConsistencyLevel_QUORUM)
+}
 
-	expires = uint64(cert.NotAfter.Unix())
+// Number of certificates read at a time by ReindexCertificates.
+const reindexBatchSize = 100
+
+// ReindexCertificates registers all certificates stored in the database in
+// the indices used by ScanCertificates. This is needed for certificates
+// which were added before the indices existed, and is safe to repeat.
+// Returns the number of certificates processed.
+func (db *X509KeyDB) ReindexCertificates() (int, error) {
+	var ts int64 = time.Now().UnixNano() / 1000
+	var recs []*x509keyserver.X509KeyData
+	var rec *x509keyserver.X509KeyData
+	var start uint64
+	var first bool = true
+	var count int
+	var err error
 
-	mutation = cassandra.NewMutation()
-	mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	mutation.ColumnOrSupercolumn.Column = cassandra.NewColumn()
-	mutation.ColumnOrSupercolumn.Column.Name = []byte("expires")
-	mutation.ColumnOrSupercolumn.Column.Value = make([]byte, 8)
-	binary.BigEndian.PutUint64(mutation.ColumnOrSupercolumn.Column.Value, expires)
-	mutation.ColumnOrSupercolumn.Column.Timestamp = &ts
-	mmap[string(key)]["certificate"] = append(
-		mmap[string(key)]["certificate"], mutation)
-
-	mutation = cassandra.NewMutation()
-	mutation.ColumnOrSupercolumn = cassandra.NewColumnOrSuperColumn()
-	mutation.ColumnOrSupercolumn.Column = cassandra.NewColumn()
-	mutation.ColumnOrSupercolumn.Column.Name = []byte("der_certificate")
-	mutation.ColumnOrSupercolumn.Column.Value = cert.Raw
-	mutation.ColumnOrSupercolumn.Column.Timestamp = &ts
-	mmap[string(key)]["certificate"] = append(
-		mmap[string(key)]["certificate"], mutation)
+	for {
+		var mmap = make(map[string]map[string][]*cassandra.Mutation)
+		var listed int
+
+		recs, err = db.ListCertificates(start, reindexBatchSize)
+		if err != nil {
+			return count, err
+		}
+		listed = len(recs)
+
+		// Rows are listed in the order of the partitioner rather than by
+		// index, so every batch starts with the last row of the previous
+		// one.
+		if !first && len(recs) > 0 && recs[0].GetIndex() == start {
+			recs = recs[1:]
+		}
+		first = false
+
+		for _, rec = range recs {
+			addIndexMutation(mmap, SortByIndex, rec, &ts)
+			addIndexMutation(mmap, SortBySubject, rec, &ts)
+			addIndexMutation(mmap, SortByExpiry, rec, &ts)
+			if rec.Added != nil {
+				addIndexMutation(mmap, SortByAdded, rec, &ts)
+			}
+			if rec.Revoked != nil {
+				addIndexMutation(mmap, SortByRevocation, rec, &ts)
+			}
+		}
+
+		if len(mmap) > 0 {
+			err = db.db.BatchMutate(mmap, cassandra.ConsistencyLevel_QUORUM)
+			if err != nil {
+				return count, err
+			}
+		}
+		count += len(recs)
+
+		if listed < reindexBatchSize || len(recs) == 0 {
+			return count, nil
+		}
+		start = recs[len(recs)-1].GetIndex()
+		if start == 0 {
+			// A start index of 0 means the beginning of the table.
+			return count, ErrListIndexZero
+		}
+	}
+}
+
+// RevokeX509Certificate marks the certificate with the given index number
+// as revoked at the time "when". Returns ErrNotFound if there is no such
+// certificate.
+func (db *X509KeyDB) RevokeX509Certificate(index uint64, when time.Time) error {
+	var mmap = make(map[string]map[string][]*cassandra.Mutation)
+	var rec *x509keyserver.X509KeyData
+	var key []byte = make([]byte, 8)
+	var ts int64 = time.Now().UnixNano() / 1000
+	var err error
+
+	rec, err = db.RetrieveKeyDataByIndex(index)
+	if err != nil {
+		return err
+	}
+
+	// Keep the original revocation time if it was revoked before.
+	if rec.Revoked != nil {
+		return nil
+	}
+	rec.Revoked = proto.Uint64(uint64(when.Unix()))
+
+	binary.BigEndian.PutUint64(key, index)
+	mmap[string(key)] = make(map[string][]*cassandra.Mutation)
+	mmap[string(key)]["certificate"] = []*cassandra.Mutation{
+		newColumnMutation([]byte("revoked"), encodeUint64(rec.GetRevoked()),
+			&ts),
+	}
+	addIndexMutation(mmap, SortByRevocation, rec, &ts)
 
-	// Commit the data into the database.
 	return db.db.BatchMutate(mmap, cassandra.ConsistencyLevel_QUORUM)
 }
@@ -0,0 +1,650 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package keydb_test
+
+import (
+	"bytes"
+	"crypto/x509"
+	"database/cassandra"
+	"encoding/binary"
+	"math/big"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/caoimhechaos/x509keyserver"
+	"github.com/caoimhechaos/x509keyserver/keydb"
+	"github.com/caoimhechaos/x509keyserver/keydb/fakecassandra"
+	"github.com/caoimhechaos/x509keyserver/x509keyservertest"
+)
+
+// Keyspace used by the key databases in tests.
+const testKeyspace = "x509certs"
+
+// Create a key database connected to an empty fake Cassandra server, which
+// is stopped when the test ends.
+func newTestDB(t *testing.T) (*keydb.X509KeyDB, *fakecassandra.Server) {
+	var server *fakecassandra.Server
+	var db *keydb.X509KeyDB
+	var err error
+
+	server, err = fakecassandra.NewServer()
+	if err != nil {
+		t.Fatal("Error starting fake Cassandra server: ", err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	db, err = keydb.NewX509KeyDB(server.Addr(), testKeyspace)
+	if err != nil {
+		t.Fatal("Error connecting to fake Cassandra server: ", err)
+	}
+	return db, server
+}
+
+// Generate a CA hierarchy with the given number of leaves and add all its
+// certificates to "db".
+func addHierarchy(t *testing.T, db keydb.KeyDB, leaves int) []*x509.Certificate {
+	var h *x509keyservertest.Hierarchy
+	var err error
+
+	h, err = x509keyservertest.NewHierarchy(leaves)
+	if err == nil {
+		err = x509keyservertest.AddCertificates(db, h.Certificates()...)
+	}
+	if err != nil {
+		t.Fatal("Error adding certificates: ", err)
+	}
+	return h.Certificates()
+}
+
+// All sort orders, and the rows of the certificate_index column family
+// which hold their indices.
+var indexRows = map[keydb.SortOrder]string{
+	keydb.SortByIndex:      "index",
+	keydb.SortBySubject:    "subject",
+	keydb.SortByExpiry:     "expires",
+	keydb.SortByAdded:      "added",
+	keydb.SortByRevocation: "revoked",
+}
+
+// Determine the indices of the certificates in a scan, in scan order.
+func pageIndices(page *keydb.CertificatePage) []uint64 {
+	var ret []uint64
+	var i int
+
+	for i = range page.Records {
+		ret = append(ret, page.Records[i].GetIndex())
+	}
+	return ret
+}
+
+func TestReindexCertificates(t *testing.T) {
+	var db, server = newTestDB(t)
+	var client *cassandra.RetryCassandraClient
+	var certs = addHierarchy(t, db, 3)
+	var mmap = make(map[string]map[string][]*cassandra.Mutation)
+	var page *keydb.CertificatePage
+	var order keydb.SortOrder
+	var ts int64 = time.Now().UnixNano() / 1000
+	var row string
+	var count int
+	var err error
+
+	err = db.RevokeX509Certificate(certs[2].SerialNumber.Uint64(),
+		time.Now())
+	if err != nil {
+		t.Fatal("Error revoking certificate: ", err)
+	}
+
+	// Drop the indices, as if the certificates had been added by an
+	// older version.
+	for _, row = range indexRows {
+		var deletion = cassandra.NewDeletion()
+
+		deletion.Timestamp = &ts
+		mmap[row] = map[string][]*cassandra.Mutation{
+			"certificate_index": {{Deletion: deletion}},
+		}
+	}
+	client, err = cassandra.NewRetryCassandraClient(server.Addr())
+	if err == nil {
+		err = client.SetKeyspace(testKeyspace)
+	}
+	if err == nil {
+		err = client.BatchMutate(mmap, cassandra.ConsistencyLevel_ONE)
+	}
+	if err != nil {
+		t.Fatal("Error dropping indices: ", err)
+	}
+
+	page, err = db.ScanCertificates(keydb.SortByIndex, nil, false, 10)
+	if err != nil {
+		t.Fatal("Error scanning certificates: ", err)
+	}
+	if len(page.Records) != 0 {
+		t.Fatal("Expected an empty index, got ", pageIndices(page))
+	}
+
+	count, err = db.ReindexCertificates()
+	if err != nil {
+		t.Fatal("Error reindexing certificates: ", err)
+	}
+	if count != len(certs) {
+		t.Errorf("Reindexed %d certificates, expected %d", count, len(certs))
+	}
+
+	for order = range indexRows {
+		var expected int = len(certs)
+
+		if order == keydb.SortByRevocation {
+			expected = 1
+		}
+
+		page, err = db.ScanCertificates(order, nil, false, 10)
+		if err != nil {
+			t.Fatal("Error scanning certificates: ", err)
+		}
+		if len(page.Records) != expected {
+			t.Errorf("Index %d has %d entries after reindexing, expected %d",
+				order, len(page.Records), expected)
+		}
+	}
+}
+
+func TestReindexCertificatesRandomPartitioner(t *testing.T) {
+	var db, server = newTestDB(t)
+	var certs []*x509.Certificate
+	var seen = make(map[uint64]bool)
+	var recs []*x509keyserver.X509KeyData
+	var start uint64
+	var count int
+	var err error
+
+	server.SetRandomPartitioner(true)
+	certs = addHierarchy(t, db, 250)
+
+	// Page through the list the way ReindexCertificates does.
+	for {
+		var rec *x509keyserver.X509KeyData
+
+		recs, err = db.ListCertificates(start, 100)
+		if err != nil {
+			t.Fatal("Error listing certificates: ", err)
+		}
+		for _, rec = range recs {
+			seen[rec.GetIndex()] = true
+		}
+		if len(recs) < 100 {
+			break
+		}
+		start = recs[len(recs)-1].GetIndex()
+	}
+	if len(seen) != len(certs) {
+		t.Errorf("Listed %d distinct certificates, expected %d", len(seen),
+			len(certs))
+	}
+
+	count, err = db.ReindexCertificates()
+	if err != nil {
+		t.Fatal("Error reindexing certificates: ", err)
+	}
+	if count != len(certs) {
+		t.Errorf("Reindexed %d certificates, expected %d", count, len(certs))
+	}
+}
+
+func TestAddX509CertificateAgain(t *testing.T) {
+	var db, _ = newTestDB(t)
+	var certs = addHierarchy(t, db, 2)
+	var replacement *x509keyservertest.Certificate
+	var page *keydb.CertificatePage
+	var order keydb.SortOrder
+	var err error
+
+	err = db.RevokeX509Certificate(certs[1].SerialNumber.Uint64(),
+		time.Now())
+	if err != nil {
+		t.Fatal("Error revoking certificate: ", err)
+	}
+
+	// Make sure the time stamp of the added column would change.
+	time.Sleep(1100 * time.Millisecond)
+	err = db.AddX509Certificate(certs[1])
+	if err != nil {
+		t.Fatal("Error adding certificate again: ", err)
+	}
+
+	for order = range indexRows {
+		var expected int = len(certs)
+
+		if order == keydb.SortByRevocation {
+			expected = 1
+		}
+
+		page, err = db.ScanCertificates(order, nil, false, 10)
+		if err != nil {
+			t.Fatal("Error scanning certificates: ", err)
+		}
+		if len(page.Records) != expected {
+			t.Errorf("Index %d lists %v, expected %d certificates",
+				order, pageIndices(page), expected)
+		}
+	}
+
+	page, err = db.ScanCertificates(keydb.SortByRevocation, nil, false, 10)
+	if err != nil {
+		t.Fatal("Error scanning certificates: ", err)
+	}
+	if len(page.Records) != 1 || page.Records[0].GetRevoked() == 0 {
+		t.Error("Adding a certificate again lost its revocation status")
+	}
+
+	// Replace a certificate by a different one with the same index.
+	replacement, err = x509keyservertest.NewCA("Replacement CA",
+		x509keyservertest.WithSerial(certs[0].SerialNumber))
+	if err != nil {
+		t.Fatal("Error generating certificate: ", err)
+	}
+	err = db.AddX509Certificate(replacement.Cert)
+	if err != nil {
+		t.Fatal("Error replacing certificate: ", err)
+	}
+
+	page, err = db.ScanCertificates(keydb.SortBySubject, nil, false, 10)
+	if err != nil {
+		t.Fatal("Error scanning certificates: ", err)
+	}
+	if len(page.Records) != len(certs) {
+		t.Errorf("Subject index lists %v after replacing a certificate",
+			pageIndices(page))
+	}
+}
+
+// Create an empty key database of each kind.
+func newTestBackends(t *testing.T) map[string]keydb.KeyDB {
+	var db, _ = newTestDB(t)
+
+	return map[string]keydb.KeyDB{
+		"cassandra": db,
+		"memory":    keydb.NewMemoryKeyDB(),
+	}
+}
+
+// Determine the serial numbers of "certs" in ascending order.
+func sortedIndices(certs []*x509.Certificate) []uint64 {
+	var ret []uint64
+	var cert *x509.Certificate
+
+	for _, cert = range certs {
+		ret = append(ret, cert.SerialNumber.Uint64())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret
+}
+
+// Scan the whole index for "order" in pages of "count" certificates.
+func scanAll(t *testing.T, db keydb.KeyDB, order keydb.SortOrder,
+	reverse bool, count int32) ([]uint64, [][]byte) {
+	var page *keydb.CertificatePage
+	var indices []uint64
+	var cursors [][]byte
+	var start []byte
+	var err error
+
+	for {
+		page, err = db.ScanCertificates(order, start, reverse, count)
+		if err != nil {
+			t.Fatal("Error scanning certificates: ", err)
+		}
+		if int32(len(page.Records)) > count {
+			t.Fatalf("Scan returned %d records, asked for %d",
+				len(page.Records), count)
+		}
+		if len(page.Records) != len(page.Cursors) {
+			t.Fatalf("Scan returned %d records but %d cursors",
+				len(page.Records), len(page.Cursors))
+		}
+
+		indices = append(indices, pageIndices(page)...)
+		cursors = append(cursors, page.Cursors...)
+		if !page.More() {
+			return indices, cursors
+		}
+		start = page.Next
+	}
+}
+
+func TestListCertificates(t *testing.T) {
+	var name string
+	var db keydb.KeyDB
+
+	for name, db = range newTestBackends(t) {
+		var indices = sortedIndices(addHierarchy(t, db, 5))
+		var recs []*x509keyserver.X509KeyData
+		var i int
+		var err error
+
+		recs, err = db.ListCertificates(0, 100)
+		if err != nil {
+			t.Fatal("Error listing certificates: ", err)
+		}
+		if len(recs) != len(indices) {
+			t.Fatalf("%s: listed %d certificates, expected %d", name,
+				len(recs), len(indices))
+		}
+		for i = range recs {
+			if recs[i].GetIndex() != indices[i] {
+				t.Errorf("%s: certificate %d has index %d, expected %d",
+					name, i, recs[i].GetIndex(), indices[i])
+			}
+			if recs[i].GetSubject() == "" || recs[i].GetExpires() == 0 ||
+				recs[i].GetAdded() == 0 {
+				t.Errorf("%s: incomplete metadata for certificate %d: %v",
+					name, recs[i].GetIndex(), recs[i])
+			}
+		}
+
+		recs, err = db.ListCertificates(indices[3], 2)
+		if err != nil {
+			t.Fatal("Error listing certificates: ", err)
+		}
+		if len(recs) != 2 || recs[0].GetIndex() != indices[3] ||
+			recs[1].GetIndex() != indices[4] {
+			t.Errorf("%s: listing from %d returned %v", name, indices[3],
+				recs)
+		}
+	}
+}
+
+func TestScanCertificates(t *testing.T) {
+	var name string
+	var db keydb.KeyDB
+
+	for name, db = range newTestBackends(t) {
+		var certs = addHierarchy(t, db, 5)
+		var order keydb.SortOrder
+		var err error
+
+		err = db.RevokeX509Certificate(certs[3].SerialNumber.Uint64(),
+			time.Now())
+		if err == nil {
+			err = db.RevokeX509Certificate(certs[5].SerialNumber.Uint64(),
+				time.Now())
+		}
+		if err != nil {
+			t.Fatal("Error revoking certificate: ", err)
+		}
+
+		for order = range indexRows {
+			var forward, backward, paged []uint64
+			var cursors [][]byte
+			var expected int = len(certs)
+			var i int
+
+			if order == keydb.SortByRevocation {
+				expected = 2
+			}
+
+			forward, cursors = scanAll(t, db, order, false, 100)
+			if len(forward) != expected {
+				t.Errorf("%s: index %d lists %d certificates, expected %d",
+					name, order, len(forward), expected)
+			}
+			for i = 1; i < len(cursors); i++ {
+				if bytes.Compare(cursors[i-1], cursors[i]) >= 0 {
+					t.Errorf("%s: index %d is not sorted at position %d",
+						name, order, i)
+				}
+			}
+
+			paged, _ = scanAll(t, db, order, false, 2)
+			if !reflect.DeepEqual(paged, forward) {
+				t.Errorf("%s: paged scan of index %d returned %v, "+
+					"expected %v", name, order, paged, forward)
+			}
+
+			backward, _ = scanAll(t, db, order, true, 2)
+			for i = range backward {
+				if backward[i] != forward[len(forward)-1-i] {
+					t.Errorf("%s: reverse scan of index %d returned %v, "+
+						"expected the reverse of %v", name, order,
+						backward, forward)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestScanCertificatesFromCursor(t *testing.T) {
+	var name string
+	var db keydb.KeyDB
+
+	for name, db = range newTestBackends(t) {
+		var indices = sortedIndices(addHierarchy(t, db, 3))
+		var page *keydb.CertificatePage
+		var err error
+
+		page, err = db.ScanCertificates(keydb.SortByIndex,
+			keydb.IndexCursor(keydb.SortByIndex,
+				&x509keyserver.X509KeyData{Index: &indices[2]}), false, 2)
+		if err != nil {
+			t.Fatal("Error scanning certificates: ", err)
+		}
+		if !reflect.DeepEqual(pageIndices(page), indices[2:4]) {
+			t.Errorf("%s: scan from %d returned %v, expected %v", name,
+				indices[2], pageIndices(page), indices[2:4])
+		}
+		if !page.More() || !bytes.Equal(page.Next, keydb.IndexCursor(
+			keydb.SortByIndex,
+			&x509keyserver.X509KeyData{Index: &indices[4]})) {
+			t.Errorf("%s: unexpected next position %x", name, page.Next)
+		}
+
+		page, err = db.ScanCertificates(keydb.SortByIndex, nil, false, 0)
+		if err != nil {
+			t.Fatal("Error scanning certificates: ", err)
+		}
+		if len(page.Records) != 0 || page.More() {
+			t.Errorf("%s: empty scan returned %v", name, pageIndices(page))
+		}
+
+		_, err = db.ScanCertificates(keydb.SortOrder(42), nil, false, 10)
+		if err == nil {
+			t.Errorf("%s: scan with unknown sort order succeeded", name)
+		}
+	}
+}
+
+func TestRetrieveCertificateByIndex(t *testing.T) {
+	var name string
+	var db keydb.KeyDB
+
+	for name, db = range newTestBackends(t) {
+		var certs = addHierarchy(t, db, 1)
+		var cert *x509.Certificate
+		var rec *x509keyserver.X509KeyData
+		var err error
+
+		cert, err = db.RetrieveCertificateByIndex(
+			certs[1].SerialNumber.Uint64())
+		if err != nil {
+			t.Fatal("Error retrieving certificate: ", err)
+		}
+		if !cert.Equal(certs[1]) {
+			t.Errorf("%s: retrieved the wrong certificate", name)
+		}
+
+		rec, err = db.RetrieveKeyDataByIndex(certs[1].SerialNumber.Uint64())
+		if err != nil {
+			t.Fatal("Error retrieving certificate: ", err)
+		}
+		if !bytes.Equal(rec.DerCertificate, certs[1].Raw) ||
+			rec.GetSubject() != string(keydb.FormatCertSubject(
+				certs[1].Subject)) {
+			t.Errorf("%s: unexpected record %v", name, rec)
+		}
+
+		_, err = db.RetrieveKeyDataByIndex(1)
+		if err != keydb.ErrNotFound {
+			t.Errorf("%s: expected ErrNotFound for an unknown index, got %v",
+				name, err)
+		}
+		err = db.RevokeX509Certificate(1, time.Now())
+		if err != keydb.ErrNotFound {
+			t.Errorf("%s: expected ErrNotFound revoking an unknown index, "+
+				"got %v", name, err)
+		}
+	}
+}
+
+// Check that the column has the expected value and was written between
+// "before" and "after", given in microseconds since the epoch.
+func checkColumn(t *testing.T, col *cassandra.Column, value []byte,
+	before, after int64) {
+	if !bytes.Equal(col.Value, value) {
+		t.Errorf("Column %q has value %x, expected %x", col.Name, col.Value,
+			value)
+	}
+	if col.Timestamp == nil || *col.Timestamp < before ||
+		*col.Timestamp > after {
+		t.Errorf("Column %q has time stamp %v, expected a time in "+
+			"microseconds between %d and %d", col.Name, col.Timestamp,
+			before, after)
+	}
+}
+
+// Encode "value" the way the key database does: as 8 bytes, big endian.
+func bigEndian(value uint64) []byte {
+	var ret []byte = make([]byte, 8)
+
+	binary.BigEndian.PutUint64(ret, value)
+	return ret
+}
+
+func TestStorageLayout(t *testing.T) {
+	var db, server = newTestDB(t)
+	var ca *x509keyservertest.Certificate
+	var key = []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08}
+	var revoked time.Time = time.Unix(1500000000, 0)
+	var cols []*cassandra.Column
+	var indices map[string][]byte
+	var names = []string{
+		"added", "der_certificate", "expires", "issuer", "subject"}
+	var row string
+	var added []byte
+	var before, after int64
+	var i int
+	var err error
+
+	ca, err = x509keyservertest.NewCA("Layout CA",
+		x509keyservertest.WithSerial(big.NewInt(0x0102030405060708)))
+	if err != nil {
+		t.Fatal("Error generating certificate: ", err)
+	}
+
+	before = time.Now().UnixNano() / 1000
+	err = db.AddX509Certificate(ca.Cert)
+	after = time.Now().UnixNano() / 1000
+	if err != nil {
+		t.Fatal("Error adding certificate: ", err)
+	}
+
+	// The row key is the index as 8 bytes, big endian.
+	cols = server.Columns(testKeyspace, "certificate", key)
+	if len(cols) != 5 {
+		t.Fatalf("Expected 5 columns in the certificate row, got %d",
+			len(cols))
+	}
+	for i = range names {
+		if string(cols[i].Name) != names[i] {
+			t.Fatalf("Column %d is called %q, expected %q", i,
+				cols[i].Name, names[i])
+		}
+	}
+	added = cols[0].Value
+	if len(added) != 8 ||
+		int64(binary.BigEndian.Uint64(added)) < before/1000000 ||
+		int64(binary.BigEndian.Uint64(added)) > after/1000000 {
+		t.Errorf("Unexpected time of addition %x", added)
+	}
+	checkColumn(t, cols[0], added, before, after)
+	checkColumn(t, cols[1], ca.Cert.Raw, before, after)
+	checkColumn(t, cols[2], bigEndian(uint64(ca.Cert.NotAfter.Unix())),
+		before, after)
+	checkColumn(t, cols[3], []byte("/O=x509keyservertest/CN=Layout CA"),
+		before, after)
+	checkColumn(t, cols[4], []byte("/O=x509keyservertest/CN=Layout CA"),
+		before, after)
+
+	// Index column names are the sort key followed by the row key.
+	indices = map[string][]byte{
+		"index": key,
+		"subject": append([]byte("/O=x509keyservertest/CN=Layout CA\x00"),
+			key...),
+		"expires": append(bigEndian(uint64(ca.Cert.NotAfter.Unix())),
+			key...),
+		"added": append(append([]byte(nil), added...), key...),
+	}
+	for row = range indices {
+		cols = server.Columns(testKeyspace, "certificate_index", []byte(row))
+		if len(cols) != 1 || !bytes.Equal(cols[0].Name, indices[row]) {
+			t.Errorf("Unexpected columns in index row %q", row)
+			continue
+		}
+		checkColumn(t, cols[0], []byte{}, before, after)
+	}
+	if len(server.Columns(testKeyspace, "certificate_index", []byte("revoked"))) != 0 {
+		t.Error("Certificate indexed as revoked before being revoked")
+	}
+
+	before = time.Now().UnixNano() / 1000
+	err = db.RevokeX509Certificate(0x0102030405060708, revoked)
+	after = time.Now().UnixNano() / 1000
+	if err != nil {
+		t.Fatal("Error revoking certificate: ", err)
+	}
+
+	cols = server.Columns(testKeyspace, "certificate", key)
+	if len(cols) != 6 || string(cols[4].Name) != "revoked" {
+		t.Fatalf("Expected 6 columns including revoked, got %d", len(cols))
+	}
+	checkColumn(t, cols[4], bigEndian(uint64(revoked.Unix())), before, after)
+
+	cols = server.Columns(testKeyspace, "certificate_index", []byte("revoked"))
+	if len(cols) != 1 || !bytes.Equal(cols[0].Name,
+		append(bigEndian(uint64(revoked.Unix())), key...)) {
+		t.Fatal("Unexpected columns in index row \"revoked\"")
+	}
+	checkColumn(t, cols[0], []byte{}, before, after)
+}
@@ -0,0 +1,245 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package keydb
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/caoimhechaos/x509keyserver"
+	"github.com/golang/protobuf/proto"
+)
+
+// MemoryKeyDB keeps X.509 certificates in memory. It behaves like X509KeyDB
+// but doesn't persist anything, which makes it useful for tests and for
+// trying out the server.
+type MemoryKeyDB struct {
+	lock    sync.RWMutex
+	records map[uint64]*x509keyserver.X509KeyData
+}
+
+// NewMemoryKeyDB creates a new, empty in-memory key database.
+func NewMemoryKeyDB() *MemoryKeyDB {
+	return &MemoryKeyDB{
+		records: make(map[uint64]*x509keyserver.X509KeyData),
+	}
+}
+
+// copyKeyData returns a copy of "rec" which the caller may modify, with
+// the certificate itself only if "der" is set.
+func copyKeyData(rec *x509keyserver.X509KeyData, der bool) *x509keyserver.X509KeyData {
+	var ret = &x509keyserver.X509KeyData{
+		Index:   proto.Uint64(rec.GetIndex()),
+		Subject: proto.String(rec.GetSubject()),
+		Issuer:  proto.String(rec.GetIssuer()),
+		Expires: proto.Uint64(rec.GetExpires()),
+	}
+
+	if rec.Added != nil {
+		ret.Added = proto.Uint64(rec.GetAdded())
+	}
+	if rec.Revoked != nil {
+		ret.Revoked = proto.Uint64(rec.GetRevoked())
+	}
+	if der {
+		ret.DerCertificate = append([]byte(nil), rec.DerCertificate...)
+	}
+	return ret
+}
+
+// ListCertificates lists the next "count" known certificates starting from
+// "start_index".
+func (db *MemoryKeyDB) ListCertificates(start_index uint64, count int32) (
+	[]*x509keyserver.X509KeyData, error) {
+	var ret []*x509keyserver.X509KeyData
+	var indices []uint64
+	var index uint64
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	for index = range db.records {
+		if index >= start_index {
+			indices = append(indices, index)
+		}
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		return indices[i] < indices[j]
+	})
+
+	for _, index = range indices {
+		if int32(len(ret)) >= count {
+			break
+		}
+		ret = append(ret, copyKeyData(db.records[index], false))
+	}
+
+	return ret, nil
+}
+
+// ScanCertificates lists up to "count" certificates from the index for the
+// given sort order, starting at the position "start" (inclusive), with the
+// same semantics as X509KeyDB.ScanCertificates.
+func (db *MemoryKeyDB) ScanCertificates(order SortOrder, start []byte,
+	reverse bool, count int32) (*CertificatePage, error) {
+	var ret *CertificatePage = new(CertificatePage)
+	var cursors [][]byte
+	var byCursor = make(map[string]*x509keyserver.X509KeyData)
+	var rec *x509keyserver.X509KeyData
+	var cursor []byte
+	var ok bool
+
+	if _, ok = certificateIndex_Rows[order]; !ok {
+		return nil, fmt.Errorf("Unknown sort order %d", order)
+	}
+	if count <= 0 {
+		return ret, nil
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	for _, rec = range db.records {
+		if order == SortByRevocation && rec.Revoked == nil {
+			continue
+		}
+		cursor = IndexCursor(order, rec)
+		cursors = append(cursors, cursor)
+		byCursor[string(cursor)] = rec
+	}
+
+	sort.Slice(cursors, func(i, j int) bool {
+		if reverse {
+			return bytes.Compare(cursors[i], cursors[j]) > 0
+		}
+		return bytes.Compare(cursors[i], cursors[j]) < 0
+	})
+
+	for _, cursor = range cursors {
+		if len(start) > 0 && !reverse && bytes.Compare(cursor, start) < 0 {
+			continue
+		}
+		if len(start) > 0 && reverse && bytes.Compare(cursor, start) > 0 {
+			continue
+		}
+		if int32(len(ret.Cursors)) == count {
+			ret.Next = cursor
+			break
+		}
+		ret.Cursors = append(ret.Cursors, cursor)
+		ret.Records = append(ret.Records,
+			copyKeyData(byCursor[string(cursor)], false))
+	}
+
+	return ret, nil
+}
+
+// RetrieveCertificateByIndex retrieves the certificate with the given index
+// number. Returns ErrNotFound if there is no such certificate.
+func (db *MemoryKeyDB) RetrieveCertificateByIndex(index uint64) (
+	*x509.Certificate, error) {
+	var rec *x509keyserver.X509KeyData
+	var ok bool
+
+	db.lock.RLock()
+	rec, ok = db.records[index]
+	db.lock.RUnlock()
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return x509.ParseCertificate(rec.DerCertificate)
+}
+
+// RetrieveKeyDataByIndex retrieves all data stored about the certificate
+// with the given index number, including the certificate itself. Returns
+// ErrNotFound if there is no such certificate.
+func (db *MemoryKeyDB) RetrieveKeyDataByIndex(index uint64) (
+	*x509keyserver.X509KeyData, error) {
+	var rec *x509keyserver.X509KeyData
+	var ok bool
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	if rec, ok = db.records[index]; !ok {
+		return nil, ErrNotFound
+	}
+	return copyKeyData(rec, true), nil
+}
+
+// AddX509Certificate adds the given certificate to the database. Like with
+// X509KeyDB, adding a certificate again replaces it but keeps the time it
+// was first added and its revocation status.
+func (db *MemoryKeyDB) AddX509Certificate(cert *x509.Certificate) error {
+	var rec *x509keyserver.X509KeyData = keyDataFromCertificate(
+		cert, time.Now())
+	var old *x509keyserver.X509KeyData
+	var ok bool
+
+	rec.DerCertificate = append([]byte(nil), cert.Raw...)
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if old, ok = db.records[rec.GetIndex()]; ok {
+		rec.Added = old.Added
+		rec.Revoked = old.Revoked
+	}
+	db.records[rec.GetIndex()] = rec
+	return nil
+}
+
+// RevokeX509Certificate marks the certificate with the given index number
+// as revoked at the time "when". Returns ErrNotFound if there is no such
+// certificate.
+func (db *MemoryKeyDB) RevokeX509Certificate(index uint64, when time.Time) error {
+	var rec *x509keyserver.X509KeyData
+	var ok bool
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if rec, ok = db.records[index]; !ok {
+		return ErrNotFound
+	}
+
+	// Keep the original revocation time if it was revoked before.
+	if rec.Revoked == nil {
+		rec.Revoked = proto.Uint64(uint64(when.Unix()))
+	}
+	return nil
+}
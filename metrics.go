@@ -0,0 +1,288 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Names of the metrics reported by X509KeyClient to its MetricsSink.
+const (
+	MetricCacheSize     = "cache-size"
+	MetricCacheRequests = "cache-requests"
+	MetricCacheHits     = "cache-hits"
+	MetricCacheMisses   = "cache-misses"
+	MetricErrors        = "errors"
+	MetricRetries       = "retries"
+	MetricStaleResults  = "stale-results"
+	MetricRefreshes     = "refreshes"
+)
+
+// Process wide expvar variables which were published before the metrics
+// of each client could be retrieved separately. They are still updated by
+// all clients so existing monitoring keeps working, but errors are now
+// counted by their class rather than their message.
+var key_cache_size = expvar.NewInt("x509-key-cache-size")
+var key_cache_requests = expvar.NewInt("x509-key-cache-requests")
+var key_cache_hits = expvar.NewInt("x509-key-cache-hits")
+var key_cache_misses = expvar.NewInt("x509-key-cache-misses")
+var key_cache_errors = expvar.NewMap("x509-key-cache-errors")
+
+// The process wide expvar variables updated along with the client
+// counters of the same names.
+var legacyCounters = map[string]*expvar.Int{
+	MetricCacheRequests: key_cache_requests,
+	MetricCacheHits:     key_cache_hits,
+	MetricCacheMisses:   key_cache_misses,
+}
+
+// ErrorClassInvalidCertificate is the error class used for certificates
+// which were returned by the server but could not be parsed.
+const ErrorClassInvalidCertificate = "InvalidCertificate"
+
+// ErrorClassRevokedCertificate is the error class used for certificates
+// which the server reported as revoked.
+const ErrorClassRevokedCertificate = "RevokedCertificate"
+
+// ErrorClassDiskCache is the error class used for failures to store
+// certificates in the disk cache.
+const ErrorClassDiskCache = "DiskCache"
+
+// MetricsSink receives the metrics of an X509KeyClient as they change.
+// Implementations must be safe for concurrent use.
+type MetricsSink interface {
+	// IncrCounter increases the counter "name" by "delta". For counters
+	// which are broken down further, such as errors, "label" specifies
+	// the sub-counter; it is empty otherwise.
+	IncrCounter(name, label string, delta int64)
+
+	// SetGauge sets the gauge "name" to "value".
+	SetGauge(name string, value int64)
+}
+
+// ClientStats is a snapshot of the metrics of an X509KeyClient.
+type ClientStats struct {
+	// Number of certificates currently in the cache.
+	CacheSize int64
+
+	// Number of certificate requests, and how many of them were answered
+	// from the cache.
+	CacheRequests int64
+	CacheHits     int64
+	CacheMisses   int64
+
+	// Number of requests to the server which were retried after failing.
+	Retries int64
+
+	// Number of certificates returned from the cache despite being due for
+	// a refresh because the server couldn't be reached.
+	StaleResults int64
+
+	// Number of cached certificates refreshed in the background.
+	Refreshes int64
+
+	// Number of errors by class. The class is the name of the gRPC status
+	// code of the error, ErrorClassInvalidCertificate,
+	// ErrorClassRevokedCertificate or ErrorClassDiskCache.
+	Errors map[string]int64
+}
+
+// clientMetrics keeps track of the metrics of an individual client and
+// forwards all changes to the configured sink.
+type clientMetrics struct {
+	cacheSize     int64
+	cacheRequests int64
+	cacheHits     int64
+	cacheMisses   int64
+	retries       int64
+	staleResults  int64
+	refreshes     int64
+
+	lock   sync.Mutex
+	errors map[string]int64
+	sink   MetricsSink
+}
+
+func newClientMetrics() *clientMetrics {
+	return &clientMetrics{
+		errors: make(map[string]int64),
+	}
+}
+
+// getSink returns the currently configured sink, or nil.
+func (m *clientMetrics) getSink() MetricsSink {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.sink
+}
+
+// setSink replaces the sink metrics are forwarded to.
+func (m *clientMetrics) setSink(sink MetricsSink) {
+	m.lock.Lock()
+	m.sink = sink
+	m.lock.Unlock()
+}
+
+// incr increases the given counter by one and reports it to the sink
+// as "name".
+func (m *clientMetrics) incr(counter *int64, name string) {
+	var sink MetricsSink
+	var legacy *expvar.Int
+	var ok bool
+
+	atomic.AddInt64(counter, 1)
+	if legacy, ok = legacyCounters[name]; ok {
+		legacy.Add(1)
+	}
+	if sink = m.getSink(); sink != nil {
+		sink.IncrCounter(name, "", 1)
+	}
+}
+
+// setCacheSize updates the current size of the cache.
+func (m *clientMetrics) setCacheSize(size int) {
+	var sink MetricsSink
+
+	atomic.StoreInt64(&m.cacheSize, int64(size))
+	key_cache_size.Set(int64(size))
+	if sink = m.getSink(); sink != nil {
+		sink.SetGauge(MetricCacheSize, int64(size))
+	}
+}
+
+// recordError counts an error of the given class.
+func (m *clientMetrics) recordError(class string) {
+	var sink MetricsSink
+
+	m.lock.Lock()
+	m.errors[class]++
+	sink = m.sink
+	m.lock.Unlock()
+
+	key_cache_errors.Add(class, 1)
+	if sink != nil {
+		sink.IncrCounter(MetricErrors, class, 1)
+	}
+}
+
+// snapshot returns the current values of all metrics.
+func (m *clientMetrics) snapshot() *ClientStats {
+	var ret = &ClientStats{
+		CacheSize:     atomic.LoadInt64(&m.cacheSize),
+		CacheRequests: atomic.LoadInt64(&m.cacheRequests),
+		CacheHits:     atomic.LoadInt64(&m.cacheHits),
+		CacheMisses:   atomic.LoadInt64(&m.cacheMisses),
+		Retries:       atomic.LoadInt64(&m.retries),
+		StaleResults:  atomic.LoadInt64(&m.staleResults),
+		Refreshes:     atomic.LoadInt64(&m.refreshes),
+		Errors:        make(map[string]int64),
+	}
+	var class string
+	var count int64
+
+	m.lock.Lock()
+	for class, count = range m.errors {
+		ret.Errors[class] = count
+	}
+	m.lock.Unlock()
+
+	return ret
+}
+
+// errorClass determines the class an error is counted under, which is
+// the name of its gRPC status code.
+func errorClass(err error) string {
+	var s *status.Status
+	var ok bool
+
+	if s, ok = status.FromError(err); ok {
+		return s.Code().String()
+	}
+	return codes.Unknown.String()
+}
+
+// ExpvarMetricsSink publishes client metrics as an expvar map. Counters
+// with labels are published as nested maps.
+type ExpvarMetricsSink struct {
+	vars *expvar.Map
+	lock sync.Mutex
+}
+
+// NewExpvarMetricsSink creates a sink which publishes the metrics in an
+// expvar map called "name". Like all expvar variables, the name must be
+// unique within the process.
+func NewExpvarMetricsSink(name string) *ExpvarMetricsSink {
+	return &ExpvarMetricsSink{
+		vars: expvar.NewMap(name),
+	}
+}
+
+// IncrCounter increases the expvar counter "name", or the entry "label" of
+// the map "name" if a label is given.
+func (s *ExpvarMetricsSink) IncrCounter(name, label string, delta int64) {
+	var sub *expvar.Map
+	var ok bool
+
+	if label == "" {
+		s.vars.Add(name, delta)
+		return
+	}
+
+	s.lock.Lock()
+	if sub, ok = s.vars.Get(name).(*expvar.Map); !ok {
+		sub = new(expvar.Map).Init()
+		s.vars.Set(name, sub)
+	}
+	s.lock.Unlock()
+
+	sub.Add(label, delta)
+}
+
+// SetGauge sets the expvar variable "name" to "value".
+func (s *ExpvarMetricsSink) SetGauge(name string, value int64) {
+	var v *expvar.Int
+	var ok bool
+
+	s.lock.Lock()
+	if v, ok = s.vars.Get(name).(*expvar.Int); !ok {
+		v = new(expvar.Int)
+		s.vars.Set(name, v)
+	}
+	s.lock.Unlock()
+
+	v.Set(value)
+}
@@ -0,0 +1,126 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestErrorClass(t *testing.T) {
+	var tests = map[error]string{
+		status.Error(codes.NotFound, "gone"):             "NotFound",
+		status.Error(codes.Unavailable, "down"):          "Unavailable",
+		status.Error(codes.DeadlineExceeded, "too slow"): "DeadlineExceeded",
+		errors.New("Something else"):                     "Unknown",
+	}
+	var err error
+	var class string
+
+	for err, class = range tests {
+		if errorClass(err) != class {
+			t.Errorf("Error %v has class %s, expected %s", err,
+				errorClass(err), class)
+		}
+	}
+}
+
+// Used for generating unique expvar names when tests are repeated.
+var expvarSinkSequence int64
+
+func TestExpvarMetricsSink(t *testing.T) {
+	var name string = fmt.Sprintf("x509-test-expvar-sink-%d",
+		atomic.AddInt64(&expvarSinkSequence, 1))
+	var sink = NewExpvarMetricsSink(name)
+	var vars *expvar.Map
+	var errs *expvar.Map
+	var ok bool
+
+	sink.IncrCounter(MetricCacheHits, "", 2)
+	sink.IncrCounter(MetricCacheHits, "", 1)
+	sink.IncrCounter(MetricErrors, "NotFound", 1)
+	sink.IncrCounter(MetricErrors, "NotFound", 1)
+	sink.IncrCounter(MetricErrors, "Unavailable", 1)
+	sink.SetGauge(MetricCacheSize, 5)
+	sink.SetGauge(MetricCacheSize, 3)
+
+	if vars, ok = expvar.Get(name).(*expvar.Map); !ok {
+		t.Fatal("Metrics not published")
+	}
+	if vars.Get(MetricCacheHits).String() != "3" {
+		t.Errorf("Expected 3 cache hits, got %s", vars.Get(MetricCacheHits))
+	}
+	if vars.Get(MetricCacheSize).String() != "3" {
+		t.Errorf("Expected cache size 3, got %s", vars.Get(MetricCacheSize))
+	}
+	if errs, ok = vars.Get(MetricErrors).(*expvar.Map); !ok {
+		t.Fatal("Errors not published as a map")
+	}
+	if errs.Get("NotFound").String() != "2" ||
+		errs.Get("Unavailable").String() != "1" {
+		t.Errorf("Unexpected error counts: %s", errs)
+	}
+}
+
+func TestLegacyExpvarNames(t *testing.T) {
+	var m = newClientMetrics()
+	var hits, errs int64
+	var notFound *expvar.Int
+	var ok bool
+
+	hits = key_cache_hits.Value()
+	if notFound, ok = key_cache_errors.Get("NotFound").(*expvar.Int); ok {
+		errs = notFound.Value()
+	}
+
+	m.incr(&m.cacheHits, MetricCacheHits)
+	m.setCacheSize(42)
+	m.recordError(codes.NotFound.String())
+
+	if expvar.Get("x509-key-cache-hits").(*expvar.Int).Value() != hits+1 {
+		t.Error("Cache hits not counted in x509-key-cache-hits")
+	}
+	if expvar.Get("x509-key-cache-size").String() != "42" {
+		t.Errorf("x509-key-cache-size is %s, expected 42",
+			expvar.Get("x509-key-cache-size"))
+	}
+	notFound, _ = key_cache_errors.Get("NotFound").(*expvar.Int)
+	if notFound == nil || notFound.Value() != errs+1 {
+		t.Error("Error not counted in x509-key-cache-errors")
+	}
+}
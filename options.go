@@ -0,0 +1,357 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/caoimhechaos/go-urlconnection"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// Defaults for clients created with NewClient.
+const (
+	DefaultCacheSize   = 1024
+	DefaultTimeout     = 5 * time.Second
+	DefaultDialTimeout = 10 * time.Second
+
+	DefaultCachePruneInterval = time.Minute
+)
+
+// ClientOption configures an X509KeyClient created with NewClient.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	cache_size     int
+	cache_ttl      time.Duration
+	negative_ttl   time.Duration
+	prune_interval time.Duration
+	disk_dir       string
+	cache          Cache
+	stale_on_error bool
+	timeout        time.Duration
+	dial_timeout   time.Duration
+	creds          credentials.TransportCredentials
+	retry_policy   *RetryPolicy
+	interceptors   []grpc.UnaryClientInterceptor
+	dialer         func(context.Context, string) (net.Conn, error)
+	metrics_sink   MetricsSink
+	dial_options   []grpc.DialOption
+
+	preload          []uint64
+	preload_recent   int32
+	refresh_interval time.Duration
+}
+
+// WithCacheSize sets the maximum number of certificates kept in the cache.
+// A size of 0 disables the cache, a negative size makes it unbounded.
+func WithCacheSize(size int) ClientOption {
+	return func(o *clientOptions) {
+		o.cache_size = size
+	}
+}
+
+// WithCache replaces the in-memory cache of the client by "cache". Use
+// NoCache to disable caching altogether. The cache size set with
+// WithCacheSize only applies to the default cache and the disk cache.
+func WithCache(cache Cache) ClientOption {
+	return func(o *clientOptions) {
+		o.cache = cache
+	}
+}
+
+// WithCacheTTL sets the time after which cached certificates are fetched
+// from the server again, e.g. to notice revocations. By default, they are
+// kept until the certificate expires or is evicted to make space.
+func WithCacheTTL(ttl time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.cache_ttl = ttl
+	}
+}
+
+// WithNegativeCacheTTL makes the client remember for "ttl" that the server
+// doesn't know a certificate, rather than asking again on every request.
+// Negative caching is disabled by default.
+func WithNegativeCacheTTL(ttl time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.negative_ttl = ttl
+	}
+}
+
+// WithCachePruneInterval sets how often expired entries are removed from
+// the cache. An interval of 0 disables pruning in the background; expired
+// entries are still never returned.
+func WithCachePruneInterval(interval time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.prune_interval = interval
+	}
+}
+
+// WithDiskCache additionally keeps retrieved certificates in the directory
+// "dir", so they can be used again after the client is restarted. The disk
+// cache is subject to the same size limit and TTL as the in-memory cache,
+// and files are checked for corruption when they are loaded.
+func WithDiskCache(dir string) ClientOption {
+	return func(o *clientOptions) {
+		o.disk_dir = dir
+	}
+}
+
+// WithStaleOnError makes the client return cached certificates which are
+// due to be refreshed if the server can't be reached, rather than failing.
+// This only makes a difference together with WithCacheTTL or
+// WithDiskCache. Certificates are never used past their expiry time.
+func WithStaleOnError() ClientOption {
+	return func(o *clientOptions) {
+		o.stale_on_error = true
+	}
+}
+
+// WithRequestTimeout sets the default timeout for requests to the server.
+// It can be overridden for individual calls using WithCallTimeout.
+func WithRequestTimeout(timeout time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithDialTimeout sets the maximum time to spend on establishing a
+// connection to the server.
+func WithDialTimeout(timeout time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.dial_timeout = timeout
+	}
+}
+
+// WithTransportCredentials sets the credentials used for securing the
+// connection to the server. Connections are unencrypted by default.
+func WithTransportCredentials(creds credentials.TransportCredentials) ClientOption {
+	return func(o *clientOptions) {
+		o.creds = creds
+	}
+}
+
+// WithTLSConfig makes the client connect to the server using TLS with the
+// given configuration.
+func WithTLSConfig(config *tls.Config) ClientOption {
+	return WithTransportCredentials(credentials.NewTLS(config))
+}
+
+// WithRetryPolicy makes the client retry failed requests to the server
+// according to "policy". By default, requests are not retried.
+func WithRetryPolicy(policy RetryPolicy) ClientOption {
+	return func(o *clientOptions) {
+		o.retry_policy = &policy
+	}
+}
+
+// WithUnaryInterceptors adds interceptors to all RPCs made by the client.
+// They are called in the order given.
+func WithUnaryInterceptors(
+	interceptors ...grpc.UnaryClientInterceptor) ClientOption {
+	return func(o *clientOptions) {
+		o.interceptors = append(o.interceptors, interceptors...)
+	}
+}
+
+// WithContextDialer replaces the function used to connect to the server.
+// By default, the address is resolved using go-urlconnection.
+func WithContextDialer(
+	dialer func(context.Context, string) (net.Conn, error)) ClientOption {
+	return func(o *clientOptions) {
+		o.dialer = dialer
+	}
+}
+
+// WithMetricsSink reports the metrics of the client to "sink", like
+// SetMetricsSink.
+func WithMetricsSink(sink MetricsSink) ClientOption {
+	return func(o *clientOptions) {
+		o.metrics_sink = sink
+	}
+}
+
+// WithDialOptions passes additional options to grpc.Dial. They are applied
+// after the ones derived from the other client options.
+func WithDialOptions(opts ...grpc.DialOption) ClientOption {
+	return func(o *clientOptions) {
+		o.dial_options = append(o.dial_options, opts...)
+	}
+}
+
+// WithPreload makes the client retrieve the certificates with the given
+// indices into the cache in the background as soon as it is created. Use
+// WaitForPreload to find out when this is done and whether it succeeded.
+func WithPreload(indices ...uint64) ClientOption {
+	return func(o *clientOptions) {
+		o.preload = append(o.preload, indices...)
+	}
+}
+
+// WithPreloadRecent makes the client retrieve the "count" most recently
+// added certificates into the cache in the background as soon as it is
+// created. This happens even if preloading the certificates passed to
+// WithPreload fails.
+func WithPreloadRecent(count int32) ClientOption {
+	return func(o *clientOptions) {
+		o.preload_recent = count
+	}
+}
+
+// WithBackgroundRefresh makes the client check every "interval" which of
+// the certificates requested since the last check are due to be refreshed
+// before the next one, or were evicted from the cache in the meantime, and
+// fetch them from the server in the background. The others are marked as
+// recently used again. Frequently used certificates thus don't go stale or
+// drop out of the cache.
+func WithBackgroundRefresh(interval time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.refresh_interval = interval
+	}
+}
+
+// urlconnectionDialer connects to "addr" using go-urlconnection, giving up
+// after "timeout" or once "ctx" expires, whichever is earlier.
+func urlconnectionDialer(timeout time.Duration) func(
+	context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, addr string) (net.Conn, error) {
+		var limit time.Duration = timeout
+		var deadline time.Time
+		var ok bool
+
+		if deadline, ok = ctx.Deadline(); ok && time.Until(deadline) < limit {
+			limit = time.Until(deadline)
+		}
+		return urlconnection.ConnectTimeout(addr, limit)
+	}
+}
+
+// The gRPC service config of the client, which balances requests across
+// all addresses the server name resolves to.
+const serviceConfig = `{"loadBalancingConfig": [{"round_robin": {}}]}`
+
+// CallOption changes the behaviour of an individual call to X509KeyClient.
+type CallOption func(*callOptions)
+
+type callOptions struct {
+	bypass_cache bool
+	timeout      time.Duration
+	info         *ResultInfo
+}
+
+// ResultInfo describes where the result of a call came from.
+type ResultInfo struct {
+	// Whether the certificate was taken from the cache, or the disk cache,
+	// rather than the server.
+	Cached bool
+
+	// Whether the certificate was due to be refreshed, but was returned
+	// from the cache anyway because the server couldn't be reached. Err
+	// is the error which occurred when asking the server.
+	Stale bool
+	Err   error
+}
+
+// BypassCache makes the client ask the server for the certificate even if
+// it is already cached. The cache is updated with the answer.
+func BypassCache() CallOption {
+	return func(o *callOptions) {
+		o.bypass_cache = true
+	}
+}
+
+// WithCallTimeout overrides the timeout configured for the client for this
+// call. A timeout of 0 means the call is only limited by its context.
+func WithCallTimeout(timeout time.Duration) CallOption {
+	return func(o *callOptions) {
+		o.timeout = timeout
+	}
+}
+
+// WithResultInfo makes the client describe in "info" where the result of
+// the call came from.
+func WithResultInfo(info *ResultInfo) CallOption {
+	return func(o *callOptions) {
+		o.info = info
+	}
+}
+
+// Record in the result info, if requested, that the result came from the
+// cache.
+func (o *callOptions) setCached() {
+	if o.info != nil {
+		o.info.Cached = true
+	}
+}
+
+// callOptions applies "opts" on top of the defaults of the client.
+func (cl *X509KeyClient) callOptions(opts []CallOption) *callOptions {
+	var ret = &callOptions{
+		timeout: cl.timeout,
+	}
+	var opt CallOption
+
+	for _, opt = range opts {
+		opt(ret)
+	}
+	return ret
+}
+
+// isUnavailableError determines whether "err" indicates that the server
+// couldn't be reached in time, as opposed to an error in the request.
+func isUnavailableError(err error) bool {
+	var code codes.Code
+
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	code = status.Code(err)
+	return code == codes.Unavailable || code == codes.DeadlineExceeded
+}
+
+// isContextError determines whether "err" was caused by the context of the
+// call being cancelled or running out of time.
+func isContextError(err error) bool {
+	var code codes.Code
+
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return true
+	}
+	code = status.Code(err)
+	return code == codes.Canceled || code == codes.DeadlineExceeded
+}
@@ -0,0 +1,240 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrNoPeerCertificate is returned by PeerVerifier if the peer didn't
+// present a certificate.
+var ErrNoPeerCertificate = errors.New("Peer did not present a certificate")
+
+// ErrUnknownCertificate is returned by PeerVerifier for certificates which
+// the key server doesn't know.
+var ErrUnknownCertificate = errors.New("Certificate is not known to the key server")
+
+// DefaultDecisionTTL is the time for which PeerVerifier remembers whether
+// a certificate was accepted, unless configured otherwise.
+const DefaultDecisionTTL = time.Minute
+
+// PeerVerifier checks the certificates presented by TLS peers against the
+// key server, so that only certificates which the server knows and which
+// haven't been revoked are accepted. The certificate is looked up by its
+// serial number and must match the one stored on the server exactly.
+//
+// Decisions are remembered for a while, so that peers reconnecting
+// frequently don't cause a request to the server every time. Apart from
+// that, every certificate is looked up on the server, bypassing the cache
+// of the client, so revocations take effect once the decision expires.
+// Failures to reach the server are never remembered, and certificates are
+// rejected if the server can't be reached, even if the client was created
+// with WithStaleOnError.
+type PeerVerifier struct {
+	client   *X509KeyClient
+	ttl      time.Duration
+	max_size int
+
+	lock      sync.Mutex
+	decisions map[[sha256.Size]byte]*peerDecision
+}
+
+// The outcome of verifying a certificate.
+type peerDecision struct {
+	err     error
+	expires time.Time
+}
+
+// NewPeerVerifier creates a verifier which looks up certificates using
+// "client" and remembers the outcome for "ttl". Up to "max_size" decisions
+// are kept; a negative size means there is no limit.
+func NewPeerVerifier(client *X509KeyClient, ttl time.Duration,
+	max_size int) *PeerVerifier {
+	return &PeerVerifier{
+		client:    client,
+		ttl:       ttl,
+		max_size:  max_size,
+		decisions: make(map[[sha256.Size]byte]*peerDecision),
+	}
+}
+
+// VerifyPeerCertificate can be used as the VerifyPeerCertificate callback
+// of a tls.Config. Only the leaf certificate is looked up; the chain is
+// verified by crypto/tls as usual unless InsecureSkipVerify is set.
+func (v *PeerVerifier) VerifyPeerCertificate(raw_certs [][]byte,
+	verified_chains [][]*x509.Certificate) error {
+	var cert *x509.Certificate
+	var err error
+
+	if len(raw_certs) == 0 {
+		return ErrNoPeerCertificate
+	}
+
+	cert, err = x509.ParseCertificate(raw_certs[0])
+	if err != nil {
+		return err
+	}
+
+	return v.VerifyCertificate(context.Background(), cert)
+}
+
+// VerifyConnection can be used as the VerifyConnection callback of a
+// tls.Config. It is also called for resumed sessions, unlike
+// VerifyPeerCertificate.
+func (v *PeerVerifier) VerifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return ErrNoPeerCertificate
+	}
+
+	return v.VerifyCertificate(context.Background(), state.PeerCertificates[0])
+}
+
+// VerifyCertificate determines whether "cert" is known to the key server
+// and hasn't been revoked. It returns nil if the certificate is acceptable.
+func (v *PeerVerifier) VerifyCertificate(ctx context.Context,
+	cert *x509.Certificate) error {
+	var fingerprint [sha256.Size]byte = sha256.Sum256(cert.Raw)
+	var decision *peerDecision
+	var known *x509.Certificate
+	var info ResultInfo
+	var err error
+
+	if decision = v.lookup(fingerprint); decision != nil {
+		return decision.err
+	}
+
+	// Certificates are stored with their serial number as the index.
+	known, err = v.client.RetrieveCertificateByIndexContext(
+		ctx, cert.SerialNumber.Uint64(), BypassCache(),
+		WithResultInfo(&info))
+	if info.Stale {
+		// The certificate might have been revoked in the meantime.
+		return info.Err
+	}
+	switch {
+	case err == nil && !bytes.Equal(known.Raw, cert.Raw):
+		err = ErrUnknownCertificate
+	case status.Code(err) == codes.NotFound:
+		err = ErrUnknownCertificate
+	case err != nil && err != ErrCertificateRevoked:
+		// Don't remember that the server couldn't be reached.
+		return err
+	}
+
+	v.remember(fingerprint, cert, err)
+	return err
+}
+
+// Find the decision about the certificate with the given fingerprint, if
+// it is still valid.
+func (v *PeerVerifier) lookup(fingerprint [sha256.Size]byte) *peerDecision {
+	var decision *peerDecision
+	var ok bool
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if decision, ok = v.decisions[fingerprint]; !ok {
+		return nil
+	}
+	if time.Now().After(decision.expires) {
+		delete(v.decisions, fingerprint)
+		return nil
+	}
+	return decision
+}
+
+// Remember the decision about "cert", but not beyond its expiry time.
+func (v *PeerVerifier) remember(fingerprint [sha256.Size]byte,
+	cert *x509.Certificate, err error) {
+	var now time.Time = time.Now()
+	var decision = &peerDecision{
+		err:     err,
+		expires: now.Add(v.ttl),
+	}
+	var key [sha256.Size]byte
+
+	if v.ttl <= 0 || v.max_size == 0 {
+		return
+	}
+	if decision.expires.After(cert.NotAfter) {
+		decision.expires = cert.NotAfter
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.max_size > 0 && len(v.decisions) >= v.max_size {
+		for key = range v.decisions {
+			if now.After(v.decisions[key].expires) {
+				delete(v.decisions, key)
+			}
+		}
+	}
+	// Make space by forgetting an arbitrary decision.
+	for key = range v.decisions {
+		if v.max_size < 0 || len(v.decisions) < v.max_size {
+			break
+		}
+		delete(v.decisions, key)
+	}
+
+	v.decisions[fingerprint] = decision
+}
+
+// ConfigureTLS makes "config" verify all peer certificates against the key
+// server, in addition to any verification it already performs.
+func (v *PeerVerifier) ConfigureTLS(config *tls.Config) {
+	var previous func(tls.ConnectionState) error = config.VerifyConnection
+
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		var err error
+
+		if previous != nil {
+			err = previous(state)
+			if err != nil {
+				return err
+			}
+		}
+		return v.VerifyConnection(state)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caoimhechaos/x509keyserver"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPeerVerifierRejectsRevokedCertificates(t *testing.T) {
+	var server, ca = newTestServer(t)
+	var client *x509keyserver.X509KeyClient
+	var verifier *x509keyserver.PeerVerifier
+	var err error
+
+	defer server.Close()
+
+	client, err = server.NewClient()
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	// Don't remember any decisions, so only the client cache could hide
+	// the revocation.
+	verifier = x509keyserver.NewPeerVerifier(client, 0, 0)
+
+	err = verifier.VerifyCertificate(context.Background(), ca.Cert)
+	if err != nil {
+		t.Fatal("Error verifying certificate: ", err)
+	}
+
+	err = server.Revoke(ca.Cert.SerialNumber.Uint64())
+	if err != nil {
+		t.Fatal("Error revoking certificate: ", err)
+	}
+
+	err = verifier.VerifyCertificate(context.Background(), ca.Cert)
+	if err != x509keyserver.ErrCertificateRevoked {
+		t.Errorf("Expected revoked certificate to be rejected, got %v", err)
+	}
+}
+
+func TestPeerVerifierRejectsStaleResults(t *testing.T) {
+	var server, ca = newTestServer(t)
+	var client *x509keyserver.X509KeyClient
+	var verifier *x509keyserver.PeerVerifier
+	var err error
+
+	defer server.Close()
+
+	client, err = server.NewClient(x509keyserver.WithStaleOnError())
+	if err != nil {
+		t.Fatal("Error creating client: ", err)
+	}
+	defer client.Close()
+
+	verifier = x509keyserver.NewPeerVerifier(client, 0, 0)
+
+	err = verifier.VerifyCertificate(context.Background(), ca.Cert)
+	if err != nil {
+		t.Fatal("Error verifying certificate: ", err)
+	}
+
+	server.SetError("", status.Error(codes.Unavailable, "Down for testing"))
+
+	err = verifier.VerifyCertificate(context.Background(), ca.Cert)
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected verification to fail while the server is "+
+			"unavailable, got %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Preload retrieves the certificates with the given indices into the
+// cache, so later requests for them don't have to wait for the server.
+// Certificates which are unknown or revoked are skipped; other errors are
+// reported after all indices have been tried.
+func (cl *X509KeyClient) Preload(ctx context.Context, indices []uint64) error {
+	var first error
+	var index uint64
+	var err error
+
+	for _, index = range indices {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		_, err = cl.RetrieveCertificateByIndexContext(ctx, index)
+		if err != nil && first == nil &&
+			status.Code(err) != codes.NotFound && err != ErrCertificateRevoked {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// PreloadRecent retrieves the "count" most recently added certificates
+// which haven't been revoked into the cache.
+func (cl *X509KeyClient) PreloadRecent(ctx context.Context, count int32) error {
+	var list *X509KeyDataList
+	var indices []uint64
+	var rec *X509KeyData
+	var err error
+
+	list, err = cl.listCertificates(ctx, &X509KeyDataListRequest{
+		StartIndex:  proto.Uint64(0),
+		Count:       proto.Int32(count),
+		NewestFirst: proto.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, rec = range list.GetRecords() {
+		if rec.GetRevoked() == 0 {
+			indices = append(indices, rec.GetIndex())
+		}
+	}
+
+	return cl.Preload(ctx, indices)
+}
+
+// Ask the server for a list of certificates, subject to the client timeout
+// and retry policy.
+func (cl *X509KeyClient) listCertificates(ctx context.Context,
+	req *X509KeyDataListRequest) (*X509KeyDataList, error) {
+	var cancel context.CancelFunc
+	var list *X509KeyDataList
+	var err error
+
+	if cl.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cl.timeout)
+		defer cancel()
+	}
+
+	err = cl.withRetries(ctx, func(ctx context.Context) error {
+		list, err = cl.client.ListCertificates(ctx, req)
+		return err
+	})
+	if err != nil {
+		cl.metrics.recordError(errorClass(err))
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// Remember that the certificate with the given index was requested, so
+// it will be refreshed in the background before it goes stale.
+func (cl *X509KeyClient) markHot(index uint64) {
+	if cl.refresh_interval <= 0 {
+		return
+	}
+
+	cl.hot_lock.Lock()
+	cl.hot[index] = struct{}{}
+	cl.hot_lock.Unlock()
+}
+
+// Create a context which is cancelled once the client is closed.
+func (cl *X509KeyClient) stopContext() (context.Context, context.CancelFunc) {
+	var ctx, cancel = context.WithCancel(context.Background())
+
+	go func() {
+		select {
+		case <-cl.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// PreloadError is returned by WaitForPreload if preloading certificates in
+// the background failed. Each field is the first error encountered by the
+// respective option, or nil if it succeeded or wasn't used.
+type PreloadError struct {
+	// Error preloading the certificates passed to WithPreload.
+	Indices error
+
+	// Error preloading the certificates selected by WithPreloadRecent.
+	Recent error
+}
+
+func (e *PreloadError) Error() string {
+	if e.Indices != nil && e.Recent != nil {
+		return fmt.Sprintf("Error preloading certificates: %s; "+
+			"error preloading recent certificates: %s", e.Indices, e.Recent)
+	} else if e.Indices != nil {
+		return "Error preloading certificates: " + e.Indices.Error()
+	}
+	return "Error preloading recent certificates: " + e.Recent.Error()
+}
+
+// WaitForPreload waits until the certificates requested with WithPreload
+// and WithPreloadRecent have been retrieved, or "ctx" is done. Returns a
+// *PreloadError if some of them couldn't be retrieved.
+func (cl *X509KeyClient) WaitForPreload(ctx context.Context) error {
+	if cl.preload_done == nil {
+		return nil
+	}
+
+	select {
+	case <-cl.preload_done:
+		return cl.preload_err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Preload the configured certificates in the background. Both kinds of
+// preloading are attempted even if the other one fails.
+func (cl *X509KeyClient) preloadInBackground(indices []uint64,
+	recent int32) {
+	var ctx, cancel = cl.stopContext()
+	var perr PreloadError
+
+	defer cl.background.Done()
+	defer cancel()
+
+	if len(indices) > 0 {
+		perr.Indices = cl.Preload(ctx, indices)
+	}
+	if recent > 0 {
+		perr.Recent = cl.PreloadRecent(ctx, recent)
+	}
+
+	if perr.Indices != nil || perr.Recent != nil {
+		cl.preload_err = &perr
+	}
+	close(cl.preload_done)
+}
+
+// Regularly refresh the certificates which were requested since the last
+// run and would be due for a refresh before the next one, until the client
+// is closed. Entries without a TTL never need to be refreshed. Looking the
+// hot entries up moves them to the front of the LRU cache, so they are not
+// the next ones to be evicted; those which were evicted since they were
+// last requested are fetched again.
+func (cl *X509KeyClient) refreshHotEntries() {
+	var ticker = time.NewTicker(cl.refresh_interval)
+	var ctx, cancel = cl.stopContext()
+	var hot map[uint64]struct{}
+	var entry *CacheEntry
+	var index uint64
+	var ok bool
+
+	defer cl.background.Done()
+	defer cancel()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cl.stop:
+			return
+		case <-ticker.C:
+		}
+
+		cl.hot_lock.Lock()
+		hot = cl.hot
+		cl.hot = make(map[uint64]struct{})
+		cl.hot_lock.Unlock()
+
+		for index = range hot {
+			entry, ok = cl.key_cache.Get(index)
+			if ok && (entry.Cert == nil || entry.Refresh.IsZero() ||
+				entry.Refresh.After(time.Now().Add(cl.refresh_interval))) {
+				continue
+			}
+
+			cl.refreshEntry(ctx, index)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+// Refresh the cached certificate with the given index in the background,
+// subject to the client timeout.
+func (cl *X509KeyClient) refreshEntry(ctx context.Context, index uint64) {
+	var cancel context.CancelFunc
+
+	if cl.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, cl.timeout)
+		defer cancel()
+	}
+
+	cl.metrics.incr(&cl.metrics.refreshes, MetricRefreshes)
+	cl.fetchAndStore(ctx, index)
+}
+
+// Fetch the certificate with the given index from the server and update
+// the caches with the result.
+func (cl *X509KeyClient) fetchAndStore(ctx context.Context, index uint64) (
+	*x509.Certificate, error) {
+	var cert *x509.Certificate
+	var err error
+
+	cert, err = cl.fetchCertificate(ctx, index)
+	cl.persistResult(index, cert, err)
+	cl.storeResult(index, cert, err)
+	return cert, err
+}
@@ -0,0 +1,157 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Defaults for the fields of RetryPolicy which are left unset.
+const (
+	DefaultInitialBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff        = 5 * time.Second
+	DefaultBackoffMultiplier = 2.0
+)
+
+// RetryPolicy describes how requests to the server which failed with one
+// of the retryable status codes are retried by X509KeyClient.
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first one.
+	MaxAttempts int
+
+	// The backoff before the n-th retry is randomly chosen between 0 and
+	// min(InitialBackoff * BackoffMultiplier^(n-1), MaxBackoff).
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	BackoffMultiplier float64
+
+	// Status codes for which requests are retried. Defaults to
+	// Unavailable, ResourceExhausted and Aborted. NotFound and
+	// InvalidArgument are never retried since the answer won't change.
+	RetryableCodes []codes.Code
+}
+
+// Determine whether a request which failed with "err" should be retried.
+func (p *RetryPolicy) retryable(err error) bool {
+	var retryable = p.RetryableCodes
+	var code codes.Code = status.Code(err)
+	var c codes.Code
+
+	if code == codes.NotFound || code == codes.InvalidArgument {
+		return false
+	}
+
+	if len(retryable) == 0 {
+		retryable = []codes.Code{
+			codes.Unavailable, codes.ResourceExhausted, codes.Aborted,
+		}
+	}
+
+	for _, c = range retryable {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Determine the time to wait before the given retry, starting at 1.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	var initial, max time.Duration = p.InitialBackoff, p.MaxBackoff
+	var multiplier float64 = p.BackoffMultiplier
+	var limit float64
+	var i int
+
+	if initial <= 0 {
+		initial = DefaultInitialBackoff
+	}
+	if max <= 0 {
+		max = DefaultMaxBackoff
+	}
+	if multiplier < 1 {
+		multiplier = DefaultBackoffMultiplier
+	}
+
+	limit = float64(initial)
+	for i = 1; i < retry && limit < float64(max); i++ {
+		limit *= multiplier
+	}
+	if limit > float64(max) {
+		limit = float64(max)
+	}
+
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
+
+// Call "f" until it succeeds, fails with an error which shouldn't be
+// retried, or the retry policy of the client is exhausted. Retries which
+// can't happen before the deadline of "ctx" aren't attempted.
+func (cl *X509KeyClient) withRetries(ctx context.Context,
+	f func(context.Context) error) error {
+	var policy *RetryPolicy = cl.retry_policy
+	var deadline time.Time
+	var has_deadline bool
+	var timer *time.Timer
+	var wait time.Duration
+	var attempt int
+	var err error
+
+	deadline, has_deadline = ctx.Deadline()
+
+	for attempt = 1; ; attempt++ {
+		err = f(ctx)
+		if err == nil || policy == nil || attempt >= policy.MaxAttempts ||
+			!policy.retryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		wait = policy.backoff(attempt)
+		if has_deadline && time.Now().Add(wait).After(deadline) {
+			return err
+		}
+
+		cl.metrics.incr(&cl.metrics.retries, MetricRetries)
+
+		timer = time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Create a client which only supports withRetries.
+func newRetryTestClient(policy *RetryPolicy) *X509KeyClient {
+	return &X509KeyClient{
+		retry_policy: policy,
+		metrics:      newClientMetrics(),
+	}
+}
+
+// A function for withRetries which fails with "code" the first "failures"
+// times it is called, recording when it was called.
+type flakyCall struct {
+	code     codes.Code
+	failures int
+	calls    []time.Time
+}
+
+func (f *flakyCall) call(ctx context.Context) error {
+	f.calls = append(f.calls, time.Now())
+	if len(f.calls) <= f.failures {
+		return status.Error(f.code, "flaky")
+	}
+	return nil
+}
+
+func TestRetryBackoffLimits(t *testing.T) {
+	var policy = &RetryPolicy{
+		InitialBackoff:    10 * time.Millisecond,
+		MaxBackoff:        50 * time.Millisecond,
+		BackoffMultiplier: 2,
+	}
+	var limits = map[int]time.Duration{
+		1: 10 * time.Millisecond,
+		2: 20 * time.Millisecond,
+		3: 40 * time.Millisecond,
+		4: 50 * time.Millisecond,
+		9: 50 * time.Millisecond,
+	}
+	var limit, wait, longest time.Duration
+	var retry, i int
+
+	for retry, limit = range limits {
+		longest = 0
+		for i = 0; i < 1000; i++ {
+			wait = policy.backoff(retry)
+			if wait < 0 || wait > limit {
+				t.Fatalf("Backoff %s before retry %d exceeds %s", wait,
+					retry, limit)
+			}
+			if wait > longest {
+				longest = wait
+			}
+		}
+		// The backoff is random, but should use most of the range.
+		if longest < limit/2 {
+			t.Errorf("Longest backoff before retry %d was %s, limit %s",
+				retry, longest, limit)
+		}
+	}
+}
+
+func TestWithRetriesStopsAtAttemptLimit(t *testing.T) {
+	var cl = newRetryTestClient(&RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     20 * time.Millisecond,
+	})
+	var f = &flakyCall{code: codes.Unavailable, failures: 10}
+	var err error
+
+	err = cl.withRetries(context.Background(), f.call)
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected the last error, got %v", err)
+	}
+	if len(f.calls) != 3 {
+		t.Errorf("Made %d attempts, expected 3", len(f.calls))
+	}
+	if cl.Stats().Retries != 2 {
+		t.Errorf("Counted %d retries, expected 2", cl.Stats().Retries)
+	}
+}
+
+func TestWithRetriesWaitsBetweenAttempts(t *testing.T) {
+	var cl = newRetryTestClient(&RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 30 * time.Millisecond,
+		MaxBackoff:     30 * time.Millisecond,
+	})
+	var f = &flakyCall{code: codes.ResourceExhausted, failures: 4}
+	var total time.Duration
+	var err error
+
+	err = cl.withRetries(context.Background(), f.call)
+	if err != nil {
+		t.Fatal("Request failed despite succeeding eventually: ", err)
+	}
+	if len(f.calls) != 5 {
+		t.Fatalf("Made %d attempts, expected 5", len(f.calls))
+	}
+
+	// Each backoff is random between 0 and 30ms, so four of them are
+	// all but certain to add up to more than a few milliseconds.
+	total = f.calls[4].Sub(f.calls[0])
+	if total < 5*time.Millisecond || total > 4*30*time.Millisecond+
+		100*time.Millisecond {
+		t.Errorf("Retries took %s, expected up to %s", total,
+			4*30*time.Millisecond)
+	}
+}
+
+func TestWithRetriesStopsAtDeadline(t *testing.T) {
+	var cl = newRetryTestClient(&RetryPolicy{
+		MaxAttempts:    100,
+		InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff:     20 * time.Millisecond,
+	})
+	var f = &flakyCall{code: codes.Unavailable, failures: 1000}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var start time.Time = time.Now()
+	var err error
+
+	ctx, cancel = context.WithTimeout(context.Background(),
+		100*time.Millisecond)
+	defer cancel()
+
+	err = cl.withRetries(ctx, f.call)
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected the last error, got %v", err)
+	}
+	if time.Since(start) > 150*time.Millisecond {
+		t.Errorf("Retries continued for %s past the deadline",
+			time.Since(start)-100*time.Millisecond)
+	}
+	if len(f.calls) < 2 || len(f.calls) == 100 {
+		t.Errorf("Made %d attempts before the deadline", len(f.calls))
+	}
+	if f.calls[len(f.calls)-1].After(start.Add(100 * time.Millisecond)) {
+		t.Error("Attempt made after the deadline")
+	}
+}
+
+func TestWithRetriesSkipsPermanentErrors(t *testing.T) {
+	var cl = newRetryTestClient(&RetryPolicy{
+		MaxAttempts: 5,
+		RetryableCodes: []codes.Code{
+			codes.NotFound, codes.InvalidArgument, codes.Unavailable,
+		},
+	})
+	var code codes.Code
+	var err error
+
+	for _, code = range []codes.Code{codes.NotFound, codes.InvalidArgument,
+		codes.Internal} {
+		var f = &flakyCall{code: code, failures: 1}
+
+		err = cl.withRetries(context.Background(), f.call)
+		if status.Code(err) != code {
+			t.Errorf("Expected %s, got %v", code, err)
+		}
+		if len(f.calls) != 1 {
+			t.Errorf("%s was retried %d times", code, len(f.calls)-1)
+		}
+	}
+	if cl.Stats().Retries != 0 {
+		t.Errorf("Counted %d retries, expected none", cl.Stats().Retries)
+	}
+}
@@ -29,50 +29,64 @@
  * OF THE POSSIBILITY OF SUCH DAMAGE.
  */
 
-package main
+// Package rpcserver implements the X.509 key server RPC interface on top
+// of a key database, so it can be embedded into other programs.
+package rpcserver
 
 import (
 	"context"
-	"crypto/x509"
 
 	"github.com/caoimhechaos/x509keyserver"
 	"github.com/caoimhechaos/x509keyserver/keydb"
-	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // X509KeyServer implements the X.509 key server RPC interface.
 type X509KeyServer struct {
-	Db *keydb.X509KeyDB
+	Db keydb.KeyDB
+}
+
+// NewX509KeyServer creates a new RPC server answering requests from the
+// key database "db".
+func NewX509KeyServer(db keydb.KeyDB) *X509KeyServer {
+	return &X509KeyServer{
+		Db: db,
+	}
 }
 
 // ListCertificates lists the next number of known certificates starting from
-// the specified start index.
+// the specified start index, or the most recently added ones if requested.
 func (s *X509KeyServer) ListCertificates(
 	c context.Context, req *x509keyserver.X509KeyDataListRequest) (
 	res *x509keyserver.X509KeyDataList, err error) {
+	var page *keydb.CertificatePage
+
 	res = new(x509keyserver.X509KeyDataList)
+	if req.GetNewestFirst() {
+		page, err = s.Db.ScanCertificates(
+			keydb.SortByAdded, nil, true, req.GetCount())
+		if err != nil {
+			return nil, err
+		}
+		res.Records = page.Records
+		return
+	}
+
 	res.Records, err = s.Db.ListCertificates(req.GetStartIndex(), req.GetCount())
 	return
 }
 
 // RetrieveCertificateByIndex retrieves the certificate with the given index
-// number assigned by the issuer from the database.
+// number assigned by the issuer from the database, along with its metadata
+// such as the revocation status. Unknown certificates are reported with the
+// NotFound status code, so clients can tell them apart from other errors.
 func (s *X509KeyServer) RetrieveCertificateByIndex(
 	c context.Context, req *x509keyserver.X509KeyDataRequest) (
 	ret *x509keyserver.X509KeyData, err error) {
-	var cert *x509.Certificate
-
-	ret = new(x509keyserver.X509KeyData)
-	cert, err = s.Db.RetrieveCertificateByIndex(req.GetIndex())
-	if err != nil {
-		return
+	ret, err = s.Db.RetrieveKeyDataByIndex(req.GetIndex())
+	if err == keydb.ErrNotFound {
+		return nil, status.Error(codes.NotFound, err.Error())
 	}
-
-	ret.DerCertificate = cert.Raw
-	ret.Expires = proto.Uint64(uint64(cert.NotAfter.Unix()))
-	ret.Index = proto.Uint64(req.GetIndex())
-	ret.Issuer = proto.String(string(keydb.FormatCertSubject(cert.Issuer)))
-	ret.Subject = proto.String(string(keydb.FormatCertSubject(cert.Subject)))
-
 	return
 }
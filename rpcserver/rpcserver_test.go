@@ -0,0 +1,152 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package rpcserver_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/caoimhechaos/x509keyserver"
+	"github.com/caoimhechaos/x509keyserver/keydb"
+	"github.com/caoimhechaos/x509keyserver/rpcserver"
+	"github.com/caoimhechaos/x509keyserver/x509keyservertest"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Create a server backed by an in-memory database holding a CA hierarchy
+// with the given number of leaves.
+func newTestServer(t *testing.T, leaves int) (*rpcserver.X509KeyServer,
+	[]*x509.Certificate) {
+	var db *keydb.MemoryKeyDB
+	var h *x509keyservertest.Hierarchy
+	var err error
+
+	db, h, err = x509keyservertest.NewHierarchyDB(leaves)
+	if err != nil {
+		t.Fatal("Error setting up database: ", err)
+	}
+	return rpcserver.NewX509KeyServer(db), h.Certificates()
+}
+
+func TestRetrieveCertificateByIndex(t *testing.T) {
+	var server, certs = newTestServer(t, 2)
+	var rec *x509keyserver.X509KeyData
+	var err error
+
+	rec, err = server.RetrieveCertificateByIndex(context.Background(),
+		&x509keyserver.X509KeyDataRequest{
+			Index: proto.Uint64(certs[2].SerialNumber.Uint64()),
+		})
+	if err != nil {
+		t.Fatal("Error retrieving certificate: ", err)
+	}
+	if rec.GetIndex() != certs[2].SerialNumber.Uint64() ||
+		!bytes.Equal(rec.DerCertificate, certs[2].Raw) {
+		t.Errorf("Retrieved the wrong certificate: %v", rec)
+	}
+	if rec.GetRevoked() != 0 {
+		t.Error("Certificate unexpectedly reported as revoked")
+	}
+
+	err = server.Db.RevokeX509Certificate(certs[2].SerialNumber.Uint64(),
+		time.Now())
+	if err != nil {
+		t.Fatal("Error revoking certificate: ", err)
+	}
+
+	rec, err = server.RetrieveCertificateByIndex(context.Background(),
+		&x509keyserver.X509KeyDataRequest{
+			Index: proto.Uint64(certs[2].SerialNumber.Uint64()),
+		})
+	if err != nil {
+		t.Fatal("Error retrieving certificate: ", err)
+	}
+	if rec.GetRevoked() == 0 {
+		t.Error("Revocation not reported")
+	}
+}
+
+func TestRetrieveUnknownCertificate(t *testing.T) {
+	var server, _ = newTestServer(t, 1)
+	var err error
+
+	_, err = server.RetrieveCertificateByIndex(context.Background(),
+		&x509keyserver.X509KeyDataRequest{Index: proto.Uint64(1)})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for an unknown certificate, got %v", err)
+	}
+}
+
+func TestListCertificates(t *testing.T) {
+	var server, certs = newTestServer(t, 3)
+	var list *x509keyserver.X509KeyDataList
+	var rec *x509keyserver.X509KeyData
+	var last uint64
+	var err error
+
+	list, err = server.ListCertificates(context.Background(),
+		&x509keyserver.X509KeyDataListRequest{
+			StartIndex: proto.Uint64(0),
+			Count:      proto.Int32(100),
+		})
+	if err != nil {
+		t.Fatal("Error listing certificates: ", err)
+	}
+	if len(list.GetRecords()) != len(certs) {
+		t.Errorf("Listed %d certificates, expected %d",
+			len(list.GetRecords()), len(certs))
+	}
+	for _, rec = range list.GetRecords() {
+		if rec.GetIndex() <= last {
+			t.Error("Certificates not listed in index order")
+		}
+		last = rec.GetIndex()
+	}
+
+	list, err = server.ListCertificates(context.Background(),
+		&x509keyserver.X509KeyDataListRequest{
+			Count:       proto.Int32(2),
+			NewestFirst: proto.Bool(true),
+		})
+	if err != nil {
+		t.Fatal("Error listing certificates: ", err)
+	}
+	if len(list.GetRecords()) != 2 {
+		t.Errorf("Listed %d of the newest certificates, expected 2",
+			len(list.GetRecords()))
+	}
+}
@@ -32,7 +32,6 @@
 package main
 
 import (
-	"expvar"
 	"flag"
 	"log"
 	"strconv"
@@ -44,6 +43,7 @@ import (
 
 func main() {
 	var kc *x509keyserver.X509KeyClient
+	var stats *x509keyserver.ClientStats
 	var fetch_interval, cache_prune_interval, timeout time.Duration
 	var server, fetch_ids, id string
 	var fetch_idlist []string
@@ -69,24 +69,26 @@ func main() {
 	if err != nil {
 		log.Fatal("Unable to connect to ", server, ": ", err)
 	}
+	defer kc.Close()
 
 	fetch_idlist = strings.Split(fetch_ids, ",")
 	for _, id = range fetch_idlist {
 		var index uint64
-		var sz string
+		var sz int64
 		index, err = strconv.ParseUint(id, 10, 64)
 		if err != nil {
 			log.Print("Unable to parse ", id, " as a number, skipping.")
 			continue
 		}
-		sz = expvar.Get("x509-key-cache-size").String()
+		sz = kc.Stats().CacheSize
 		_, err = kc.RetrieveCertificateByIndex(index)
 		if err != nil {
 			log.Print("Error retrieving certificate ", index, ": ", err)
 		}
-		log.Print("Cache size: ", sz, " -> ", expvar.Get("x509-key-cache-size").String())
-		log.Print("Cache stats: hits: ", expvar.Get("x509-key-cache-hits").String(),
-			", misses: ", expvar.Get("x509-key-cache-misses"))
+		stats = kc.Stats()
+		log.Print("Cache size: ", sz, " -> ", stats.CacheSize)
+		log.Print("Cache stats: hits: ", stats.CacheHits,
+			", misses: ", stats.CacheMisses, ", errors: ", stats.Errors)
 
 		if fetch_interval > 0 {
 			time.Sleep(fetch_interval)
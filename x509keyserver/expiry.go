@@ -0,0 +1,338 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caoimhechaos/x509keyserver"
+	"github.com/caoimhechaos/x509keyserver/keydb"
+)
+
+// Number of certificates to fetch from the database at once when
+// assembling the dashboard.
+const expiryScanBatchSize int32 = 100
+
+// Number of certificates listed per group unless configured otherwise.
+const defaultExpiryMaxRows = 50
+
+// ExpiryDashboard is an HTTP service which displays all known certificates
+// grouped by how soon they are going to expire.
+type ExpiryDashboard struct {
+	Db   keydb.KeyDB
+	Tmpl *template.Template
+
+	// Warning thresholds, in ascending order. Certificates expiring within
+	// the first threshold are highlighted most prominently.
+	Thresholds []time.Duration
+
+	// Maximum number of certificates listed in each group; the others are
+	// only counted. 0 means defaultExpiryMaxRows.
+	MaxRows int
+
+	// Time for which the dashboard is reused for subsequent requests
+	// rather than reading all certificates again.
+	CacheFor time.Duration
+
+	lock    sync.Mutex
+	cached  *expiryTemplateData
+	pending *pendingDashboard
+}
+
+// A collection of the dashboard contents which is in progress. Requests
+// arriving in the meantime wait for "done" to be closed and share the
+// result.
+type pendingDashboard struct {
+	done chan struct{}
+	data *expiryTemplateData
+	err  error
+}
+
+// Number of certificates in a group which were issued by a specific issuer.
+type issuerCount struct {
+	Issuer string
+	Count  int
+}
+
+// Group of certificates which share the same expiry status.
+type expiryGroup struct {
+	Name    string
+	Class   string
+	Count   int
+	Certs   []*httpExpandedKey
+	Omitted int
+	Issuers []*issuerCount
+
+	// End of the time range covered by this group. Zero for the last
+	// group, which is open ended.
+	until time.Time
+	// Number of certificates per issuer.
+	issuers map[string]int
+}
+
+type expiryTemplateData struct {
+	Groups    []*expiryGroup
+	Total     int
+	Generated time.Time
+}
+
+// parseThresholds parses a comma separated list of durations into a
+// sorted list of expiry thresholds.
+func parseThresholds(spec string) ([]time.Duration, error) {
+	var ret []time.Duration
+	var part string
+
+	for _, part = range strings.Split(spec, ",") {
+		var threshold time.Duration
+		var err error
+
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		threshold, err = time.ParseDuration(part)
+		if err != nil {
+			return nil, err
+		}
+		if threshold <= 0 {
+			return nil, fmt.Errorf("Threshold must be positive: %s", part)
+		}
+		ret = append(ret, threshold)
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i] < ret[j] })
+	return ret, nil
+}
+
+// formatThreshold formats a threshold duration for display, using days
+// where that makes sense.
+func formatThreshold(threshold time.Duration) string {
+	var day time.Duration = 24 * time.Hour
+
+	if threshold%day == 0 {
+		if threshold == day {
+			return "1 day"
+		}
+		return fmt.Sprintf("%d days", threshold/day)
+	}
+	return threshold.String()
+}
+
+// Set up the list of groups certificates will be sorted into.
+func (ed *ExpiryDashboard) makeGroups(now time.Time) []*expiryGroup {
+	var groups []*expiryGroup
+	var threshold time.Duration
+	var i int
+
+	groups = append(groups, &expiryGroup{
+		Name:    "Expired",
+		Class:   "expired",
+		until:   now,
+		issuers: make(map[string]int),
+	})
+
+	for i, threshold = range ed.Thresholds {
+		var class string = "warning"
+
+		if i == 0 {
+			class = "critical"
+		}
+
+		groups = append(groups, &expiryGroup{
+			Name:    "Expiring within " + formatThreshold(threshold),
+			Class:   class,
+			until:   now.Add(threshold),
+			issuers: make(map[string]int),
+		})
+	}
+
+	groups = append(groups, &expiryGroup{
+		Name:    "Healthy",
+		Class:   "healthy",
+		issuers: make(map[string]int),
+	})
+
+	return groups
+}
+
+// Add the certificate "key" to the group, listing it only if there is
+// still space.
+func (g *expiryGroup) add(key *x509keyserver.X509KeyData, max_rows int) {
+	g.Count++
+	g.issuers[key.GetIssuer()]++
+	if len(g.Certs) < max_rows {
+		g.Certs = append(g.Certs, expandKey(key))
+	} else {
+		g.Omitted++
+	}
+}
+
+// Display all known certificates grouped by their expiry status.
+func (ed *ExpiryDashboard) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var data *expiryTemplateData
+	var err error
+
+	data, err = ed.dashboard()
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	ed.Tmpl.Execute(rw, data)
+}
+
+// Get the contents of the dashboard, reusing the previous ones if they
+// are recent enough. The lock is only held to look at and update the
+// cached contents; concurrent requests share a single database scan.
+func (ed *ExpiryDashboard) dashboard() (*expiryTemplateData, error) {
+	var pending *pendingDashboard
+	var data *expiryTemplateData
+
+	ed.lock.Lock()
+	if ed.cached != nil &&
+		time.Since(ed.cached.Generated) < ed.CacheFor {
+		data = ed.cached
+		ed.lock.Unlock()
+		return data, nil
+	}
+	if ed.pending != nil {
+		pending = ed.pending
+		ed.lock.Unlock()
+		<-pending.done
+		return pending.data, pending.err
+	}
+	pending = &pendingDashboard{done: make(chan struct{})}
+	ed.pending = pending
+	ed.lock.Unlock()
+
+	pending.data, pending.err = ed.collect(time.Now())
+
+	ed.lock.Lock()
+	if pending.err == nil {
+		ed.cached = pending.data
+	}
+	ed.pending = nil
+	ed.lock.Unlock()
+	close(pending.done)
+
+	return pending.data, pending.err
+}
+
+// Sort all known certificates into groups by their expiry status as of
+// "now". Revoked certificates are kept in a separate group.
+func (ed *ExpiryDashboard) collect(now time.Time) (*expiryTemplateData, error) {
+	var data = &expiryTemplateData{
+		Generated: now,
+	}
+	var revoked = &expiryGroup{
+		Name:    "Revoked",
+		Class:   "revoked",
+		issuers: make(map[string]int),
+	}
+	var max_rows int = ed.MaxRows
+	var page *keydb.CertificatePage
+	var group *expiryGroup
+	var start []byte
+	var current int
+	var err error
+
+	if max_rows <= 0 {
+		max_rows = defaultExpiryMaxRows
+	}
+
+	data.Groups = ed.makeGroups(data.Generated)
+
+	// The expiry index is sorted, so we can walk through the groups as we
+	// go through the certificates.
+	for {
+		var key *x509keyserver.X509KeyData
+
+		page, err = ed.Db.ScanCertificates(
+			keydb.SortByExpiry, start, false, expiryScanBatchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key = range page.Records {
+			var expires time.Time = time.Unix(int64(key.GetExpires()), 0)
+
+			data.Total++
+			if key.GetRevoked() != 0 {
+				revoked.add(key, max_rows)
+				continue
+			}
+
+			for !data.Groups[current].until.IsZero() &&
+				!expires.Before(data.Groups[current].until) {
+				current++
+			}
+
+			data.Groups[current].add(key, max_rows)
+		}
+
+		if !page.More() {
+			break
+		}
+		start = page.Next
+	}
+
+	data.Groups = append(data.Groups, revoked)
+
+	for _, group = range data.Groups {
+		var issuer string
+		var count int
+
+		for issuer, count = range group.issuers {
+			group.Issuers = append(group.Issuers, &issuerCount{
+				Issuer: issuer,
+				Count:  count,
+			})
+		}
+
+		sort.Slice(group.Issuers, func(i, j int) bool {
+			if group.Issuers[i].Count != group.Issuers[j].Count {
+				return group.Issuers[i].Count > group.Issuers[j].Count
+			}
+			return group.Issuers[i].Issuer < group.Issuers[j].Issuer
+		})
+	}
+
+	return data, nil
+}
@@ -0,0 +1,211 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caoimhechaos/x509keyserver/keydb"
+	"github.com/caoimhechaos/x509keyserver/x509keyservertest"
+)
+
+// Find the group with the given name on the dashboard.
+func findExpiryGroup(data *expiryTemplateData, name string) *expiryGroup {
+	var group *expiryGroup
+
+	for _, group = range data.Groups {
+		if group.Name == name {
+			return group
+		}
+	}
+	return nil
+}
+
+func TestExpiryDashboard(t *testing.T) {
+	var db, h = newTestDB(t, 3)
+	var ed = &ExpiryDashboard{
+		Db:         db,
+		Tmpl:       parseTemplate(t, "expiry.html"),
+		Thresholds: []time.Duration{time.Hour},
+		MaxRows:    2,
+	}
+	var expired, soon *x509keyservertest.Certificate
+	var data *expiryTemplateData
+	var soonName string = "Expiring within " + formatThreshold(time.Hour)
+	var res *http.Response
+	var body string
+	var err error
+
+	expired, err = h.Intermediate.Issue("expired.example.com",
+		x509keyservertest.Expired())
+	if err == nil {
+		soon, err = h.Intermediate.Issue("soon.example.com",
+			x509keyservertest.WithValidity(time.Now().Add(-time.Hour),
+				time.Now().Add(30*time.Minute)))
+	}
+	if err != nil {
+		t.Fatal("Error generating certificates: ", err)
+	}
+	err = db.AddX509Certificate(expired.Cert)
+	if err == nil {
+		err = db.AddX509Certificate(soon.Cert)
+	}
+	if err == nil {
+		err = db.RevokeX509Certificate(h.Leaves[0].Cert.SerialNumber.Uint64(),
+			time.Now())
+	}
+	if err != nil {
+		t.Fatal("Error adding certificates: ", err)
+	}
+
+	data, err = ed.collect(time.Now())
+	if err != nil {
+		t.Fatal("Error collecting certificates: ", err)
+	}
+	if data.Total != 7 {
+		t.Errorf("Dashboard covers %d certificates, expected 7", data.Total)
+	}
+	if findExpiryGroup(data, "Expired").Count != 1 {
+		t.Errorf("Expected 1 expired certificate, got %d",
+			findExpiryGroup(data, "Expired").Count)
+	}
+	if findExpiryGroup(data, soonName).Count != 1 {
+		t.Errorf("Expected 1 certificate expiring soon, got %d",
+			findExpiryGroup(data, soonName).Count)
+	}
+	if findExpiryGroup(data, "Revoked").Count != 1 {
+		t.Errorf("Expected 1 revoked certificate, got %d",
+			findExpiryGroup(data, "Revoked").Count)
+	}
+
+	// The root, the intermediate and two leaves are healthy, but only
+	// two of them are listed.
+	if findExpiryGroup(data, "Healthy").Count != 4 ||
+		len(findExpiryGroup(data, "Healthy").Certs) != 2 ||
+		findExpiryGroup(data, "Healthy").Omitted != 2 {
+		t.Errorf("Unexpected healthy group: %d certificates, %d listed, "+
+			"%d omitted", findExpiryGroup(data, "Healthy").Count,
+			len(findExpiryGroup(data, "Healthy").Certs),
+			findExpiryGroup(data, "Healthy").Omitted)
+	}
+
+	res, body = serve(ed, httptest.NewRequest("GET", "/expiry", nil))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", res.StatusCode, body)
+	}
+	if !strings.Contains(body, "2 more not shown") {
+		t.Error("Omitted certificates not mentioned")
+	}
+	if !strings.Contains(body, "expired.example.com") {
+		t.Error("Expired certificate not listed")
+	}
+}
+
+// A database whose scans wait until "release" is closed.
+type blockingScanDB struct {
+	keydb.KeyDB
+	started chan struct{}
+	release chan struct{}
+
+	lock  sync.Mutex
+	scans int
+}
+
+func (db *blockingScanDB) ScanCertificates(order keydb.SortOrder,
+	start []byte, reverse bool, count int32) (*keydb.CertificatePage, error) {
+	db.lock.Lock()
+	db.scans++
+	if db.scans == 1 {
+		close(db.started)
+	}
+	db.lock.Unlock()
+
+	<-db.release
+	return db.KeyDB.ScanCertificates(order, start, reverse, count)
+}
+
+func TestExpiryDashboardSharesScans(t *testing.T) {
+	var db, _ = newTestDB(t, 3)
+	var blocking = &blockingScanDB{
+		KeyDB:   db,
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	var ed = &ExpiryDashboard{
+		Db:         blocking,
+		Tmpl:       parseTemplate(t, "expiry.html"),
+		Thresholds: []time.Duration{time.Hour},
+		CacheFor:   time.Hour,
+	}
+	var results = make([]*expiryTemplateData, 4)
+	var wg sync.WaitGroup
+	var i int
+
+	for i = range results {
+		wg.Add(1)
+		go func(i int) {
+			var err error
+
+			defer wg.Done()
+			results[i], err = ed.dashboard()
+			if err != nil {
+				t.Error("Error generating dashboard: ", err)
+			}
+		}(i)
+	}
+
+	// The lock must not be held while the database is being read.
+	<-blocking.started
+	ed.lock.Lock()
+	ed.lock.Unlock()
+
+	close(blocking.release)
+	wg.Wait()
+
+	for i = range results {
+		if results[i] == nil || results[i] != results[0] {
+			t.Errorf("Request %d got different dashboard contents", i)
+		}
+	}
+	if blocking.scans != 1 {
+		t.Errorf("Database was scanned %d times, expected 1", blocking.scans)
+	}
+	if results[0] != nil && results[0].Total != 5 {
+		t.Errorf("Dashboard covers %d certificates, expected 5",
+			results[0].Total)
+	}
+}
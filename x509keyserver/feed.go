@@ -0,0 +1,357 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caoimhechaos/x509keyserver"
+	"github.com/caoimhechaos/x509keyserver/keydb"
+)
+
+// Number of entries in the feed unless configured otherwise.
+const defaultFeedEntries = 50
+
+// Maximum number of index entries to examine per event type when looking
+// for entries matching the filters, so that rare filters can't cause a
+// scan of the whole database.
+const maxFeedScan = 2000
+
+// Maximum number of certificates to retrieve per request for matching the
+// "q" parameter against subject alternative names. Once it is used up,
+// only the subjects of the remaining certificates are searched.
+const maxFeedFetches = 100
+
+// Number of index entries to fetch from the database at once.
+const feedScanBatchSize int32 = 100
+
+// FeedService serves an Atom feed of recently added and revoked
+// certificates. The feed can be filtered by issuer using the "issuer"
+// parameter and by subject or subject alternative name using the "q"
+// parameter; both match case insensitive substrings. Subject alternative
+// names are only searched for up to maxFeedFetches certificates per request;
+// if matches may have been missed because of that, the feed says so in its
+// subtitle.
+type FeedService struct {
+	Db keydb.KeyDB
+
+	// Maximum number of entries to include in the feed.
+	MaxEntries int
+}
+
+// A certificate being added or revoked.
+type feedEvent struct {
+	Record  *x509keyserver.X509KeyData
+	Cert    *x509.Certificate
+	Revoked bool
+	When    time.Time
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Link    []atomLink `xml:"link"`
+	Content atomText   `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName  xml.Name     `xml:"http://www.w3.org/2005/Atom feed"`
+	Title    string       `xml:"title"`
+	ID       string       `xml:"id"`
+	Updated  string       `xml:"updated"`
+	Author   atomPerson   `xml:"author"`
+	Subtitle *atomText    `xml:"subtitle,omitempty"`
+	Link     []atomLink   `xml:"link"`
+	Entries  []*atomEntry `xml:"entry"`
+}
+
+// Filter criteria for the feed.
+type feedFilter struct {
+	issuer string
+	query  string
+
+	// Number of certificates retrieved for matching so far, and whether
+	// some certificates couldn't be matched because there were too many.
+	fetches   int
+	truncated bool
+}
+
+// matches determines whether the certificate matches the filter. The
+// certificate itself is only retrieved if the metadata doesn't suffice.
+func (f *feedFilter) matches(db keydb.KeyDB, ev *feedEvent) (bool, error) {
+	var names []string
+	var name string
+	var i int
+	var err error
+
+	if f.issuer != "" &&
+		!strings.Contains(strings.ToLower(ev.Record.GetIssuer()), f.issuer) {
+		return false, nil
+	}
+
+	if f.query == "" ||
+		strings.Contains(strings.ToLower(ev.Record.GetSubject()), f.query) {
+		return true, nil
+	}
+
+	if f.fetches >= maxFeedFetches {
+		f.truncated = true
+		return false, nil
+	}
+	f.fetches++
+
+	ev.Cert, err = db.RetrieveCertificateByIndex(ev.Record.GetIndex())
+	if err != nil {
+		return false, err
+	}
+
+	names = append(names, ev.Cert.DNSNames...)
+	names = append(names, ev.Cert.EmailAddresses...)
+	for i = range ev.Cert.IPAddresses {
+		names = append(names, ev.Cert.IPAddresses[i].String())
+	}
+	for i = range ev.Cert.URIs {
+		names = append(names, ev.Cert.URIs[i].String())
+	}
+
+	for _, name = range names {
+		if strings.Contains(strings.ToLower(name), f.query) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// collectEvents finds the most recent certificates in the given index
+// which match the filter.
+func (fs *FeedService) collectEvents(order keydb.SortOrder, filter *feedFilter) (
+	[]*feedEvent, error) {
+	var ret []*feedEvent
+	var page *keydb.CertificatePage
+	var start []byte
+	var scanned int
+	var err error
+
+	for len(ret) < fs.MaxEntries && scanned < maxFeedScan {
+		var rec *x509keyserver.X509KeyData
+
+		page, err = fs.Db.ScanCertificates(order, start, true, feedScanBatchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, rec = range page.Records {
+			var ev = &feedEvent{
+				Record:  rec,
+				Revoked: order == keydb.SortByRevocation,
+				When:    time.Unix(int64(rec.GetAdded()), 0),
+			}
+			var ok bool
+
+			if ev.Revoked {
+				ev.When = time.Unix(int64(rec.GetRevoked()), 0)
+			}
+
+			ok, err = filter.matches(fs.Db, ev)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				ret = append(ret, ev)
+			}
+			if len(ret) >= fs.MaxEntries {
+				break
+			}
+		}
+
+		scanned += len(page.Records)
+		if !page.More() {
+			break
+		}
+		start = page.Next
+	}
+
+	return ret, nil
+}
+
+// describeEvent generates the text of the feed entry for the event.
+func describeEvent(ev *feedEvent) string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "Index:   %d\n", ev.Record.GetIndex())
+	fmt.Fprintf(&buf, "Subject: %s\n", ev.Record.GetSubject())
+	fmt.Fprintf(&buf, "Issuer:  %s\n", ev.Record.GetIssuer())
+	fmt.Fprintf(&buf, "Expires: %s\n",
+		time.Unix(int64(ev.Record.GetExpires()), 0).UTC())
+	if ev.Revoked {
+		fmt.Fprintf(&buf, "Revoked: %s\n", ev.When.UTC())
+	}
+	if ev.Cert != nil && len(ev.Cert.DNSNames) > 0 {
+		fmt.Fprintf(&buf, "Names:   %s\n", strings.Join(ev.Cert.DNSNames, ", "))
+	}
+
+	return buf.String()
+}
+
+// Serve an Atom feed of the most recent certificate additions and
+// revocations.
+func (fs *FeedService) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var filter = &feedFilter{
+		issuer: strings.ToLower(req.FormValue("issuer")),
+		query:  strings.ToLower(req.FormValue("q")),
+	}
+	var base string = "http://" + req.Host
+	var feed *atomFeed
+	var events, revoked []*feedEvent
+	var ev *feedEvent
+	var self url.URL
+	var out []byte
+	var err error
+
+	if req.TLS != nil {
+		base = "https://" + req.Host
+	}
+
+	events, err = fs.collectEvents(keydb.SortByAdded, filter)
+	if err == nil {
+		revoked, err = fs.collectEvents(keydb.SortByRevocation, filter)
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	events = append(events, revoked...)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].When.After(events[j].When)
+	})
+	if len(events) > fs.MaxEntries {
+		events = events[:fs.MaxEntries]
+	}
+
+	self = *req.URL
+	self.Scheme = ""
+	self.Host = ""
+
+	feed = &atomFeed{
+		Title:   "Recently added and revoked X.509 certificates",
+		ID:      base + "/feed.atom",
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  atomPerson{Name: "x509keyserver"},
+		Link: []atomLink{
+			{Href: base + self.String(), Rel: "self",
+				Type: "application/atom+xml"},
+			{Href: base + "/", Rel: "alternate", Type: "text/html"},
+		},
+	}
+	if len(events) > 0 {
+		feed.Updated = events[0].When.UTC().Format(time.RFC3339)
+	}
+	if filter.truncated {
+		feed.Subtitle = &atomText{
+			Type: "text",
+			Body: fmt.Sprintf("Incomplete: subject alternative names were "+
+				"only searched in %d certificates, further matches "+
+				"may be missing", maxFeedFetches),
+		}
+	}
+
+	for _, ev = range events {
+		var kind, title string = "added", "Added: "
+
+		if ev.Revoked {
+			kind, title = "revoked", "Revoked: "
+		}
+
+		// Fetch the certificate for the names, unless the filter did.
+		if ev.Cert == nil {
+			ev.Cert, err = fs.Db.RetrieveCertificateByIndex(
+				ev.Record.GetIndex())
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				rw.Write([]byte(err.Error()))
+				return
+			}
+		}
+
+		feed.Entries = append(feed.Entries, &atomEntry{
+			Title: title + ev.Record.GetSubject(),
+			ID: fmt.Sprintf("%s/?display=%d#%s", base,
+				ev.Record.GetIndex(), kind),
+			Updated: ev.When.UTC().Format(time.RFC3339),
+			Link: []atomLink{{
+				Href: fmt.Sprintf("%s/?display=%d&format=txt", base,
+					ev.Record.GetIndex()),
+				Rel: "alternate",
+			}},
+			Content: atomText{Type: "text", Body: describeEvent(ev)},
+		})
+	}
+
+	out, err = xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte(xml.Header))
+	rw.Write(out)
+}
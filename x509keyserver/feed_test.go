@@ -0,0 +1,148 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fetch and decode the feed for the given request path.
+func fetchFeed(t *testing.T, fs *FeedService, path string) *atomFeed {
+	var feed = new(atomFeed)
+	var res *http.Response
+	var body string
+	var err error
+
+	res, body = serve(fs, httptest.NewRequest("GET", path, nil))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", res.StatusCode, body)
+	}
+	err = xml.Unmarshal([]byte(body), feed)
+	if err != nil {
+		t.Fatal("Error decoding feed: ", err)
+	}
+	return feed
+}
+
+func TestFeed(t *testing.T) {
+	var db, h = newTestDB(t, 3)
+	var fs = &FeedService{
+		Db:         db,
+		MaxEntries: 10,
+	}
+	var feed *atomFeed
+	var revoked int
+	var entry *atomEntry
+	var err error
+
+	err = db.RevokeX509Certificate(h.Leaves[1].Cert.SerialNumber.Uint64(),
+		time.Now())
+	if err != nil {
+		t.Fatal("Error revoking certificate: ", err)
+	}
+
+	feed = fetchFeed(t, fs, "/feed.atom")
+	if len(feed.Entries) != len(h.Certificates())+1 {
+		t.Errorf("Feed has %d entries, expected %d", len(feed.Entries),
+			len(h.Certificates())+1)
+	}
+	for _, entry = range feed.Entries {
+		if strings.HasPrefix(entry.Title, "Revoked: ") {
+			revoked++
+			if !strings.Contains(entry.Title, "leaf1.example.com") {
+				t.Error("Wrong certificate reported as revoked: ",
+					entry.Title)
+			}
+		}
+	}
+	if revoked != 1 {
+		t.Errorf("Feed reports %d revocations, expected 1", revoked)
+	}
+
+	// Leaf names are also in the subject alternative names.
+	feed = fetchFeed(t, fs, "/feed.atom?q=LEAF2")
+	if len(feed.Entries) != 1 ||
+		!strings.Contains(feed.Entries[0].Title, "leaf2.example.com") {
+		t.Errorf("Filtering by name returned %d entries", len(feed.Entries))
+	}
+
+	// Only the root and the intermediate are issued by the root.
+	feed = fetchFeed(t, fs, "/feed.atom?issuer=Test+Root+CA")
+	if len(feed.Entries) != 2 {
+		t.Errorf("Filtering by issuer returned %d entries, expected 2",
+			len(feed.Entries))
+	}
+	for _, entry = range feed.Entries {
+		if strings.Contains(entry.Title, "leaf") {
+			t.Error("Filtering by issuer returned ", entry.Title)
+		}
+	}
+
+	fs.MaxEntries = 2
+	feed = fetchFeed(t, fs, "/feed.atom")
+	if len(feed.Entries) != 2 {
+		t.Errorf("Feed has %d entries, expected at most 2",
+			len(feed.Entries))
+	}
+}
+
+func TestFeedMarksIncompleteSearch(t *testing.T) {
+	var db, _ = newTestDB(t, maxFeedFetches+10)
+	var fs = &FeedService{
+		Db:         db,
+		MaxEntries: 10,
+	}
+	var feed *atomFeed
+
+	// None of the certificates match, so more of them would have to be
+	// retrieved than permitted.
+	feed = fetchFeed(t, fs, "/feed.atom?q=nowhere.example.org")
+	if len(feed.Entries) != 0 {
+		t.Errorf("Feed has %d entries, expected none", len(feed.Entries))
+	}
+	if feed.Subtitle == nil ||
+		!strings.Contains(feed.Subtitle.Body, "Incomplete") {
+		t.Error("Feed doesn't say that the search was incomplete")
+	}
+
+	fs.Db, _ = newTestDB(t, 3)
+	feed = fetchFeed(t, fs, "/feed.atom?q=nowhere.example.org")
+	if feed.Subtitle != nil {
+		t.Error("Complete search marked as incomplete: ",
+			feed.Subtitle.Body)
+	}
+}
@@ -0,0 +1,540 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/caoimhechaos/x509keyserver"
+	"github.com/caoimhechaos/x509keyserver/keydb"
+	"github.com/golang/protobuf/proto"
+)
+
+// Maximum number of issuers we will follow when assembling a certificate
+// chain. This protects against loops in badly cross-signed hierarchies.
+const maxChainLength = 8
+
+// certFormat describes one of the formats a certificate can be downloaded in.
+type certFormat struct {
+	// Name of the format as used in the "format" request parameter.
+	Name string
+
+	// MIME type to report in the Content-Type header.
+	ContentType string
+
+	// File name extension to use in the Content-Disposition header.
+	Extension string
+
+	// Whether the response should be sent as an attachment rather than
+	// displayed inline.
+	Attachment bool
+
+	// Function to encode the certificate chain into the output. The first
+	// certificate is always the one which was requested.
+	Encode func(w io.Writer, chain []*x509.Certificate) error
+}
+
+// List of all supported download formats. The first one is the default
+// if the client expresses no preference.
+var certFormats = []*certFormat{
+	{
+		Name:        "der",
+		ContentType: "application/pkix-cert",
+		Extension:   "der",
+		Attachment:  true,
+		Encode:      encodeDER,
+	},
+	{
+		Name:        "pem",
+		ContentType: "application/x-pem-file",
+		Extension:   "pem",
+		Attachment:  true,
+		Encode:      encodePEM,
+	},
+	{
+		Name:        "p7c",
+		ContentType: "application/pkcs7-mime; smime-type=certs-only",
+		Extension:   "p7c",
+		Attachment:  true,
+		Encode:      encodePKCS7,
+	},
+	{
+		Name:        "txt",
+		ContentType: "text/plain; charset=utf-8",
+		Extension:   "txt",
+		Attachment:  false,
+		Encode:      encodeText,
+	},
+}
+
+// Object identifiers for the PKCS#7 content types we generate.
+var (
+	oidPKCS7Data       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+)
+
+// Outer PKCS#7 ContentInfo wrapper.
+type pkcs7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+// Encapsulated content info of the SignedData, which is always empty for
+// certificate-only messages.
+type pkcs7EmptyContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+}
+
+// Degenerate PKCS#7 SignedData structure which carries nothing but
+// certificates.
+type pkcs7SignedData struct {
+	Version          int
+	DigestAlgorithms asn1.RawValue
+	ContentInfo      pkcs7EmptyContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      asn1.RawValue
+}
+
+// findCertFormat looks up the format with the given name.
+func findCertFormat(name string) *certFormat {
+	var format *certFormat
+
+	for _, format = range certFormats {
+		if format.Name == name {
+			return format
+		}
+	}
+	return nil
+}
+
+// negotiateCertFormat determines the most appropriate format for the
+// given value of the Accept header. If the client didn't specify any
+// preference, the default format is returned. If none of the acceptable
+// formats are supported, nil is returned.
+func negotiateCertFormat(accept string) *certFormat {
+	type acceptEntry struct {
+		mimeType string
+		q        float64
+	}
+	var entries []acceptEntry
+	var entry acceptEntry
+	var part string
+
+	if strings.TrimSpace(accept) == "" {
+		return certFormats[0]
+	}
+
+	for _, part = range strings.Split(accept, ",") {
+		var params []string = strings.Split(part, ";")
+		var param string
+
+		entry = acceptEntry{
+			mimeType: strings.ToLower(strings.TrimSpace(params[0])),
+			q:        1.0,
+		}
+
+		for _, param = range params[1:] {
+			var q float64
+			var err error
+
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			q, err = strconv.ParseFloat(param[2:], 64)
+			if err == nil {
+				entry.q = q
+			}
+		}
+
+		if entry.q > 0 {
+			entries = append(entries, entry)
+		}
+	}
+
+	// Stable, so that the client's order decides between equal weights.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].q > entries[j].q
+	})
+
+	for _, entry = range entries {
+		var format *certFormat
+
+		if entry.mimeType == "*/*" || entry.mimeType == "application/*" {
+			return certFormats[0]
+		}
+
+		for _, format = range certFormats {
+			var mimeType string = strings.SplitN(format.ContentType, ";", 2)[0]
+			if entry.mimeType == mimeType {
+				return format
+			}
+		}
+
+		// Some clients use alternative names for the same thing.
+		switch entry.mimeType {
+		case "application/x-x509-ca-cert", "application/x-x509-user-cert":
+			return findCertFormat("der")
+		case "application/x-pkcs7-certificates":
+			return findCertFormat("p7c")
+		case "text/*":
+			return findCertFormat("txt")
+		}
+	}
+
+	return nil
+}
+
+// findIssuerCertificate searches the database for the certificate which
+// issued "cert". Returns nil if the issuer is not known.
+func findIssuerCertificate(db keydb.KeyDB, cert *x509.Certificate) (
+	*x509.Certificate, error) {
+	var issuer string = string(keydb.FormatCertSubject(cert.Issuer))
+	var start []byte = keydb.IndexCursor(keydb.SortBySubject,
+		&x509keyserver.X509KeyData{Subject: proto.String(issuer)})
+	var page *keydb.CertificatePage
+	var err error
+
+	for {
+		var record *x509keyserver.X509KeyData
+
+		page, err = db.ScanCertificates(keydb.SortBySubject, start, false, 20)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record = range page.Records {
+			var candidate *x509.Certificate
+
+			// The subject index is sorted, so we're past all candidates.
+			if record.GetSubject() != issuer {
+				return nil, nil
+			}
+
+			candidate, err = db.RetrieveCertificateByIndex(record.GetIndex())
+			if err != nil {
+				return nil, err
+			}
+			if cert.CheckSignatureFrom(candidate) == nil {
+				return candidate, nil
+			}
+		}
+
+		if !page.More() {
+			return nil, nil
+		}
+		start = page.Next
+	}
+}
+
+// buildCertificateChain assembles the chain of known issuers for the
+// given certificate, starting with the certificate itself.
+func buildCertificateChain(db keydb.KeyDB, cert *x509.Certificate) (
+	[]*x509.Certificate, error) {
+	var chain = []*x509.Certificate{cert}
+	var err error
+
+	for len(chain) < maxChainLength {
+		var last *x509.Certificate = chain[len(chain)-1]
+		var issuer *x509.Certificate
+
+		// Self-signed certificates terminate the chain.
+		if bytes.Equal(last.RawIssuer, last.RawSubject) {
+			break
+		}
+
+		issuer, err = findIssuerCertificate(db, last)
+		if err != nil {
+			return nil, err
+		}
+		if issuer == nil {
+			break
+		}
+		chain = append(chain, issuer)
+	}
+
+	return chain, nil
+}
+
+// encodeDER writes the requested certificate in raw DER format.
+func encodeDER(w io.Writer, chain []*x509.Certificate) error {
+	var err error
+
+	_, err = w.Write(chain[0].Raw)
+	return err
+}
+
+// encodePEM writes all certificates in the chain as PEM blocks.
+func encodePEM(w io.Writer, chain []*x509.Certificate) error {
+	var cert *x509.Certificate
+	var err error
+
+	for _, cert = range chain {
+		err = pem.Encode(w, &pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: cert.Raw,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodePKCS7 writes all certificates in the chain as a degenerate,
+// certificate-only PKCS#7 SignedData structure.
+func encodePKCS7(w io.Writer, chain []*x509.Certificate) error {
+	var emptySet = asn1.RawValue{
+		Class:      asn1.ClassUniversal,
+		Tag:        asn1.TagSet,
+		IsCompound: true,
+	}
+	var certs bytes.Buffer
+	var cert *x509.Certificate
+	var signedData, der []byte
+	var err error
+
+	for _, cert = range chain {
+		certs.Write(cert.Raw)
+	}
+
+	signedData, err = asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: emptySet,
+		ContentInfo: pkcs7EmptyContentInfo{
+			ContentType: oidPKCS7Data,
+		},
+		Certificates: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      certs.Bytes(),
+		},
+		SignerInfos: emptySet,
+	})
+	if err != nil {
+		return err
+	}
+
+	der, err = asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidPKCS7SignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      signedData,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(der)
+	return err
+}
+
+// formatFingerprint formats a hash as colon separated hex bytes.
+func formatFingerprint(sum []byte) string {
+	var parts = make([]string, len(sum))
+	var i int
+	var b byte
+
+	for i, b = range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// describePublicKey returns a short human readable description of the
+// certificates public key.
+func describePublicKey(cert *x509.Certificate) string {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("%s (%d bit)", cert.PublicKeyAlgorithm,
+			key.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("%s (%s)", cert.PublicKeyAlgorithm,
+			key.Curve.Params().Name)
+	default:
+		return cert.PublicKeyAlgorithm.String()
+	}
+}
+
+// Names of the individual key usage bits, in bit order.
+var keyUsageNames = []string{
+	"Digital Signature", "Content Commitment", "Key Encipherment",
+	"Data Encipherment", "Key Agreement", "Certificate Sign", "CRL Sign",
+	"Encipher Only", "Decipher Only",
+}
+
+// Names of the known extended key usages.
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "Any",
+	x509.ExtKeyUsageServerAuth:      "TLS Web Server Authentication",
+	x509.ExtKeyUsageClientAuth:      "TLS Web Client Authentication",
+	x509.ExtKeyUsageCodeSigning:     "Code Signing",
+	x509.ExtKeyUsageEmailProtection: "E-mail Protection",
+	x509.ExtKeyUsageTimeStamping:    "Time Stamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSP Signing",
+}
+
+// dumpCertificate writes a human readable description of a single
+// certificate to "w".
+func dumpCertificate(w io.Writer, cert *x509.Certificate) {
+	var sha1sum = sha1.Sum(cert.Raw)
+	var sha256sum = sha256.Sum256(cert.Raw)
+	var usages []string
+	var i int
+
+	fmt.Fprintf(w, "Version:             %d\n", cert.Version)
+	fmt.Fprintf(w, "Serial Number:       %s\n", cert.SerialNumber.String())
+	fmt.Fprintf(w, "Signature Algorithm: %s\n", cert.SignatureAlgorithm)
+	fmt.Fprintf(w, "Issuer:              %s\n",
+		keydb.FormatCertSubject(cert.Issuer))
+	fmt.Fprintf(w, "Not Before:          %s\n", cert.NotBefore.UTC())
+	fmt.Fprintf(w, "Not After:           %s\n", cert.NotAfter.UTC())
+	fmt.Fprintf(w, "Subject:             %s\n",
+		keydb.FormatCertSubject(cert.Subject))
+	fmt.Fprintf(w, "Public Key:          %s\n", describePublicKey(cert))
+
+	if cert.BasicConstraintsValid {
+		if cert.IsCA && cert.MaxPathLen >= 0 &&
+			(cert.MaxPathLen > 0 || cert.MaxPathLenZero) {
+			fmt.Fprintf(w, "Basic Constraints:   CA, path length %d\n",
+				cert.MaxPathLen)
+		} else if cert.IsCA {
+			fmt.Fprintf(w, "Basic Constraints:   CA\n")
+		} else {
+			fmt.Fprintf(w, "Basic Constraints:   not a CA\n")
+		}
+	}
+
+	for i = range keyUsageNames {
+		if cert.KeyUsage&(1<<uint(i)) != 0 {
+			usages = append(usages, keyUsageNames[i])
+		}
+	}
+	if len(usages) > 0 {
+		fmt.Fprintf(w, "Key Usage:           %s\n", strings.Join(usages, ", "))
+	}
+
+	usages = nil
+	for i = range cert.ExtKeyUsage {
+		var name string
+		var ok bool
+
+		if name, ok = extKeyUsageNames[cert.ExtKeyUsage[i]]; !ok {
+			name = fmt.Sprintf("Unknown (%d)", cert.ExtKeyUsage[i])
+		}
+		usages = append(usages, name)
+	}
+	for i = range cert.UnknownExtKeyUsage {
+		usages = append(usages, cert.UnknownExtKeyUsage[i].String())
+	}
+	if len(usages) > 0 {
+		fmt.Fprintf(w, "Extended Key Usage:  %s\n", strings.Join(usages, ", "))
+	}
+
+	for i = range cert.DNSNames {
+		fmt.Fprintf(w, "DNS Name:            %s\n", cert.DNSNames[i])
+	}
+	for i = range cert.EmailAddresses {
+		fmt.Fprintf(w, "E-mail Address:      %s\n", cert.EmailAddresses[i])
+	}
+	for i = range cert.IPAddresses {
+		fmt.Fprintf(w, "IP Address:          %s\n", cert.IPAddresses[i])
+	}
+	for i = range cert.URIs {
+		fmt.Fprintf(w, "URI:                 %s\n", cert.URIs[i])
+	}
+
+	if len(cert.SubjectKeyId) > 0 {
+		fmt.Fprintf(w, "Subject Key ID:      %s\n",
+			formatFingerprint(cert.SubjectKeyId))
+	}
+	if len(cert.AuthorityKeyId) > 0 {
+		fmt.Fprintf(w, "Authority Key ID:    %s\n",
+			formatFingerprint(cert.AuthorityKeyId))
+	}
+	for i = range cert.OCSPServer {
+		fmt.Fprintf(w, "OCSP Server:         %s\n", cert.OCSPServer[i])
+	}
+	for i = range cert.IssuingCertificateURL {
+		fmt.Fprintf(w, "Issuer URL:          %s\n",
+			cert.IssuingCertificateURL[i])
+	}
+	for i = range cert.CRLDistributionPoints {
+		fmt.Fprintf(w, "CRL:                 %s\n",
+			cert.CRLDistributionPoints[i])
+	}
+
+	fmt.Fprintf(w, "SHA-1 Fingerprint:   %s\n", formatFingerprint(sha1sum[:]))
+	fmt.Fprintf(w, "SHA-256 Fingerprint: %s\n",
+		formatFingerprint(sha256sum[:]))
+}
+
+// encodeText writes a human readable dump of all certificates in the
+// chain, followed by the PEM encoding of each of them.
+func encodeText(w io.Writer, chain []*x509.Certificate) error {
+	var i int
+	var err error
+
+	if len(chain) == 0 {
+		return errors.New("No certificate to encode")
+	}
+
+	for i = range chain {
+		if i > 0 {
+			fmt.Fprintf(w, "\n")
+		}
+		dumpCertificate(w, chain[i])
+		fmt.Fprintf(w, "\n")
+		err = encodePEM(w, chain[i:i+1])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
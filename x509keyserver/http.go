@@ -32,7 +32,9 @@
 package main
 
 import (
+	"bytes"
 	"crypto/x509"
+	"encoding/hex"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -41,58 +43,284 @@ import (
 
 	"github.com/caoimhechaos/x509keyserver"
 	"github.com/caoimhechaos/x509keyserver/keydb"
+	"github.com/golang/protobuf/proto"
 )
 
+// Number of certificates to display per page unless requested otherwise.
+const defaultPageSize int32 = 20
+
+// Page sizes offered for selection in the web interface.
+var pageSizes = []int32{10, 20, 50, 100}
+
+// Names of the sort orders as used in the "sort" request parameter.
+var sortOrders = map[string]keydb.SortOrder{
+	"index":   keydb.SortByIndex,
+	"subject": keydb.SortBySubject,
+	"expires": keydb.SortByExpiry,
+	"added":   keydb.SortByAdded,
+}
+
 // HTTP service to display known keys in a web site.
 type HTTPKeyService struct {
-	Db   *keydb.X509KeyDB
+	Db   keydb.KeyDB
 	Tmpl *template.Template
+
+	// Maximum number of certificates which can be requested per page.
+	MaxPageSize int32
 }
 
 type httpExpandedKey struct {
 	Pb      *x509keyserver.X509KeyData
 	Expires time.Time
+	Added   time.Time
+	Revoked time.Time
 }
 
 type templateData struct {
-	Certs []*httpExpandedKey
-	Next  uint64
-	Error string
+	Certs     []*httpExpandedKey
+	Sort      string
+	Count     int32
+	PageSizes []int32
+	Prev      string
+	Next      string
+	HasPrev   bool
+	HasNext   bool
+	Error     string
+}
+
+// Decode the index position given in the request parameter "name", if any.
+func decodeCursor(req *http.Request, name string) ([]byte, error) {
+	var value string = req.FormValue(name)
+
+	if value == "" {
+		return nil, nil
+	}
+	return hex.DecodeString(value)
 }
 
 // Display a list of all known X.509 certificates.
 func (ks *HTTPKeyService) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	var keydata []*x509keyserver.X509KeyData
+	var page *keydb.CertificatePage
 	var key *x509keyserver.X509KeyData
 	var expanded []*httpExpandedKey
-	var startidx, next uint64
+	var data *templateData
+	var order keydb.SortOrder
+	var from, before []byte
+	var cursors [][]byte
+	var startidx uint64
+	var count int64
+	var size int32
 	var startidxStr = req.FormValue("start")
+	var countStr = req.FormValue("count")
 	var display string = req.FormValue("display")
+	var ok bool
 	var err error
 
 	if display != "" {
-		var cert *x509.Certificate
-		startidx, err = strconv.ParseUint(display, 10, 64)
+		ks.serveCertificate(rw, req, display)
+		return
+	}
+
+	data = &templateData{
+		Sort:  req.FormValue("sort"),
+		Count: defaultPageSize,
+	}
+
+	if data.Sort == "" {
+		data.Sort = "index"
+	}
+	if order, ok = sortOrders[data.Sort]; !ok {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Unknown sort order: " + data.Sort))
+		return
+	}
+
+	if countStr != "" {
+		count, err = strconv.ParseInt(countStr, 10, 32)
+		if err != nil || count <= 0 {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("Invalid page size: " + countStr))
+			return
+		}
+		data.Count = int32(count)
+	}
+	if ks.MaxPageSize > 0 && data.Count > ks.MaxPageSize {
+		data.Count = ks.MaxPageSize
+	}
+	for _, size = range pageSizes {
+		if ks.MaxPageSize <= 0 || size <= ks.MaxPageSize {
+			data.PageSizes = append(data.PageSizes, size)
+		}
+	}
+
+	from, err = decodeCursor(req, "from")
+	if err == nil {
+		before, err = decodeCursor(req, "before")
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	// Support links using the older "start" parameter, which always refers
+	// to an index number.
+	if startidxStr != "" && from == nil {
+		startidx, err = strconv.ParseUint(startidxStr, 10, 64)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+		data.Sort = "index"
+		order = keydb.SortByIndex
+		from = keydb.IndexCursor(order,
+			&x509keyserver.X509KeyData{Index: proto.Uint64(startidx)})
+	}
+
+	if before != nil {
+		var i int
+
+		// Scan backwards from the first record of the following page.
+		page, err = ks.Db.ScanCertificates(order, before, true, data.Count+1)
 		if err != nil {
 			rw.WriteHeader(http.StatusInternalServerError)
 			rw.Write([]byte(err.Error()))
 			return
 		}
-		cert, err = ks.Db.RetrieveCertificateByIndex(startidx)
+
+		for i = range page.Records {
+			if bytes.Equal(page.Cursors[i], before) {
+				continue
+			}
+			if int32(len(cursors)) == data.Count {
+				data.HasPrev = true
+				break
+			}
+			cursors = append(cursors, page.Cursors[i])
+			expanded = append(expanded, expandKey(page.Records[i]))
+		}
+		if page.More() {
+			data.HasPrev = true
+		}
+
+		// Bring the page back into display order.
+		for i = 0; i < len(expanded)/2; i++ {
+			var j int = len(expanded) - 1 - i
+			expanded[i], expanded[j] = expanded[j], expanded[i]
+			cursors[i], cursors[j] = cursors[j], cursors[i]
+		}
+
+		data.HasNext = true
+		data.Next = hex.EncodeToString(before)
+	} else {
+		page, err = ks.Db.ScanCertificates(order, from, false, data.Count)
 		if err != nil {
 			rw.WriteHeader(http.StatusInternalServerError)
 			rw.Write([]byte(err.Error()))
 			return
 		}
-		rw.Header().Set("Content-Disposition",
-			fmt.Sprintf("attachment; filename=%d.der", startidx))
-		rw.WriteHeader(http.StatusOK)
-		rw.Write(cert.Raw)
+
+		cursors = page.Cursors
+		for _, key = range page.Records {
+			expanded = append(expanded, expandKey(key))
+		}
+
+		if page.More() {
+			data.HasNext = true
+			data.Next = hex.EncodeToString(page.Next)
+		}
+
+		// Find out whether there's anything before the start position.
+		if from != nil {
+			var prev *keydb.CertificatePage
+			var cursor []byte
+
+			prev, err = ks.Db.ScanCertificates(order, from, true, 2)
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				rw.Write([]byte(err.Error()))
+				return
+			}
+			for _, cursor = range prev.Cursors {
+				if !bytes.Equal(cursor, from) {
+					data.HasPrev = true
+				}
+			}
+		}
+	}
+
+	if data.HasPrev {
+		if len(cursors) > 0 {
+			data.Prev = hex.EncodeToString(cursors[0])
+		} else {
+			data.Prev = hex.EncodeToString(from)
+		}
+	}
+
+	data.Certs = expanded
+	ks.Tmpl.Execute(rw, data)
+}
+
+// Convert the certificate metadata into a form suitable for display.
+func expandKey(key *x509keyserver.X509KeyData) *httpExpandedKey {
+	var expkey *httpExpandedKey = new(httpExpandedKey)
+	expkey.Pb = key
+	expkey.Expires = time.Unix(int64(key.GetExpires()), 0)
+	expkey.Added = time.Unix(int64(key.GetAdded()), 0)
+	expkey.Revoked = time.Unix(int64(key.GetRevoked()), 0)
+	return expkey
+}
+
+// Serve the certificate with the index number "display" in the format
+// requested by the client. The format can be selected explicitly using
+// the "format" parameter, or through the Accept header. If the "chain"
+// parameter is set, all known issuer certificates will be included for
+// the formats which support it.
+func (ks *HTTPKeyService) serveCertificate(
+	rw http.ResponseWriter, req *http.Request, display string) {
+	var format *certFormat
+	var formatName string = req.FormValue("format")
+	var chain []*x509.Certificate
+	var cert *x509.Certificate
+	var buf bytes.Buffer
+	var disposition string
+	var index uint64
+	var err error
+
+	index, err = strconv.ParseUint(display, 10, 64)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
 		return
 	}
 
-	if startidxStr != "" {
-		startidx, err = strconv.ParseUint(startidxStr, 10, 64)
+	if formatName != "" {
+		format = findCertFormat(formatName)
+		if format == nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("Unsupported format: " + formatName))
+			return
+		}
+	} else {
+		format = negotiateCertFormat(req.Header.Get("Accept"))
+		if format == nil {
+			rw.WriteHeader(http.StatusNotAcceptable)
+			rw.Write([]byte("None of the acceptable formats are supported"))
+			return
+		}
+	}
+
+	cert, err = ks.Db.RetrieveCertificateByIndex(index)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	chain = []*x509.Certificate{cert}
+	if req.FormValue("chain") != "" && format.Name != "der" {
+		chain, err = buildCertificateChain(ks.Db, cert)
 		if err != nil {
 			rw.WriteHeader(http.StatusInternalServerError)
 			rw.Write([]byte(err.Error()))
@@ -100,23 +328,23 @@ func (ks *HTTPKeyService) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	keydata, err = ks.Db.ListCertificates(startidx, 20)
+	// Encode into a buffer first so errors can still be reported properly.
+	err = format.Encode(&buf, chain)
 	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte(err.Error()))
 		return
 	}
 
-	for _, key = range keydata {
-		var expkey *httpExpandedKey = new(httpExpandedKey)
-		expkey.Pb = key
-		expkey.Expires = time.Unix(int64(key.GetExpires()), 0)
-		expanded = append(expanded, expkey)
-		next = key.GetIndex() + 1
+	disposition = "attachment"
+	if !format.Attachment {
+		disposition = "inline"
 	}
 
-	ks.Tmpl.Execute(rw, &templateData{
-		Certs: expanded,
-		Next:  next,
-	})
+	rw.Header().Set("Content-Type", format.ContentType)
+	rw.Header().Set("Content-Disposition",
+		fmt.Sprintf("%s; filename=%d.%s", disposition, index, format.Extension))
+	rw.Header().Add("Vary", "Accept")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(buf.Bytes())
 }
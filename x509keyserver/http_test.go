@@ -0,0 +1,245 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caoimhechaos/x509keyserver/keydb"
+	"github.com/caoimhechaos/x509keyserver/x509keyservertest"
+)
+
+// Create a database holding a CA hierarchy with the given number of leaves.
+func newTestDB(t *testing.T, leaves int) (*keydb.MemoryKeyDB,
+	*x509keyservertest.Hierarchy) {
+	var db *keydb.MemoryKeyDB
+	var h *x509keyservertest.Hierarchy
+	var err error
+
+	db, h, err = x509keyservertest.NewHierarchyDB(leaves)
+	if err != nil {
+		t.Fatal("Error setting up database: ", err)
+	}
+	return db, h
+}
+
+// Parse one of the templates shipped with the server.
+func parseTemplate(t *testing.T, path string) *template.Template {
+	var tmpl *template.Template
+	var err error
+
+	tmpl, err = template.ParseFiles(path)
+	if err != nil {
+		t.Fatal("Error parsing template ", path, ": ", err)
+	}
+	return tmpl
+}
+
+// Send the request to "handler" and return the response.
+func serve(handler http.Handler, req *http.Request) (*http.Response, string) {
+	var rec = httptest.NewRecorder()
+	var res *http.Response
+	var body []byte
+
+	handler.ServeHTTP(rec, req)
+	res = rec.Result()
+	body, _ = ioutil.ReadAll(res.Body)
+	return res, string(body)
+}
+
+func TestKeyList(t *testing.T) {
+	var db, h = newTestDB(t, 3)
+	var ks = &HTTPKeyService{
+		Db:   db,
+		Tmpl: parseTemplate(t, "keylist.html"),
+	}
+	var res *http.Response
+	var body string
+	var cert *x509.Certificate
+
+	res, body = serve(ks, httptest.NewRequest("GET", "/?sort=subject", nil))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", res.StatusCode, body)
+	}
+	for _, cert = range h.Certificates() {
+		if !strings.Contains(body, "/?display="+
+			cert.SerialNumber.String()+"\"") {
+			t.Errorf("Certificate %s not listed", cert.SerialNumber)
+		}
+	}
+	if strings.Index(body, h.Leaves[0].Cert.Subject.CommonName) >
+		strings.Index(body, h.Leaves[1].Cert.Subject.CommonName) {
+		t.Error("Certificates not sorted by subject")
+	}
+
+	// Paging.
+	res, body = serve(ks, httptest.NewRequest("GET", "/?count=2", nil))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", res.StatusCode, body)
+	}
+	if strings.Count(body, "&amp;format=txt") != 2 {
+		t.Errorf("Expected 2 certificates on the page, got %d",
+			strings.Count(body, "&amp;format=txt"))
+	}
+	if !strings.Contains(body, "&amp;from=") {
+		t.Error("No link to the next page")
+	}
+
+	res, body = serve(ks, httptest.NewRequest("GET", "/?sort=bogus", nil))
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected bad request for unknown sort order, got %d",
+			res.StatusCode)
+	}
+}
+
+func TestDisplayFormats(t *testing.T) {
+	var db, h = newTestDB(t, 1)
+	var ks = &HTTPKeyService{
+		Db:   db,
+		Tmpl: parseTemplate(t, "keylist.html"),
+	}
+	var leaf *x509.Certificate = h.Leaves[0].Cert
+	var base string = "/?display=" + leaf.SerialNumber.String()
+	var format *certFormat
+	var res *http.Response
+	var body string
+
+	for _, format = range certFormats {
+		var block *pem.Block
+
+		res, body = serve(ks, httptest.NewRequest("GET",
+			base+"&format="+format.Name, nil))
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("%s: unexpected status %d: %s", format.Name,
+				res.StatusCode, body)
+			continue
+		}
+		if res.Header.Get("Content-Type") != format.ContentType {
+			t.Errorf("%s: unexpected content type %s", format.Name,
+				res.Header.Get("Content-Type"))
+		}
+		if !strings.Contains(res.Header.Get("Content-Disposition"),
+			leaf.SerialNumber.String()+"."+format.Extension) {
+			t.Errorf("%s: unexpected disposition %s", format.Name,
+				res.Header.Get("Content-Disposition"))
+		}
+
+		switch format.Name {
+		case "der":
+			if body != string(leaf.Raw) {
+				t.Error("der: response is not the certificate")
+			}
+		case "pem", "txt":
+			block, _ = pem.Decode([]byte(body[strings.Index(body,
+				"-----BEGIN"):]))
+			if block == nil || !bytes.Equal(block.Bytes, leaf.Raw) {
+				t.Errorf("%s: response does not contain the certificate",
+					format.Name)
+			}
+		case "p7c":
+			if !bytes.Contains([]byte(body), leaf.Raw) {
+				t.Error("p7c: response does not contain the certificate")
+			}
+		}
+	}
+
+	// The chain includes the issuers.
+	_, body = serve(ks, httptest.NewRequest("GET",
+		base+"&format=pem&chain=1", nil))
+	if strings.Count(body, "-----BEGIN CERTIFICATE-----") != 3 {
+		t.Errorf("Expected 3 certificates in the chain, got %d",
+			strings.Count(body, "-----BEGIN CERTIFICATE-----"))
+	}
+
+	res, _ = serve(ks, httptest.NewRequest("GET", base+"&format=bogus", nil))
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected bad request for unknown format, got %d",
+			res.StatusCode)
+	}
+}
+
+func TestDisplayNegotiation(t *testing.T) {
+	var db, h = newTestDB(t, 1)
+	var ks = &HTTPKeyService{
+		Db:   db,
+		Tmpl: parseTemplate(t, "keylist.html"),
+	}
+	var tests = []struct {
+		accept string
+		format string
+	}{
+		{"", "der"},
+		{"*/*", "der"},
+		{"application/x-pem-file", "pem"},
+		{"application/x-pkcs7-certificates", "p7c"},
+		{"text/*", "txt"},
+		{"application/pkix-cert;q=0.1, text/plain;q=0.5", "txt"},
+		{"text/plain;q=0, application/x-pem-file", "pem"},
+		{"image/png", ""},
+	}
+	var i int
+
+	for i = range tests {
+		var req *http.Request = httptest.NewRequest("GET",
+			"/?display="+h.Leaves[0].Cert.SerialNumber.String(), nil)
+		var res *http.Response
+
+		req.Header.Set("Accept", tests[i].accept)
+		res, _ = serve(ks, req)
+
+		if tests[i].format == "" {
+			if res.StatusCode != http.StatusNotAcceptable {
+				t.Errorf("Accept %q: expected status %d, got %d",
+					tests[i].accept, http.StatusNotAcceptable,
+					res.StatusCode)
+			}
+			continue
+		}
+		if res.Header.Get("Content-Type") !=
+			findCertFormat(tests[i].format).ContentType {
+			t.Errorf("Accept %q: got %s, expected format %s",
+				tests[i].accept, res.Header.Get("Content-Type"),
+				tests[i].format)
+		}
+		if res.Header.Get("Vary") != "Accept" {
+			t.Errorf("Accept %q: missing Vary header", tests[i].accept)
+		}
+	}
+}
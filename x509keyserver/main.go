@@ -37,19 +37,32 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"time"
 
 	"github.com/caoimhechaos/x509keyserver"
 	"github.com/caoimhechaos/x509keyserver/keydb"
+	"github.com/caoimhechaos/x509keyserver/rpcserver"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
 )
 
 func main() {
-	var tmpl *template.Template
-	var ks *X509KeyServer
-	var kdb *keydb.X509KeyDB
+	var tmpl, expiryTmpl, uploadTmpl *template.Template
+	var upload *UploadService
+	var ks *rpcserver.X509KeyServer
+	var cdb *keydb.X509KeyDB
+	var kdb keydb.KeyDB
 	var httpBind, bind string
-	var tmplPath, staticPath string
+	var tmplPath, expiryTmplPath, staticPath string
+	var expiryThresholdSpec string
+	var uploadTmplPath, uploadUsersPath string
+	var tlsCertPath, tlsKeyPath string
+	var uploadBehindProxy bool
+	var expiryThresholds []time.Duration
+	var inventoryInterval, expiryCacheFor time.Duration
+	var expiryMaxRows int
 	var dbserver, keyspace string
+	var maxPageSize, feedEntries int
 	var server *grpc.Server
 	var l net.Listener
 	var err error
@@ -58,10 +71,41 @@ func main() {
 		"host:port pair to bind the RPC server to")
 	flag.StringVar(&httpBind, "bind-http", "",
 		"host:port pair to bind the HTTP server to")
+	flag.StringVar(&tlsCertPath, "tls-cert", "",
+		"Path to the PEM encoded certificate chain for serving HTTPS. "+
+			"Plain HTTP is served if empty")
+	flag.StringVar(&tlsKeyPath, "tls-key", "",
+		"Path to the PEM encoded private key for serving HTTPS")
 	flag.StringVar(&staticPath, "static-path", ".",
 		"Path to the required static files for the web interface")
 	flag.StringVar(&tmplPath, "template", "keylist.html",
 		"Path to the template file for displaying")
+	flag.IntVar(&maxPageSize, "max-page-size", 100,
+		"Maximum number of certificates to display on a single page")
+	flag.StringVar(&expiryTmplPath, "expiry-template", "expiry.html",
+		"Path to the template file for the expiry dashboard")
+	flag.StringVar(&expiryThresholdSpec, "expiry-thresholds", "168h,720h",
+		"Comma separated list of durations before expiry at which "+
+			"certificates should be highlighted on the expiry dashboard")
+	flag.IntVar(&expiryMaxRows, "expiry-max-rows", defaultExpiryMaxRows,
+		"Maximum number of certificates listed per group on the expiry "+
+			"dashboard")
+	flag.DurationVar(&expiryCacheFor, "expiry-cache", time.Minute,
+		"Time for which the expiry dashboard is reused between requests")
+	flag.IntVar(&feedEntries, "feed-entries", defaultFeedEntries,
+		"Maximum number of entries in the Atom feed of changes")
+	flag.StringVar(&uploadTmplPath, "upload-template", "upload.html",
+		"Path to the template file for uploading certificates")
+	flag.StringVar(&uploadUsersPath, "upload-users", "",
+		"htpasswd style file with the bcrypt password hashes of the "+
+			"users permitted to upload certificates. Uploads are "+
+			"disabled if empty. Requires -tls-cert, since the "+
+			"passwords are sent with every request")
+	flag.BoolVar(&uploadBehindProxy, "upload-behind-tls-proxy", false,
+		"Permit uploads over plain HTTP because a reverse proxy "+
+			"terminates TLS in front of the web interface")
+	flag.DurationVar(&inventoryInterval, "inventory-interval", 5*time.Minute,
+		"Interval at which the certificate inventory metrics are updated")
 
 	flag.StringVar(&dbserver, "cassandra-server", "localhost:9160",
 		"host:port pair of the Cassandra database server")
@@ -69,14 +113,22 @@ func main() {
 		"Cassandra keyspace in which the relevant column families are stored")
 	flag.Parse()
 
+	if (len(tlsCertPath) > 0) != (len(tlsKeyPath) > 0) {
+		log.Fatal("-tls-cert and -tls-key must be specified together")
+	}
+
+	if inventoryInterval <= 0 {
+		log.Fatal("The inventory interval must be positive, got ",
+			inventoryInterval)
+	}
+
 	// Set up the connection to the key database.
-	kdb, err = keydb.NewX509KeyDB(dbserver, keyspace)
+	cdb, err = keydb.NewX509KeyDB(dbserver, keyspace)
 	if err != nil {
 		log.Fatal("Error connecting to key database: ", err)
 	}
-	ks = &X509KeyServer{
-		Db: kdb,
-	}
+	kdb = instrumentKeyDB(cdb, "cassandra")
+	ks = rpcserver.NewX509KeyServer(kdb)
 
 	// Register the RPC service.
 	l, err = net.Listen("tcp", bind)
@@ -84,25 +136,80 @@ func main() {
 		log.Fatal("Error listening on ", bind, ": ", err)
 	}
 
-	server = grpc.NewServer()
+	server = grpc.NewServer(grpc.UnaryInterceptor(rpcMetricsInterceptor))
 	x509keyserver.RegisterX509KeyServerServer(server, ks)
 
+	expiryThresholds, err = parseThresholds(expiryThresholdSpec)
+	if err != nil {
+		log.Fatal("Error parsing expiry thresholds ",
+			expiryThresholdSpec, ": ", err)
+	}
+
 	// Prepare the HTTP server
 	if len(httpBind) > 0 {
 		tmpl, err = template.ParseFiles(tmplPath)
 		if err != nil {
 			log.Fatal("Error parsing template ", tmplPath, ": ", err)
 		}
+		expiryTmpl, err = template.ParseFiles(expiryTmplPath)
+		if err != nil {
+			log.Fatal("Error parsing template ", expiryTmplPath, ": ", err)
+		}
+
+		http.Handle("/", instrumentHandler("keylist", &HTTPKeyService{
+			Db:          kdb,
+			Tmpl:        tmpl,
+			MaxPageSize: int32(maxPageSize),
+		}))
+		http.Handle("/expiry", instrumentHandler("expiry", &ExpiryDashboard{
+			Db:         kdb,
+			Tmpl:       expiryTmpl,
+			Thresholds: expiryThresholds,
+			MaxRows:    expiryMaxRows,
+			CacheFor:   expiryCacheFor,
+		}))
+		http.Handle("/feed.atom", instrumentHandler("feed", &FeedService{
+			Db:         kdb,
+			MaxEntries: feedEntries,
+		}))
+		http.Handle("/metrics", promhttp.Handler())
+
+		// The inventory is only of use if the metrics are served.
+		go runInventory(kdb, expiryThresholds, inventoryInterval)
+
+		if len(uploadUsersPath) > 0 {
+			// Basic authentication sends the password in the clear
+			// with every request.
+			if len(tlsCertPath) == 0 && !uploadBehindProxy {
+				log.Fatal("Refusing to accept uploads over plain HTTP; " +
+					"specify -tls-cert and -tls-key")
+			} else if len(tlsCertPath) == 0 {
+				log.Print("Warning: accepting uploads over plain HTTP, " +
+					"passwords are only protected by the reverse proxy")
+			}
+
+			uploadTmpl, err = template.ParseFiles(uploadTmplPath)
+			if err != nil {
+				log.Fatal("Error parsing template ", uploadTmplPath,
+					": ", err)
+			}
+			upload, err = NewUploadService(kdb, uploadTmpl, uploadUsersPath)
+			if err != nil {
+				log.Fatal("Error setting up uploads: ", err)
+			}
+			http.Handle("/upload", instrumentHandler("upload", upload))
+		}
 
-		http.Handle("/", &HTTPKeyService{
-			Db:   kdb,
-			Tmpl: tmpl,
-		})
 		http.Handle("/css/", http.FileServer(http.Dir(staticPath)))
 		http.Handle("/js/", http.FileServer(http.Dir(staticPath)))
 
 		go server.Serve(l)
-		err = http.ListenAndServe(httpBind, nil)
+		if len(tlsCertPath) > 0 {
+			err = http.ListenAndServeTLS(httpBind, tlsCertPath,
+				tlsKeyPath, nil)
+		} else {
+			err = http.ListenAndServe(httpBind, nil)
+		}
 		if err != nil {
 			log.Fatal("Error binding to ", httpBind, ": ", err)
 		}
@@ -0,0 +1,342 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/caoimhechaos/x509keyserver"
+	"github.com/caoimhechaos/x509keyserver/keydb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	rpcRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "x509keyserver",
+		Subsystem: "rpc",
+		Name:      "requests_total",
+		Help:      "Number of RPCs handled, by method and status code.",
+	}, []string{"method", "code"})
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "x509keyserver",
+		Subsystem: "rpc",
+		Name:      "duration_seconds",
+		Help:      "Latency of RPCs, by method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "x509keyserver",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests, by handler, method and status code.",
+	}, []string{"handler", "method", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "x509keyserver",
+		Subsystem: "http",
+		Name:      "duration_seconds",
+		Help:      "Latency of HTTP requests, by handler and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler", "code"})
+
+	keydbDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "x509keyserver",
+		Subsystem: "keydb",
+		Name:      "operation_duration_seconds",
+		Help:      "Latency of key database operations, by backend and operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"backend", "operation"})
+	keydbErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "x509keyserver",
+		Subsystem: "keydb",
+		Name:      "errors_total",
+		Help:      "Number of failed key database operations, by backend and operation.",
+	}, []string{"backend", "operation"})
+
+	inventoryByIssuer = &issuerInventory{
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName("x509keyserver", "inventory",
+				"certificates"),
+			"Number of known certificates, by issuer.",
+			[]string{"issuer"}, nil),
+	}
+	inventoryExpired = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "x509keyserver",
+		Subsystem: "inventory",
+		Name:      "certificates_expired",
+		Help:      "Number of known certificates which have expired without being revoked.",
+	})
+	inventoryExpiring = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "x509keyserver",
+		Subsystem: "inventory",
+		Name:      "certificates_expiring",
+		Help:      "Number of valid certificates expiring within the given time.",
+	}, []string{"within"})
+	inventoryRevoked = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "x509keyserver",
+		Subsystem: "inventory",
+		Name:      "certificates_revoked",
+		Help:      "Number of known certificates which have been revoked.",
+	})
+	inventoryUpdated = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "x509keyserver",
+		Subsystem: "inventory",
+		Name:      "last_update_timestamp_seconds",
+		Help:      "Time of the last successful update of the inventory metrics.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(rpcRequests, rpcDuration, httpRequests,
+		httpDuration, keydbDuration, keydbErrors, inventoryByIssuer,
+		inventoryExpired, inventoryExpiring, inventoryRevoked,
+		inventoryUpdated)
+}
+
+// issuerInventory exports the number of certificates by issuer. Unlike a
+// GaugeVec, all counts are replaced at once, so issuers which no longer
+// have any certificates disappear without the others being missing from
+// scrapes in the meantime.
+type issuerInventory struct {
+	desc   *prometheus.Desc
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+func (c *issuerInventory) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *issuerInventory) Collect(ch chan<- prometheus.Metric) {
+	var issuer string
+	var count int
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for issuer, count = range c.counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue,
+			float64(count), issuer)
+	}
+}
+
+// set replaces the counts of all issuers with "counts".
+func (c *issuerInventory) set(counts map[string]int) {
+	c.lock.Lock()
+	c.counts = counts
+	c.lock.Unlock()
+}
+
+// rpcMetricsInterceptor records the number and latency of all RPCs.
+func rpcMetricsInterceptor(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (
+	interface{}, error) {
+	var start time.Time = time.Now()
+	var method string = path.Base(info.FullMethod)
+	var code string
+	var resp interface{}
+	var err error
+
+	resp, err = handler(ctx, req)
+	code = status.Code(err).String()
+
+	rpcRequests.WithLabelValues(method, code).Inc()
+	rpcDuration.WithLabelValues(method, code).Observe(
+		time.Since(start).Seconds())
+	return resp, err
+}
+
+// instrumentHandler records the number and latency of requests to the
+// HTTP handler "h", which is identified as "name".
+func instrumentHandler(name string, h http.Handler) http.Handler {
+	var labels = prometheus.Labels{"handler": name}
+
+	return promhttp.InstrumentHandlerDuration(
+		httpDuration.MustCurryWith(labels),
+		promhttp.InstrumentHandlerCounter(
+			httpRequests.MustCurryWith(labels), h))
+}
+
+// instrumentedKeyDB records the latency and errors of all operations of
+// the key database backend it wraps.
+type instrumentedKeyDB struct {
+	db      keydb.KeyDB
+	backend string
+}
+
+// instrumentKeyDB wraps the key database "db" so that all operations are
+// recorded as being performed by "backend".
+func instrumentKeyDB(db keydb.KeyDB, backend string) keydb.KeyDB {
+	return &instrumentedKeyDB{
+		db:      db,
+		backend: backend,
+	}
+}
+
+// observe records an operation which was started at "start" and finished
+// with the error pointed to by "err". It is meant to be deferred, so the
+// error is only looked at once the operation has returned.
+func (i *instrumentedKeyDB) observe(operation string, start time.Time,
+	err *error) {
+	keydbDuration.WithLabelValues(i.backend, operation).Observe(
+		time.Since(start).Seconds())
+	if *err != nil && *err != keydb.ErrNotFound {
+		keydbErrors.WithLabelValues(i.backend, operation).Inc()
+	}
+}
+
+func (i *instrumentedKeyDB) ListCertificates(start_index uint64,
+	count int32) (ret []*x509keyserver.X509KeyData, err error) {
+	defer i.observe("ListCertificates", time.Now(), &err)
+	ret, err = i.db.ListCertificates(start_index, count)
+	return
+}
+
+func (i *instrumentedKeyDB) ScanCertificates(order keydb.SortOrder,
+	start []byte, reverse bool, count int32) (
+	ret *keydb.CertificatePage, err error) {
+	defer i.observe("ScanCertificates", time.Now(), &err)
+	ret, err = i.db.ScanCertificates(order, start, reverse, count)
+	return
+}
+
+func (i *instrumentedKeyDB) RetrieveCertificateByIndex(index uint64) (
+	ret *x509.Certificate, err error) {
+	defer i.observe("RetrieveCertificateByIndex", time.Now(), &err)
+	ret, err = i.db.RetrieveCertificateByIndex(index)
+	return
+}
+
+func (i *instrumentedKeyDB) RetrieveKeyDataByIndex(index uint64) (
+	ret *x509keyserver.X509KeyData, err error) {
+	defer i.observe("RetrieveKeyDataByIndex", time.Now(), &err)
+	ret, err = i.db.RetrieveKeyDataByIndex(index)
+	return
+}
+
+func (i *instrumentedKeyDB) AddX509Certificate(cert *x509.Certificate) (
+	err error) {
+	defer i.observe("AddX509Certificate", time.Now(), &err)
+	err = i.db.AddX509Certificate(cert)
+	return
+}
+
+func (i *instrumentedKeyDB) RevokeX509Certificate(index uint64,
+	when time.Time) (err error) {
+	defer i.observe("RevokeX509Certificate", time.Now(), &err)
+	err = i.db.RevokeX509Certificate(index, when)
+	return
+}
+
+// updateInventory recomputes the inventory metrics from the certificates
+// stored in "db". "thresholds" are the durations for which the number
+// of certificates expiring within them is reported. Revoked certificates
+// are counted separately rather than as expired or expiring.
+func updateInventory(db keydb.KeyDB, thresholds []time.Duration) error {
+	var now time.Time = time.Now()
+	var byIssuer = make(map[string]int)
+	var expiring = make([]int, len(thresholds))
+	var page *keydb.CertificatePage
+	var threshold time.Duration
+	var expired, revoked int
+	var start []byte
+	var i int
+	var err error
+
+	for {
+		var rec *x509keyserver.X509KeyData
+
+		page, err = db.ScanCertificates(
+			keydb.SortByExpiry, start, false, expiryScanBatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, rec = range page.Records {
+			var expires time.Time = time.Unix(int64(rec.GetExpires()), 0)
+
+			byIssuer[rec.GetIssuer()]++
+			if rec.GetRevoked() != 0 {
+				revoked++
+				continue
+			}
+			if expires.Before(now) {
+				expired++
+				continue
+			}
+			for i, threshold = range thresholds {
+				if expires.Before(now.Add(threshold)) {
+					expiring[i]++
+				}
+			}
+		}
+
+		if !page.More() {
+			break
+		}
+		start = page.Next
+	}
+
+	inventoryByIssuer.set(byIssuer)
+	inventoryExpired.Set(float64(expired))
+	inventoryRevoked.Set(float64(revoked))
+	for i, threshold = range thresholds {
+		inventoryExpiring.WithLabelValues(threshold.String()).Set(
+			float64(expiring[i]))
+	}
+	inventoryUpdated.Set(float64(now.Unix()))
+
+	return nil
+}
+
+// runInventory updates the inventory metrics every "interval".
+func runInventory(db keydb.KeyDB, thresholds []time.Duration,
+	interval time.Duration) {
+	var err error
+
+	for {
+		err = updateInventory(db, thresholds)
+		if err != nil {
+			log.Print("Error updating certificate inventory: ", err)
+		}
+		time.Sleep(interval)
+	}
+}
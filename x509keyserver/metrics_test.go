@@ -0,0 +1,135 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caoimhechaos/x509keyserver/x509keyservertest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUpdateInventory(t *testing.T) {
+	var db, h = newTestDB(t, 3)
+	var expired, soon, revokedSoon *x509keyservertest.Certificate
+	var soonValidity = x509keyservertest.WithValidity(
+		time.Now().Add(-time.Hour), time.Now().Add(30*time.Minute))
+	var thresholds = []time.Duration{time.Hour, 48 * time.Hour}
+	var err error
+
+	expired, err = h.Intermediate.Issue("expired.example.com",
+		x509keyservertest.Expired())
+	if err == nil {
+		soon, err = h.Intermediate.Issue("soon.example.com", soonValidity)
+	}
+	if err == nil {
+		revokedSoon, err = h.Root.Issue("revoked.example.com",
+			soonValidity)
+	}
+	if err != nil {
+		t.Fatal("Error generating certificates: ", err)
+	}
+	err = db.AddX509Certificate(expired.Cert)
+	if err == nil {
+		err = db.AddX509Certificate(soon.Cert)
+	}
+	if err == nil {
+		err = db.AddX509Certificate(revokedSoon.Cert)
+	}
+	if err == nil {
+		err = db.RevokeX509Certificate(
+			revokedSoon.Cert.SerialNumber.Uint64(), time.Now())
+	}
+	if err == nil {
+		err = db.RevokeX509Certificate(
+			h.Leaves[0].Cert.SerialNumber.Uint64(), time.Now())
+	}
+	if err != nil {
+		t.Fatal("Error adding certificates: ", err)
+	}
+
+	err = updateInventory(db, thresholds)
+	if err != nil {
+		t.Fatal("Error updating inventory: ", err)
+	}
+
+	if testutil.ToFloat64(inventoryExpired) != 1 {
+		t.Errorf("Expected 1 expired certificate, got %v",
+			testutil.ToFloat64(inventoryExpired))
+	}
+	if testutil.ToFloat64(inventoryRevoked) != 2 {
+		t.Errorf("Expected 2 revoked certificates, got %v",
+			testutil.ToFloat64(inventoryRevoked))
+	}
+
+	// The revoked certificates expiring soon are not counted.
+	if testutil.ToFloat64(inventoryExpiring.WithLabelValues(
+		time.Hour.String())) != 1 {
+		t.Errorf("Expected 1 certificate expiring within an hour, got %v",
+			testutil.ToFloat64(inventoryExpiring.WithLabelValues(
+				time.Hour.String())))
+	}
+	if testutil.ToFloat64(inventoryExpiring.WithLabelValues(
+		(48 * time.Hour).String())) != 5 {
+		t.Errorf("Expected 5 certificates expiring within two days, got %v",
+			testutil.ToFloat64(inventoryExpiring.WithLabelValues(
+				(48 * time.Hour).String())))
+	}
+
+	// Every certificate is counted under its issuer.
+	inventoryByIssuer.lock.Lock()
+	if len(inventoryByIssuer.counts) != 2 {
+		t.Errorf("Expected 2 issuers, got %v", inventoryByIssuer.counts)
+	}
+	inventoryByIssuer.lock.Unlock()
+	if testutil.CollectAndCount(inventoryByIssuer) != 2 {
+		t.Errorf("Expected 2 issuer metrics, got %d",
+			testutil.CollectAndCount(inventoryByIssuer))
+	}
+
+	// Issuers without any certificates disappear. Here, only the root
+	// has issued certificates.
+	db, _ = newTestDB(t, 0)
+	err = updateInventory(db, thresholds)
+	if err != nil {
+		t.Fatal("Error updating inventory: ", err)
+	}
+	if testutil.ToFloat64(inventoryRevoked) != 0 {
+		t.Errorf("Expected no revoked certificates, got %v",
+			testutil.ToFloat64(inventoryRevoked))
+	}
+	if testutil.CollectAndCount(inventoryByIssuer) != 1 {
+		t.Errorf("Expected 1 issuer metric, got %d",
+			testutil.CollectAndCount(inventoryByIssuer))
+	}
+}
@@ -0,0 +1,446 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caoimhechaos/x509keyserver"
+	"github.com/caoimhechaos/x509keyserver/keydb"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Maximum size of an upload request, including all form fields.
+const maxUploadSize = 1 << 20
+
+// Time for which a CSRF token remains valid after it has been issued.
+const csrfTokenLifetime = time.Hour
+
+// UploadService lets authenticated users register new certificates through
+// the web interface. Uploads are a two step process: the certificates are
+// first parsed and presented to the user for review, and only stored once
+// the user confirms.
+type UploadService struct {
+	Db   keydb.KeyDB
+	Tmpl *template.Template
+
+	// Users permitted to upload certificates, mapped to their bcrypt
+	// password hashes.
+	users map[string][]byte
+
+	// Key used for generating and verifying CSRF tokens.
+	csrfKey []byte
+}
+
+// Description of an uploaded certificate for the preview.
+type uploadedCert struct {
+	Index   uint64
+	Subject string
+	Issuer  string
+	Expires time.Time
+	IsCA    bool
+
+	// Whether the certificate is already stored under its index, whether
+	// a different certificate is, and whether the serial number had to
+	// be truncated to obtain the index.
+	Existing  bool
+	Conflict  bool
+	Truncated bool
+}
+
+type uploadTemplateData struct {
+	User      string
+	Token     string
+	Certs     []*uploadedCert
+	PEM       string
+	Stored    bool
+	Conflicts bool
+	Error     string
+}
+
+// NewUploadService creates a new upload handler which authenticates users
+// against the htpasswd style file "passwdPath". Only bcrypt password hashes
+// are supported.
+func NewUploadService(db keydb.KeyDB, tmpl *template.Template,
+	passwdPath string) (*UploadService, error) {
+	var ret = &UploadService{
+		Db:      db,
+		Tmpl:    tmpl,
+		users:   make(map[string][]byte),
+		csrfKey: make([]byte, 32),
+	}
+	var scanner *bufio.Scanner
+	var f *os.File
+	var err error
+
+	_, err = rand.Read(ret.csrfKey)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err = os.Open(passwdPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner = bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line string = strings.TrimSpace(scanner.Text())
+		var parts []string
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts = strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "$2") {
+			return nil, errors.New("Unsupported password entry in " +
+				passwdPath + ": only user:bcrypt-hash is supported")
+		}
+		ret.users[parts[0]] = []byte(parts[1])
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// authenticate verifies the HTTP basic authentication credentials of the
+// request and returns the name of the user.
+func (us *UploadService) authenticate(req *http.Request) (string, bool) {
+	var user, password string
+	var hash []byte
+	var ok bool
+
+	user, password, ok = req.BasicAuth()
+	if !ok {
+		return "", false
+	}
+
+	if hash, ok = us.users[user]; !ok {
+		return "", false
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", false
+	}
+
+	return user, true
+}
+
+// csrfMAC computes the message authentication code for a CSRF token issued
+// to "user" which expires at "expires".
+func (us *UploadService) csrfMAC(user string, expires int64) []byte {
+	var mac = hmac.New(sha256.New, us.csrfKey)
+
+	fmt.Fprintf(mac, "%s\x00%d", user, expires)
+	return mac.Sum(nil)
+}
+
+// csrfToken generates a new CSRF token for the given user.
+func (us *UploadService) csrfToken(user string) string {
+	var expires int64 = time.Now().Add(csrfTokenLifetime).Unix()
+
+	return fmt.Sprintf("%d:%s", expires,
+		hex.EncodeToString(us.csrfMAC(user, expires)))
+}
+
+// verifyCSRFToken determines whether the token was issued by us to the
+// given user and is still valid.
+func (us *UploadService) verifyCSRFToken(user, token string) bool {
+	var parts []string = strings.SplitN(token, ":", 2)
+	var expires int64
+	var mac []byte
+	var err error
+
+	if len(parts) != 2 {
+		return false
+	}
+
+	expires, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	mac, err = hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	return hmac.Equal(mac, us.csrfMAC(user, expires))
+}
+
+// parseCertificates decodes all certificates contained in "data", which can
+// either be a sequence of PEM blocks or DER encoded certificates.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var ret []*x509.Certificate
+	var block *pem.Block
+
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		return x509.ParseCertificates(data)
+	}
+
+	for {
+		var cert *x509.Certificate
+		var err error
+
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, cert)
+	}
+
+	return ret, nil
+}
+
+// readUpload collects the certificate data from the uploaded file and the
+// text area of the form.
+func readUpload(req *http.Request) ([]byte, error) {
+	var data []byte = []byte(req.FormValue("pem"))
+	var f multipart.File
+	var file []byte
+	var err error
+
+	f, _, err = req.FormFile("certificate")
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return data, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	file, err = ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// Mixing PEM and DER in one upload doesn't work, so keep DER files
+	// separate unless there's nothing else.
+	if len(bytes.TrimSpace(data)) == 0 {
+		return file, nil
+	}
+	if !bytes.Contains(file, []byte("-----BEGIN")) {
+		return nil, errors.New(
+			"Cannot combine a DER encoded file with pasted PEM data")
+	}
+	return append(append(data, '\n'), file...), nil
+}
+
+// encodeCertificates converts the certificates into a PEM bundle, to be
+// submitted again after the user confirmed the preview.
+func encodeCertificates(certs []*x509.Certificate) string {
+	var buf bytes.Buffer
+	var cert *x509.Certificate
+
+	for _, cert = range certs {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.String()
+}
+
+// checkCertificates describes the uploaded certificates for the preview,
+// and determines which of them would replace a different certificate
+// stored under the same index, either on the server or in the upload.
+func (us *UploadService) checkCertificates(certs []*x509.Certificate) (
+	[]*uploadedCert, error) {
+	var ret []*uploadedCert
+	var seen = make(map[uint64][]byte)
+	var cert *x509.Certificate
+	var err error
+
+	for _, cert = range certs {
+		var uploaded = &uploadedCert{
+			Index:     cert.SerialNumber.Uint64(),
+			Subject:   string(keydb.FormatCertSubject(cert.Subject)),
+			Issuer:    string(keydb.FormatCertSubject(cert.Issuer)),
+			Expires:   cert.NotAfter,
+			IsCA:      cert.IsCA,
+			Truncated: !cert.SerialNumber.IsUint64(),
+		}
+		var existing *x509keyserver.X509KeyData
+		var der []byte
+		var ok bool
+
+		if der, ok = seen[uploaded.Index]; ok {
+			uploaded.Conflict = !bytes.Equal(der, cert.Raw)
+		} else {
+			seen[uploaded.Index] = cert.Raw
+
+			existing, err = us.Db.RetrieveKeyDataByIndex(uploaded.Index)
+			if err == nil {
+				uploaded.Existing = bytes.Equal(
+					existing.DerCertificate, cert.Raw)
+				uploaded.Conflict = !uploaded.Existing
+			} else if err != keydb.ErrNotFound {
+				return nil, err
+			}
+		}
+
+		ret = append(ret, uploaded)
+	}
+
+	return ret, nil
+}
+
+// Display the upload form, the preview of uploaded certificates or store
+// them, depending on the request.
+func (us *UploadService) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var data = new(uploadTemplateData)
+	var certs []*x509.Certificate
+	var cert *x509.Certificate
+	var uploaded *uploadedCert
+	var upload []byte
+	var i int
+	var ok bool
+	var err error
+
+	if data.User, ok = us.authenticate(req); !ok {
+		rw.Header().Set("WWW-Authenticate",
+			"Basic realm=\"x509keyserver upload\"")
+		rw.WriteHeader(http.StatusUnauthorized)
+		rw.Write([]byte("Authentication required"))
+		return
+	}
+
+	data.Token = us.csrfToken(data.User)
+
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		us.Tmpl.Execute(rw, data)
+		return
+	}
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", "GET, HEAD, POST")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	req.Body = http.MaxBytesReader(rw, req.Body, maxUploadSize)
+	err = req.ParseMultipartForm(maxUploadSize)
+	if err != nil && err != http.ErrNotMultipart {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	if !us.verifyCSRFToken(data.User, req.PostFormValue("token")) {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte("Invalid or expired form token, please try again"))
+		return
+	}
+
+	upload, err = readUpload(req)
+	if err == nil {
+		certs, err = parseCertificates(upload)
+	}
+	if err == nil && len(certs) == 0 {
+		err = errors.New("No certificates found in the uploaded data")
+	}
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		data.Error = err.Error()
+		us.Tmpl.Execute(rw, data)
+		return
+	}
+
+	data.Certs, err = us.checkCertificates(certs)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		data.Error = err.Error()
+		us.Tmpl.Execute(rw, data)
+		return
+	}
+	for _, uploaded = range data.Certs {
+		data.Conflicts = data.Conflicts || uploaded.Conflict
+	}
+
+	if data.Conflicts {
+		rw.WriteHeader(http.StatusConflict)
+		data.Error = "Some certificates have the same index as a " +
+			"different certificate and cannot be stored"
+		us.Tmpl.Execute(rw, data)
+		return
+	}
+
+	if req.PostFormValue("action") != "store" {
+		data.PEM = encodeCertificates(certs)
+		us.Tmpl.Execute(rw, data)
+		return
+	}
+
+	for i, cert = range certs {
+		if data.Certs[i].Existing {
+			continue
+		}
+
+		err = us.Db.AddX509Certificate(cert)
+		if err != nil {
+			rw.WriteHeader(http.StatusInternalServerError)
+			data.Error = fmt.Sprintf("Error storing certificate %s: %s",
+				cert.SerialNumber, err)
+			us.Tmpl.Execute(rw, data)
+			return
+		}
+	}
+
+	data.Stored = true
+	us.Tmpl.Execute(rw, data)
+}
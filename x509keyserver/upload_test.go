@@ -0,0 +1,290 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/caoimhechaos/x509keyserver/keydb"
+	"github.com/caoimhechaos/x509keyserver/x509keyservertest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Find the CSRF token in the upload form.
+var uploadTokenRe = regexp.MustCompile(`name="token" value="([^"]*)"`)
+
+// Create an upload service for the user "admin" with the password "secret".
+func newTestUploadService(t *testing.T, db keydb.KeyDB) *UploadService {
+	var us *UploadService
+	var dir string
+	var hash []byte
+	var err error
+
+	dir, err = ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, err = bcrypt.GenerateFromPassword([]byte("secret"),
+		bcrypt.MinCost)
+	if err != nil {
+		t.Fatal("Error hashing password: ", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "passwd"),
+		[]byte("# Test users\nadmin:"+string(hash)+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	us, err = NewUploadService(db, parseTemplate(t, "upload.html"),
+		filepath.Join(dir, "passwd"))
+	if err != nil {
+		t.Fatal("Error setting up uploads: ", err)
+	}
+	return us
+}
+
+// Create an authenticated upload request with the given form values.
+func uploadRequest(method string, form url.Values) *http.Request {
+	var req *http.Request = httptest.NewRequest(method, "/upload",
+		strings.NewReader(form.Encode()))
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("admin", "secret")
+	return req
+}
+
+func TestUploadRequiresAuthentication(t *testing.T) {
+	var us = newTestUploadService(t, keydb.NewMemoryKeyDB())
+	var req *http.Request = httptest.NewRequest("GET", "/upload", nil)
+	var res *http.Response
+
+	res, _ = serve(us, req)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without credentials, got %d",
+			http.StatusUnauthorized, res.StatusCode)
+	}
+
+	req.SetBasicAuth("admin", "wrong")
+	res, _ = serve(us, req)
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status %d with the wrong password, got %d",
+			http.StatusUnauthorized, res.StatusCode)
+	}
+}
+
+func TestUploadRejectsInvalidCSRFToken(t *testing.T) {
+	var db *keydb.MemoryKeyDB = keydb.NewMemoryKeyDB()
+	var us = newTestUploadService(t, db)
+	var other = newTestUploadService(t, db)
+	var ca *x509keyservertest.Certificate
+	var form = url.Values{}
+	var res *http.Response
+	var body string
+	var token string
+	var err error
+
+	ca, err = x509keyservertest.NewCA("Uploaded CA")
+	if err != nil {
+		t.Fatal("Error generating certificate: ", err)
+	}
+	form.Set("pem", encodeCertificates([]*x509.Certificate{ca.Cert}))
+	form.Set("action", "store")
+
+	res, _ = serve(us, uploadRequest("POST", form))
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status %d without a token, got %d",
+			http.StatusForbidden, res.StatusCode)
+	}
+
+	// Tokens issued by a different instance must not be accepted.
+	_, body = serve(other, uploadRequest("GET", nil))
+	form.Set("token", uploadTokenRe.FindStringSubmatch(body)[1])
+	res, _ = serve(us, uploadRequest("POST", form))
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status %d with a foreign token, got %d",
+			http.StatusForbidden, res.StatusCode)
+	}
+
+	if _, err = db.RetrieveKeyDataByIndex(
+		ca.Cert.SerialNumber.Uint64()); err != keydb.ErrNotFound {
+		t.Fatal("Certificate stored despite invalid token: ", err)
+	}
+
+	res, body = serve(us, uploadRequest("GET", nil))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", res.StatusCode, body)
+	}
+	token = uploadTokenRe.FindStringSubmatch(body)[1]
+	form.Set("token", token)
+
+	res, body = serve(us, uploadRequest("POST", form))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", res.StatusCode, body)
+	}
+	if _, err = db.RetrieveKeyDataByIndex(
+		ca.Cert.SerialNumber.Uint64()); err != nil {
+		t.Error("Certificate not stored with a valid token: ", err)
+	}
+}
+
+func TestUploadPreviewAndStore(t *testing.T) {
+	var db *keydb.MemoryKeyDB = keydb.NewMemoryKeyDB()
+	var us = newTestUploadService(t, db)
+	var ca *x509keyservertest.Certificate
+	var form = url.Values{}
+	var res *http.Response
+	var body string
+	var err error
+
+	ca, err = x509keyservertest.NewCA("Uploaded CA")
+	if err != nil {
+		t.Fatal("Error generating certificate: ", err)
+	}
+
+	_, body = serve(us, uploadRequest("GET", nil))
+	form.Set("token", uploadTokenRe.FindStringSubmatch(body)[1])
+	form.Set("pem", encodeCertificates([]*x509.Certificate{ca.Cert}))
+	form.Set("action", "preview")
+
+	res, body = serve(us, uploadRequest("POST", form))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", res.StatusCode, body)
+	}
+	if !strings.Contains(body, "Uploaded CA") ||
+		!strings.Contains(body, "New") {
+		t.Error("Preview doesn't describe the new certificate: ", body)
+	}
+	if !strings.Contains(body, `name="action" value="store"`) {
+		t.Error("Preview doesn't offer to store the certificate")
+	}
+	if _, err = db.RetrieveKeyDataByIndex(
+		ca.Cert.SerialNumber.Uint64()); err != keydb.ErrNotFound {
+		t.Fatal("Certificate stored by the preview: ", err)
+	}
+
+	form.Set("action", "store")
+	res, body = serve(us, uploadRequest("POST", form))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", res.StatusCode, body)
+	}
+	if !strings.Contains(body, "have been stored") {
+		t.Error("Storing the certificate wasn't confirmed: ", body)
+	}
+	if _, err = db.RetrieveKeyDataByIndex(
+		ca.Cert.SerialNumber.Uint64()); err != nil {
+		t.Fatal("Certificate not stored: ", err)
+	}
+
+	// Uploading it again is harmless.
+	form.Set("action", "preview")
+	res, body = serve(us, uploadRequest("POST", form))
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", res.StatusCode, body)
+	}
+	if !strings.Contains(body, "Already stored") {
+		t.Error("Stored certificate not recognized: ", body)
+	}
+}
+
+func TestUploadDetectsConflicts(t *testing.T) {
+	var db *keydb.MemoryKeyDB = keydb.NewMemoryKeyDB()
+	var us = newTestUploadService(t, db)
+	var stored, other *x509keyservertest.Certificate
+	var cert *x509.Certificate
+	var form = url.Values{}
+	var res *http.Response
+	var body string
+	var err error
+
+	stored, err = x509keyservertest.NewCA("Stored CA")
+	if err == nil {
+		other, err = x509keyservertest.NewCA("Other CA",
+			x509keyservertest.WithSerial(stored.Cert.SerialNumber))
+	}
+	if err != nil {
+		t.Fatal("Error generating certificates: ", err)
+	}
+	err = db.AddX509Certificate(stored.Cert)
+	if err != nil {
+		t.Fatal("Error adding certificate: ", err)
+	}
+
+	_, body = serve(us, uploadRequest("GET", nil))
+	form.Set("token", uploadTokenRe.FindStringSubmatch(body)[1])
+	form.Set("pem", encodeCertificates([]*x509.Certificate{other.Cert}))
+	form.Set("action", "store")
+
+	res, body = serve(us, uploadRequest("POST", form))
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status %d, got %d", http.StatusConflict,
+			res.StatusCode)
+	}
+	if !strings.Contains(body, "A different certificate has the same index") {
+		t.Error("Conflict not described: ", body)
+	}
+
+	cert, err = db.RetrieveCertificateByIndex(
+		stored.Cert.SerialNumber.Uint64())
+	if err != nil {
+		t.Fatal("Error retrieving certificate: ", err)
+	}
+	if !cert.Equal(stored.Cert) {
+		t.Error("Stored certificate was replaced")
+	}
+
+	// Two different certificates with the same index in one upload
+	// conflict as well.
+	form.Set("pem", encodeCertificates([]*x509.Certificate{
+		stored.Cert, other.Cert}))
+	db = keydb.NewMemoryKeyDB()
+	us.Db = db
+	res, _ = serve(us, uploadRequest("POST", form))
+	if res.StatusCode != http.StatusConflict {
+		t.Errorf("Expected status %d within the upload, got %d",
+			http.StatusConflict, res.StatusCode)
+	}
+	if _, err = db.RetrieveKeyDataByIndex(
+		stored.Cert.SerialNumber.Uint64()); err != keydb.ErrNotFound {
+		t.Error("Conflicting upload was stored: ", err)
+	}
+}
@@ -0,0 +1,280 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyservertest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math"
+	"math/big"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Validity of generated certificates unless specified otherwise.
+const defaultValidity = 24 * time.Hour
+
+// Used for giving every generated certificate a unique serial number.
+var serialSequence uint64
+
+// Certificate is a generated certificate along with its private key.
+type Certificate struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// CertOption modifies the template from which a certificate is generated.
+type CertOption func(*x509.Certificate)
+
+// WithSerial sets the serial number, and thus the index on the key server,
+// of the certificate. By default, every certificate gets a unique serial.
+func WithSerial(serial *big.Int) CertOption {
+	return func(tmpl *x509.Certificate) {
+		tmpl.SerialNumber = serial
+	}
+}
+
+// WithValidity sets the time range in which the certificate is valid. By
+// default, certificates are valid from now on for a day.
+func WithValidity(not_before, not_after time.Time) CertOption {
+	return func(tmpl *x509.Certificate) {
+		tmpl.NotBefore = not_before
+		tmpl.NotAfter = not_after
+	}
+}
+
+// WithSubject replaces the subject of the certificate.
+func WithSubject(subject pkix.Name) CertOption {
+	return func(tmpl *x509.Certificate) {
+		tmpl.Subject = subject
+	}
+}
+
+// Expired makes the certificate expire before it is generated.
+func Expired() CertOption {
+	return WithValidity(time.Now().Add(-2*defaultValidity),
+		time.Now().Add(-defaultValidity))
+}
+
+// NotYetValid makes the certificate become valid only after a day.
+func NotYetValid() CertOption {
+	return WithValidity(time.Now().Add(defaultValidity),
+		time.Now().Add(2*defaultValidity))
+}
+
+// Create a certificate template for "name" with the defaults applied.
+func newTemplate(name string, ca bool, opts []CertOption) *x509.Certificate {
+	var now time.Time = time.Now()
+	var tmpl = &x509.Certificate{
+		SerialNumber: new(big.Int).SetUint64(
+			atomic.AddUint64(&serialSequence, 1)),
+		Subject: pkix.Name{
+			Organization: []string{"x509keyservertest"},
+			CommonName:   name,
+		},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(defaultValidity),
+		BasicConstraintsValid: true,
+		IsCA:                  ca,
+	}
+	var opt CertOption
+
+	if ca {
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		tmpl.KeyUsage = x509.KeyUsageDigitalSignature
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{
+			x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
+		tmpl.DNSNames = []string{name}
+	}
+
+	for _, opt = range opts {
+		opt(tmpl)
+	}
+	return tmpl
+}
+
+// Sign the certificate described by "tmpl" with the key of "issuer", or
+// create a self-signed certificate if "issuer" is nil.
+func generate(tmpl *x509.Certificate, issuer *Certificate) (
+	*Certificate, error) {
+	var key *ecdsa.PrivateKey
+	var parent *x509.Certificate = tmpl
+	var signer crypto.Signer
+	var der []byte
+	var err error
+
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	signer = key
+
+	if issuer != nil {
+		parent = issuer.Cert
+		signer = issuer.Key
+	}
+
+	der, err = x509.CreateCertificate(rand.Reader, tmpl, parent,
+		key.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Certificate{
+		Cert: tmpl,
+		Key:  key,
+	}, nil
+}
+
+// NewCA generates a self-signed root CA certificate with the common name
+// "name".
+func NewCA(name string, opts ...CertOption) (*Certificate, error) {
+	return generate(newTemplate(name, true, opts), nil)
+}
+
+// IssueCA generates an intermediate CA certificate with the common name
+// "name" which is signed by "c".
+func (c *Certificate) IssueCA(name string, opts ...CertOption) (
+	*Certificate, error) {
+	return generate(newTemplate(name, true, opts), c)
+}
+
+// Issue generates a leaf certificate for client and server authentication
+// with the common name and DNS name "name" which is signed by "c".
+func (c *Certificate) Issue(name string, opts ...CertOption) (
+	*Certificate, error) {
+	return generate(newTemplate(name, false, opts), c)
+}
+
+// Hierarchy is a generated CA hierarchy.
+type Hierarchy struct {
+	Root         *Certificate
+	Intermediate *Certificate
+	Leaves       []*Certificate
+}
+
+// Certificates returns all certificates of the hierarchy, starting with
+// the root.
+func (h *Hierarchy) Certificates() []*x509.Certificate {
+	var ret = []*x509.Certificate{h.Root.Cert, h.Intermediate.Cert}
+	var leaf *Certificate
+
+	for _, leaf = range h.Leaves {
+		ret = append(ret, leaf.Cert)
+	}
+	return ret
+}
+
+// NewHierarchy generates a root CA, an intermediate CA signed by it and
+// "leaves" leaf certificates signed by the intermediate CA.
+func NewHierarchy(leaves int) (*Hierarchy, error) {
+	var ret = new(Hierarchy)
+	var leaf *Certificate
+	var i int
+	var err error
+
+	ret.Root, err = NewCA("Test Root CA")
+	if err != nil {
+		return nil, err
+	}
+
+	ret.Intermediate, err = ret.Root.IssueCA("Test Intermediate CA")
+	if err != nil {
+		return nil, err
+	}
+
+	for i = 0; i < leaves; i++ {
+		leaf, err = ret.Intermediate.Issue(
+			"leaf" + strconv.Itoa(i) + ".example.com")
+		if err != nil {
+			return nil, err
+		}
+		ret.Leaves = append(ret.Leaves, leaf)
+	}
+
+	return ret, nil
+}
+
+// EdgeCases generates certificates signed by "issuer" which are likely to
+// expose bugs in code handling certificates from the key server:
+//
+//   - a certificate which has already expired,
+//   - a certificate which isn't valid yet,
+//   - a certificate with the highest possible index,
+//   - a certificate whose serial number doesn't fit into an index, so it is
+//     stored under the lower 64 bits of it,
+//   - a certificate with an empty subject, and
+//   - a certificate with a long subject containing non-ASCII characters.
+func EdgeCases(issuer *Certificate) ([]*Certificate, error) {
+	var huge *big.Int = new(big.Int).Lsh(big.NewInt(1), 70)
+	var cases = [][]CertOption{
+		{Expired()},
+		{NotYetValid()},
+		{WithSerial(new(big.Int).SetUint64(math.MaxUint64))},
+		{WithSerial(huge.Add(huge, big.NewInt(
+			int64(atomic.AddUint64(&serialSequence, 1)))))},
+		{WithSubject(pkix.Name{})},
+		{WithSubject(pkix.Name{
+			Country:            []string{"CH"},
+			Province:           []string{"Zürich"},
+			Locality:           []string{"Zürich"},
+			Organization:       []string{"Ünïcödé Test Org", "Second Org"},
+			OrganizationalUnit: []string{"Ops", "Security"},
+			CommonName:         "ein-sehr-langer-name.beispiel.example.com",
+		})},
+	}
+	var ret []*Certificate
+	var cert *Certificate
+	var opts []CertOption
+	var err error
+
+	for _, opts = range cases {
+		cert, err = issuer.Issue("edge-case.example.com", opts...)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, cert)
+	}
+
+	return ret, nil
+}
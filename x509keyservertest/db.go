@@ -0,0 +1,72 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package x509keyservertest
+
+import (
+	"crypto/x509"
+
+	"github.com/caoimhechaos/x509keyserver/keydb"
+)
+
+// AddCertificates adds the given certificates to "db", stopping at the
+// first error.
+func AddCertificates(db keydb.KeyDB, certs ...*x509.Certificate) error {
+	var cert *x509.Certificate
+	var err error
+
+	for _, cert = range certs {
+		err = db.AddX509Certificate(cert)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewHierarchyDB creates an in-memory key database holding a newly
+// generated CA hierarchy with the given number of leaves.
+func NewHierarchyDB(leaves int) (*keydb.MemoryKeyDB, *Hierarchy, error) {
+	var db *keydb.MemoryKeyDB = keydb.NewMemoryKeyDB()
+	var h *Hierarchy
+	var err error
+
+	h, err = NewHierarchy(leaves)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = AddCertificates(db, h.Certificates()...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, h, nil
+}
@@ -0,0 +1,200 @@
+/*
+ * (c) 2016, Caoimhe Chaos <caoimhechaos@protonmail.com>,
+ *	     Starship Factory. All rights reserved.
+ *
+ * Redistribution and use in source  and binary forms, with or without
+ * modification, are permitted  provided that the following conditions
+ * are met:
+ *
+ * * Redistributions of  source code  must retain the  above copyright
+ *   notice, this list of conditions and the following disclaimer.
+ * * Redistributions in binary form must reproduce the above copyright
+ *   notice, this  list of conditions and the  following disclaimer in
+ *   the  documentation  and/or  other  materials  provided  with  the
+ *   distribution.
+ * * Neither  the name  of the Starship Factory  nor the  name  of its
+ *   contributors may  be used to endorse or  promote products derived
+ *   from this software without specific prior written permission.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+ * "AS IS"  AND ANY EXPRESS  OR IMPLIED WARRANTIES  OF MERCHANTABILITY
+ * AND FITNESS  FOR A PARTICULAR  PURPOSE ARE DISCLAIMED. IN  NO EVENT
+ * SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL,  EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED  TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE,  DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT  LIABILITY,  OR  TORT  (INCLUDING NEGLIGENCE  OR  OTHERWISE)
+ * ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED
+ * OF THE POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// Package x509keyservertest provides an in-process X.509 key server for
+// testing code which uses X509KeyClient.
+package x509keyservertest
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/caoimhechaos/x509keyserver"
+	"github.com/caoimhechaos/x509keyserver/keydb"
+	"github.com/caoimhechaos/x509keyserver/rpcserver"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Size of the in-memory connection buffers.
+const bufferSize = 1 << 20
+
+// Server is a real X.509 key server which keeps its certificates in
+// memory and is reachable through an in-memory listener, so tests don't
+// need any network access. Errors and latency can be injected into the
+// RPCs it answers.
+type Server struct {
+	// DB holds the certificates served. It may be modified directly at
+	// any time.
+	DB *keydb.MemoryKeyDB
+
+	listener *bufconn.Listener
+	server   *grpc.Server
+
+	lock     sync.Mutex
+	errors   map[string]error
+	latency  time.Duration
+	requests map[string]int
+}
+
+// NewServer starts a new server without any certificates. It should be
+// stopped with Close once it is no longer needed.
+func NewServer() *Server {
+	var ret = &Server{
+		DB:       keydb.NewMemoryKeyDB(),
+		listener: bufconn.Listen(bufferSize),
+		errors:   make(map[string]error),
+		requests: make(map[string]int),
+	}
+
+	ret.server = grpc.NewServer(grpc.UnaryInterceptor(ret.intercept))
+	x509keyserver.RegisterX509KeyServerServer(ret.server,
+		rpcserver.NewX509KeyServer(ret.DB))
+	go ret.server.Serve(ret.listener)
+
+	return ret
+}
+
+// NewServerWithCA starts a new server holding a newly generated CA
+// certificate with the given name.
+func NewServerWithCA(name string) (*Server, *Certificate, error) {
+	var server = NewServer()
+	var ca *Certificate
+	var err error
+
+	ca, err = NewCA(name)
+	if err == nil {
+		err = server.AddCertificates(ca.Cert)
+	}
+	if err != nil {
+		server.Close()
+		return nil, nil, err
+	}
+	return server, ca, nil
+}
+
+// AddCertificates adds the given certificates to the server.
+func (s *Server) AddCertificates(certs ...*x509.Certificate) error {
+	return AddCertificates(s.DB, certs...)
+}
+
+// Revoke marks the certificate with the given index as revoked now.
+func (s *Server) Revoke(index uint64) error {
+	return s.DB.RevokeX509Certificate(index, time.Now())
+}
+
+// SetError makes all calls to the RPC "method", e.g.
+// "RetrieveCertificateByIndex", fail with "err" until it is reset by
+// passing nil. The empty method name applies to all RPCs. Errors created
+// with the status package are passed on to the client as is.
+func (s *Server) SetError(method string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err == nil {
+		delete(s.errors, method)
+	} else {
+		s.errors[method] = err
+	}
+}
+
+// SetLatency delays the answer to every RPC by "latency".
+func (s *Server) SetLatency(latency time.Duration) {
+	s.lock.Lock()
+	s.latency = latency
+	s.lock.Unlock()
+}
+
+// Requests returns the number of calls the server received for the RPC
+// "method", or for all RPCs if "method" is empty.
+func (s *Server) Requests(method string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[method]
+}
+
+// Apply the injected latency and errors to the RPCs received.
+func (s *Server) intercept(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (
+	interface{}, error) {
+	var method string = path.Base(info.FullMethod)
+	var latency time.Duration
+	var err error
+	var ok bool
+
+	s.lock.Lock()
+	s.requests[method]++
+	s.requests[""]++
+	latency = s.latency
+	if err, ok = s.errors[method]; !ok {
+		err = s.errors[""]
+	}
+	s.lock.Unlock()
+
+	if latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// Dial opens a new connection to the server. It can be passed to
+// x509keyserver.WithContextDialer or grpc.WithContextDialer.
+func (s *Server) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return s.listener.DialContext(ctx)
+}
+
+// NewClient creates a client connected to the server, configured by
+// "opts". The client must be closed by the caller.
+func (s *Server) NewClient(opts ...x509keyserver.ClientOption) (
+	*x509keyserver.X509KeyClient, error) {
+	return x509keyserver.NewClient("passthrough:///x509keyservertest",
+		append([]x509keyserver.ClientOption{
+			x509keyserver.WithContextDialer(s.Dial),
+		}, opts...)...)
+}
+
+// Close stops the server and closes all connections to it.
+func (s *Server) Close() {
+	s.server.Stop()
+	s.listener.Close()
+}